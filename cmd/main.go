@@ -29,7 +29,8 @@ func main() {
         ---------                 -----------------  --------------       -----
         namespaces                []                 []                   [list,watch,get]
         secrets,                  []                 []                   [list,watch,get]
-        selfsubjectaccessreviews  []                 []                   [create]`
+        selfsubjectaccessreviews  []                 []                   [create]
+        subjectaccessreviews      []                 []                   [create]`
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
@@ -47,9 +48,95 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  "proxy-url",
-			Usage: "[optional] URL to proxy",
+			Usage: "[optional] URL to proxy, separate the URLs of multiple replicas by comma",
 			Value: "http://localhost:9999",
 		},
+		cli.StringFlag{
+			Name:  "shard-urls",
+			Usage: "[optional] URLs of the Prometheus shards separated by comma, the tenant queries are sent to every shard and merged",
+		},
+		cli.StringFlag{
+			Name:  "upstream.tls.ca-file",
+			Usage: "[optional] Path to the CA bundle to verify the upstream certificate",
+		},
+		cli.StringFlag{
+			Name:  "upstream.tls.cert-file",
+			Usage: "[optional] Path to the client certificate file presented to the upstream",
+		},
+		cli.StringFlag{
+			Name:  "upstream.tls.key-file",
+			Usage: "[optional] Path to the client key file presented to the upstream",
+		},
+		cli.StringFlag{
+			Name:  "upstream.tls.server-name",
+			Usage: "[optional] Server name to verify the upstream certificate",
+		},
+		cli.BoolFlag{
+			Name:  "upstream.tls.insecure-skip-verify",
+			Usage: "[optional] Skip the upstream certificate verification",
+		},
+		cli.StringFlag{
+			Name:  "upstream.bearer-token-file",
+			Usage: "[optional] Path to the bearer token file injected into every upstream request",
+		},
+		cli.StringFlag{
+			Name:  "upstream.basic-auth.username",
+			Usage: "[optional] Basic auth username injected into every upstream request",
+		},
+		cli.StringFlag{
+			Name:  "upstream.basic-auth.password-file",
+			Usage: "[optional] Path to the basic auth password file",
+		},
+		cli.StringFlag{
+			Name:  "upstream.routing",
+			Usage: "[optional] How to route among multiple upstream replicas, 'round-robin' or 'sticky' (by user)",
+			Value: "round-robin",
+		},
+		cli.DurationFlag{
+			Name:  "upstream.health-check-interval",
+			Usage: "[optional] Interval to probe the '/-/ready' endpoint of multiple upstream replicas and the health of the gRPC upstream",
+			Value: 5 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "upstream.tenant-mapping",
+			Usage: "[optional] Inject the tenant header for a multi-tenant upstream (Cortex, Thanos, Mimir), mapping the caller namespaces by 'project', 'namespace' or 'template'",
+		},
+		cli.StringFlag{
+			Name:  "upstream.tenant-header",
+			Usage: "[optional] Header to carry the tenants, multiple tenants are separated by '|'",
+			Value: "X-Scope-OrgID",
+		},
+		cli.StringFlag{
+			Name:  "upstream.tenant-template",
+			Usage: "[optional] Go template to render the tenant of a namespace when mapping by 'template', e.g. '{{ .ProjectID }}-{{ .Namespace }}'",
+		},
+		cli.BoolFlag{
+			Name:  "upstream.tenant-skip-rewrite",
+			Usage: "[optional] Don't rewrite the namespace matchers when injecting the tenant header",
+		},
+		cli.StringFlag{
+			Name:  "grpc-upstream",
+			Usage: "[optional] gRPC target (host:port) of the upstream StoreAPI, defaults to the host of the first '--proxy-url'",
+		},
+		cli.BoolFlag{
+			Name:  "grpc-upstream.insecure",
+			Usage: "[optional] Dial the gRPC upstream without TLS, regardless of the '--upstream.tls.*' settings",
+		},
+		cli.DurationFlag{
+			Name:  "grpc-upstream.keepalive-time",
+			Usage: "[optional] Interval of the keepalive pings on the gRPC upstream connection",
+			Value: 5 * time.Minute,
+		},
+		cli.StringSliceFlag{
+			Name:  "grpc.allow-methods",
+			Usage: "[optional] Only proxy the gRPC methods matching these patterns, e.g. '/thanos.Store/*'",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "grpc.deny-methods",
+			Usage: "[optional] Never proxy the gRPC methods matching these patterns, takes precedence over '--grpc.allow-methods'",
+			Value: &cli.StringSlice{},
+		},
 		cli.DurationFlag{
 			Name:  "read-timeout",
 			Usage: "[optional] Maximum duration before timing out read of the request, and closing idle connections",
@@ -62,9 +149,178 @@ func main() {
 		},
 		cli.StringSliceFlag{
 			Name:  "filter-reader-labels",
-			Usage: "[optional] Filter out the configured labels when calling '/api/v1/read'",
+			Usage: "[optional] Filter out the configured labels from the matchers and the responses of '/api/v1/read', e.g. 'prometheus_replica'",
 			Value: &cli.StringSlice{},
 		},
+		cli.BoolFlag{
+			Name:  "read.verify-namespaces",
+			Usage: "[optional] Drop the series of unauthorized namespaces from the streamed responses of '/api/v1/read'",
+		},
+		cli.StringFlag{
+			Name:  "write.unauthorized-series",
+			Usage: "[optional] Handle the series of unauthorized namespaces written to '/api/v1/write' by 'reject', 'drop' or 'relabel' into the only namespace of the caller",
+			Value: "reject",
+		},
+		cli.StringFlag{
+			Name:  "scope.mode",
+			Usage: "[optional] Handle the matchers selecting namespaces out of the caller scope by 'lenient', which selects nothing, or 'strict', which refuses the request",
+			Value: "lenient",
+		},
+		cli.BoolFlag{
+			Name:  "namespaces.history",
+			Usage: "[optional] Grant the data of a namespace only for the periods it belongs to the projects of the caller, the deleted or moved namespaces stay visible for their past periods",
+		},
+		cli.StringFlag{
+			Name:  "namespaces.history-file",
+			Usage: "[optional] Persist the namespace history into the file to survive restarts, required by '--namespaces.history', e.g. '/var/lib/prometheus-auth/namespaces.json'",
+		},
+		cli.StringSliceFlag{
+			Name:  "cluster-metrics",
+			Usage: "[optional] Series selectors of the metrics without namespace which tenants can read, e.g. '{__name__=~\"node_.*\"}' or 'up{job=\"apiserver\"}'",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "cluster-metrics.redact-labels",
+			Usage: "[optional] Hash the values of the configured labels on the series without namespace, e.g. 'instance'",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "metric-policy-file",
+			Usage: "[optional] Path to the YAML rules denying or allowing metric names to the tenants by user, group or project",
+		},
+		cli.StringSliceFlag{
+			Name:  "redact.hash-labels",
+			Usage: "[optional] Hash the values of the configured labels in the responses to the tenants, e.g. 'host_ip'",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "redact.drop-labels",
+			Usage: "[optional] Drop the configured labels from the responses to the tenants, e.g. 'node'",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "redact.key-file",
+			Usage: "[optional] Path to the key (at least 32 bytes) hashing the redacted label values, a random key is generated if not set",
+		},
+		cli.StringFlag{
+			Name:  "oidc.issuer-url",
+			Usage: "[optional] Issuer of the OIDC ID tokens to verify before the Kubernetes TokenReview, e.g. 'https://keycloak/realms/rancher'",
+		},
+		cli.StringFlag{
+			Name:  "oidc.client-id",
+			Usage: "[optional] Audience the OIDC ID tokens must be issued for",
+		},
+		cli.StringFlag{
+			Name:  "oidc.jwks-file",
+			Usage: "[optional] Path to the JWKS verifying the OIDC ID tokens, reloaded when it changes on disk",
+		},
+		cli.StringFlag{
+			Name:  "oidc.jwks-url",
+			Usage: "[optional] URL of the JWKS verifying the OIDC ID tokens, e.g. 'https://keycloak/realms/rancher/protocol/openid-connect/certs'",
+		},
+		cli.StringFlag{
+			Name:  "oidc.ca-file",
+			Usage: "[optional] Path to the CA bundle to verify the certificate of '--oidc.jwks-url'",
+		},
+		cli.DurationFlag{
+			Name:  "oidc.jwks-refresh-interval",
+			Usage: "[optional] Interval to refetch '--oidc.jwks-url', it is also refetched when a token is signed by an unknown key",
+			Value: time.Hour,
+		},
+		cli.StringFlag{
+			Name:  "oidc.username-claim",
+			Usage: "[optional] Claim of the OIDC ID token used as the username",
+			Value: "sub",
+		},
+		cli.StringFlag{
+			Name:  "oidc.uid-claim",
+			Usage: "[optional] Claim of the OIDC ID token used as the UID",
+			Value: "sub",
+		},
+		cli.StringFlag{
+			Name:  "oidc.groups-claim",
+			Usage: "[optional] Claim of the OIDC ID token used as the groups",
+			Value: "groups",
+		},
+		cli.StringFlag{
+			Name:  "oidc.username-prefix",
+			Usage: "[optional] Prefix prepended to the OIDC usernames, e.g. 'oidc:', defaults to '<issuer URL>#' unless the username claim is 'email', '-' disables it",
+		},
+		cli.StringFlag{
+			Name:  "oidc.groups-prefix",
+			Usage: "[optional] Prefix prepended to the OIDC groups, e.g. 'oidc:'",
+		},
+		cli.StringSliceFlag{
+			Name:  "bypass.users",
+			Usage: "[optional] Users proxied without the namespace restriction",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "bypass.groups",
+			Usage: "[optional] Groups proxied without the namespace restriction, e.g. 'system:masters'",
+			Value: &cli.StringSlice{},
+		},
+		cli.BoolFlag{
+			Name:  "bypass.cluster-view",
+			Usage: "[optional] Proxy the users without the namespace restriction if a SubjectAccessReview allows the cluster view",
+		},
+		cli.StringFlag{
+			Name:  "bypass.cluster-view.verb",
+			Usage: "[optional] Verb of the cluster view SubjectAccessReview",
+			Value: "list",
+		},
+		cli.StringFlag{
+			Name:  "bypass.cluster-view.group",
+			Usage: "[optional] API group of the cluster view SubjectAccessReview",
+		},
+		cli.StringFlag{
+			Name:  "bypass.cluster-view.resource",
+			Usage: "[optional] Resource of the cluster view SubjectAccessReview",
+			Value: "namespaces",
+		},
+		cli.BoolFlag{
+			Name:  "session.enabled",
+			Usage: "[optional] Serve '/_/login' and accept the browser session cookies it issues",
+		},
+		cli.StringFlag{
+			Name:  "session.secret-file",
+			Usage: "[optional] Path to the secret (at least 32 bytes) signing the browser session cookies, a random secret is generated if not set",
+		},
+		cli.DurationFlag{
+			Name:  "session.ttl",
+			Usage: "[optional] Lifetime of the browser session cookies issued by '/_/login'",
+			Value: 8 * time.Hour,
+		},
+		cli.StringFlag{
+			Name:  "session.cookie-name",
+			Usage: "[optional] Name of the browser session cookie",
+			Value: "prometheus_auth_session",
+		},
+		cli.StringFlag{
+			Name:  "access-token-param",
+			Usage: "[optional] Accept the access token from this query parameter for embedding, e.g. 'access_token'",
+		},
+		cli.StringFlag{
+			Name:  "tls.cert-file",
+			Usage: "[optional] Path to the TLS certificate file, enables TLS when set together with '--tls.key-file'",
+		},
+		cli.StringFlag{
+			Name:  "tls.key-file",
+			Usage: "[optional] Path to the TLS private key file",
+		},
+		cli.StringFlag{
+			Name:  "tls.client-ca-file",
+			Usage: "[optional] Path to the CA bundle to verify client certificates, the verified CN/SAN is used as the username",
+		},
+		cli.BoolFlag{
+			Name:  "tls.require-client-cert",
+			Usage: "[optional] Reject the connections without a verified client certificate",
+		},
+		cli.DurationFlag{
+			Name:  "tls.reload-interval",
+			Usage: "[optional] Interval to check the TLS files for changes, 0 disables the hot-reload",
+			Value: 30 * time.Second,
+		},
 	}
 
 	app.Before = func(context *cli.Context) error {
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/kube"
+	log "github.com/sirupsen/logrus"
+	authentication "k8s.io/api/authentication/v1"
+	authorization "k8s.io/api/authorization/v1"
+)
+
+const (
+	bypassReasonAgent       = "agent"
+	bypassReasonUser        = "user"
+	bypassReasonGroup       = "group"
+	bypassReasonClusterView = "cluster-view"
+	bypassReasonNone        = "none"
+)
+
+type bypassConfig struct {
+	users               []string
+	groups              []string
+	clusterView         bool
+	clusterViewVerb     string
+	clusterViewGroup    string
+	clusterViewResource string
+}
+
+func (c *bypassConfig) String() string {
+	if c == nil {
+		return ""
+	}
+
+	sb := &strings.Builder{}
+	if len(c.users) != 0 {
+		sb.WriteString(fmt.Sprintf(", bypassing users [%s]", strings.Join(c.users, ",")))
+	}
+	if len(c.groups) != 0 {
+		sb.WriteString(fmt.Sprintf(", bypassing groups [%s]", strings.Join(c.groups, ",")))
+	}
+	if c.clusterView {
+		sb.WriteString(fmt.Sprintf(", bypassing who can %s %s", c.clusterViewVerb, c.clusterViewResource))
+	}
+
+	return sb.String()
+}
+
+func (c *bypassConfig) clusterViewAttributes() authorization.ResourceAttributes {
+	return authorization.ResourceAttributes{
+		Verb:     c.clusterViewVerb,
+		Group:    c.clusterViewGroup,
+		Resource: c.clusterViewResource,
+	}
+}
+
+// bypassPolicy decides which callers skip the namespace restriction and are proxied as they are.
+type bypassPolicy struct {
+	agentUserInfo authentication.UserInfo
+	users         data.Set
+	groups        data.Set
+	clusterView   *authorization.ResourceAttributes
+	accessReviews kube.AccessReviews
+}
+
+func newBypassPolicy(agentUserInfo authentication.UserInfo, cfg *bypassConfig, accessReviews kube.AccessReviews) *bypassPolicy {
+	ret := &bypassPolicy{
+		agentUserInfo: agentUserInfo,
+		users:         data.Set{},
+		groups:        data.Set{},
+		accessReviews: accessReviews,
+	}
+
+	if cfg != nil {
+		ret.users = data.NewSet(cfg.users...)
+		ret.groups = data.NewSet(cfg.groups...)
+		if cfg.clusterView {
+			attributes := cfg.clusterViewAttributes()
+			ret.clusterView = &attributes
+		}
+	}
+
+	return ret
+}
+
+// decide returns the reason of bypassing, or bypassReasonNone if the caller must be restricted.
+func (p *bypassPolicy) decide(userInfo authentication.UserInfo) string {
+	if kube.MatchingUsers(p.agentUserInfo, userInfo) {
+		return bypassReasonAgent
+	}
+
+	if _, exist := p.users[userInfo.Username]; exist {
+		return bypassReasonUser
+	}
+
+	for _, group := range userInfo.Groups {
+		if _, exist := p.groups[group]; exist {
+			return bypassReasonGroup
+		}
+	}
+
+	if p.clusterView != nil && p.accessReviews != nil {
+		allowed, err := p.accessReviews.Allowed(userInfo, *p.clusterView)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to review cluster view of %s", userInfo.Username)
+		} else if allowed {
+			return bypassReasonClusterView
+		}
+	}
+
+	return bypassReasonNone
+}
+
+// bypass records the decision in metrics and logs, returns true if the caller is unrestricted.
+func (a *agent) bypass(userInfo authentication.UserInfo, protocol string) bool {
+	reason := a.bypassPolicy().decide(userInfo)
+	bypassDecisionsCounter.WithLabelValues(protocol, reason).Inc()
+
+	if reason == bypassReasonNone {
+		log.Debugf("Restrict %s on %s", userInfo.Username, protocol)
+		return false
+	}
+
+	// the dashboards of the admins and the proxy itself call all the time, the metrics count the decisions
+	log.Debugf("Bypass %s on %s by %s", userInfo.Username, protocol, reason)
+
+	return true
+}
+
+func (a *agent) bypassPolicy() *bypassPolicy {
+	if a.bypasses == nil {
+		return newBypassPolicy(a.userInfo, nil, nil)
+	}
+
+	return a.bypasses
+}
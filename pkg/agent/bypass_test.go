@@ -0,0 +1,68 @@
+//go:build test
+
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	authentication "k8s.io/api/authentication/v1"
+	authorization "k8s.io/api/authorization/v1"
+)
+
+type fakeAccessReviews struct {
+	allowedUsers map[string]bool
+	reviews      int
+}
+
+func (f *fakeAccessReviews) Allowed(userInfo authentication.UserInfo, attributes authorization.ResourceAttributes) (bool, error) {
+	f.reviews++
+	if attributes.Verb != "list" || attributes.Resource != "namespaces" {
+		return false, errors.New("unexpected attributes")
+	}
+
+	return f.allowedUsers[userInfo.Username], nil
+}
+
+func Test_bypassPolicy(t *testing.T) {
+	agentUserInfo := authentication.UserInfo{Username: "myUser", UID: "cluster-admin"}
+	reviews := &fakeAccessReviews{allowedUsers: map[string]bool{"viewer": true}}
+
+	policy := newBypassPolicy(agentUserInfo, &bypassConfig{
+		users:               []string{"alice"},
+		groups:              []string{"sre"},
+		clusterView:         true,
+		clusterViewVerb:     "list",
+		clusterViewResource: "namespaces",
+	}, reviews)
+
+	require.Equal(t, bypassReasonAgent, policy.decide(agentUserInfo))
+	require.Equal(t, bypassReasonUser, policy.decide(authentication.UserInfo{Username: "alice"}))
+	require.Equal(t, bypassReasonGroup, policy.decide(authentication.UserInfo{Username: "bob", Groups: []string{"devs", "sre"}}))
+	require.Equal(t, 0, reviews.reviews)
+
+	require.Equal(t, bypassReasonClusterView, policy.decide(authentication.UserInfo{Username: "viewer"}))
+	require.Equal(t, bypassReasonNone, policy.decide(authentication.UserInfo{Username: "someNamespacesUser"}))
+	require.Equal(t, 2, reviews.reviews)
+
+	// only the agent itself is bypassed by default
+	policy = newBypassPolicy(agentUserInfo, nil, reviews)
+	require.Equal(t, bypassReasonAgent, policy.decide(agentUserInfo))
+	require.Equal(t, bypassReasonNone, policy.decide(authentication.UserInfo{Username: "viewer"}))
+	require.Equal(t, 2, reviews.reviews)
+}
+
+func Test_agent_bypass(t *testing.T) {
+	agt := mockAgent(t)
+	agt.bypasses = newBypassPolicy(agt.userInfo, &bypassConfig{groups: []string{"sre"}}, nil)
+
+	before := testutil.ToFloat64(bypassDecisionsCounter.WithLabelValues("http", bypassReasonGroup))
+	require.True(t, agt.bypass(authentication.UserInfo{Username: "bob", Groups: []string{"sre"}}, "http"))
+	require.Equal(t, before+1, testutil.ToFloat64(bypassDecisionsCounter.WithLabelValues("http", bypassReasonGroup)))
+
+	before = testutil.ToFloat64(bypassDecisionsCounter.WithLabelValues("grpc", bypassReasonNone))
+	require.False(t, agt.bypass(authentication.UserInfo{Username: "bob"}, "grpc"))
+	require.Equal(t, before+1, testutil.ToFloat64(bypassDecisionsCounter.WithLabelValues("grpc", bypassReasonNone)))
+}
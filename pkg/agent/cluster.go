@@ -0,0 +1,25 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// clusterMetricsConfig allows the tenants to read the series without namespace, e.g. the node metrics.
+type clusterMetricsConfig struct {
+	selectors    []string
+	redactLabels []string
+}
+
+func (c *clusterMetricsConfig) String() string {
+	if c == nil || len(c.selectors) == 0 {
+		return ""
+	}
+
+	ret := fmt.Sprintf(", allowing cluster metrics [%s]", strings.Join(c.selectors, ","))
+	if len(c.redactLabels) != 0 {
+		ret += fmt.Sprintf(" redacting labels [%s]", strings.Join(c.redactLabels, ","))
+	}
+
+	return ret
+}
@@ -0,0 +1,38 @@
+//go:build test
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_apiContext_clusterSelectors(t *testing.T) {
+	selectors, err := prom.ParseClusterSelectors([]string{`{__name__=~"node_.*"}`})
+	require.NoError(t, err)
+
+	apiCtx := &apiContext{
+		namespaceSet:     data.NewSet("ns-a"),
+		clusterSelectors: selectors,
+		rewriteMatchers:  true,
+		nameFilter:       &prom.MetricNameFilter{Deny: "kube_secret_.*"},
+	}
+
+	testCases := map[string]string{
+		`node_cpu_seconds_total`:                                  `node_cpu_seconds_total{__name__!~"kube_secret_.*",namespace=""}`,
+		`rate(node_cpu_seconds_total[5m])`:                        `rate(node_cpu_seconds_total{__name__!~"kube_secret_.*",namespace=""}[5m])`,
+		`increase(node_cpu_seconds_total{cpu="0"}[1h] offset 5m)`: `increase(node_cpu_seconds_total{__name__!~"kube_secret_.*",cpu="0",namespace=""}[1h] offset 5m)`,
+		`rate(up[5m])`:                      `rate(up{__name__!~"kube_secret_.*",namespace="ns-a"}[5m])`,
+		`max_over_time(node_load1[10m:1m])`: `max_over_time(node_load1{__name__!~"kube_secret_.*",namespace=""}[10m:1m])`,
+	}
+
+	for input, expect := range testCases {
+		expr, err := parser.ParseExpr(input)
+		require.NoError(t, err, input)
+		require.Equal(t, expect, apiCtx.modifyExpression(expr), input)
+	}
+}
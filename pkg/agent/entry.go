@@ -18,8 +18,10 @@ import (
 	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/rancher/prometheus-auth/pkg/data"
 	"github.com/rancher/prometheus-auth/pkg/kube"
+	"github.com/rancher/prometheus-auth/pkg/prom"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/netutil"
 	"google.golang.org/grpc"
 	authentication "k8s.io/api/authentication/v1"
@@ -43,17 +45,64 @@ func Run(cliContext *cli.Context) {
 		readTimeout:          cliContext.Duration("read-timeout"),
 		maxConnections:       cliContext.Int("max-connections"),
 		filterReaderLabelSet: data.NewSet(cliContext.StringSlice("filter-reader-labels")...),
+		verifyReadNamespaces: cliContext.Bool("read.verify-namespaces"),
+		writeMode:            cliContext.String("write.unauthorized-series"),
+		scopeMode:            cliContext.String("scope.mode"),
+		namespaceHistory:     cliContext.Bool("namespaces.history"),
+		namespaceHistoryFile: cliContext.String("namespaces.history-file"),
+	}
+	if err := validateScopeMode(cfg.scopeMode); err != nil {
+		log.WithError(err).Fatal("Unable to parse scope.mode")
+	}
+	if err := validateWriteMode(cfg.writeMode); err != nil {
+		log.WithError(err).Fatal("Unable to parse write.unauthorized-series")
+	}
+	if cfg.namespaceHistory && len(cfg.namespaceHistoryFile) == 0 {
+		// without the file, the namespaces created before a restart would be regarded as members since ever
+		log.Fatal("--namespaces.history requires --namespaces.history-file")
 	}
 
 	proxyURLString := cliContext.String("proxy-url")
 	if len(proxyURLString) == 0 {
 		log.Fatal("--agent.proxy-url is blank")
 	}
-	proxyURL, err := url.Parse(proxyURLString)
+	proxyURLs, err := parseProxyURLs(proxyURLString)
 	if err != nil {
-		log.Fatal("Unable to parse agent.proxy-url")
+		log.WithError(err).Fatal("Unable to parse agent.proxy-url")
+	}
+	cfg.proxyURL = proxyURLs[0]
+	cfg.proxyURLs = proxyURLs
+
+	if shardURLString := cliContext.String("shard-urls"); len(shardURLString) != 0 {
+		shardURLs, err := parseProxyURLs(shardURLString)
+		if err != nil {
+			log.WithError(err).Fatal("Unable to parse shard-urls")
+		}
+		cfg.shardURLs = shardURLs
+	}
+	cfg.upstream = &upstreamConfig{
+		caFile:                cliContext.String("upstream.tls.ca-file"),
+		certFile:              cliContext.String("upstream.tls.cert-file"),
+		keyFile:               cliContext.String("upstream.tls.key-file"),
+		serverName:            cliContext.String("upstream.tls.server-name"),
+		insecureSkipVerify:    cliContext.Bool("upstream.tls.insecure-skip-verify"),
+		bearerTokenFile:       cliContext.String("upstream.bearer-token-file"),
+		basicAuthUsername:     cliContext.String("upstream.basic-auth.username"),
+		basicAuthPasswordFile: cliContext.String("upstream.basic-auth.password-file"),
+		routing:               cliContext.String("upstream.routing"),
+		healthCheckInterval:   cliContext.Duration("upstream.health-check-interval"),
+	}
+
+	cfg.grpcUpstream = &grpcUpstreamConfig{
+		target:         cliContext.String("grpc-upstream"),
+		insecure:       cliContext.Bool("grpc-upstream.insecure"),
+		keepaliveTime:  cliContext.Duration("grpc-upstream.keepalive-time"),
+		allowedMethods: cliContext.StringSlice("grpc.allow-methods"),
+		deniedMethods:  cliContext.StringSlice("grpc.deny-methods"),
+	}
+	if len(cfg.grpcUpstream.target) == 0 {
+		cfg.grpcUpstream.target = grpcTargetFromURL(cfg.proxyURL)
 	}
-	cfg.proxyURL = proxyURL
 
 	accessTokenPath := "/var/run/secrets/kubernetes.io/serviceaccount/token"
 	accessTokenBytes, err := ioutil.ReadFile(accessTokenPath)
@@ -66,6 +115,74 @@ func Run(cliContext *cli.Context) {
 	}
 	cfg.myToken = accessToken
 
+	cfg.tenant = &tenantConfig{
+		header:          cliContext.String("upstream.tenant-header"),
+		mapping:         cliContext.String("upstream.tenant-mapping"),
+		template:        cliContext.String("upstream.tenant-template"),
+		rewriteMatchers: !cliContext.Bool("upstream.tenant-skip-rewrite"),
+	}
+	if cfg.tenant.enabled() {
+		cfg.upstream.tenantHeader = cfg.tenant.header
+	}
+
+	cfg.oidc = &oidcConfig{
+		issuerURL:           cliContext.String("oidc.issuer-url"),
+		clientID:            cliContext.String("oidc.client-id"),
+		jwksFile:            cliContext.String("oidc.jwks-file"),
+		jwksURL:             cliContext.String("oidc.jwks-url"),
+		caFile:              cliContext.String("oidc.ca-file"),
+		jwksRefreshInterval: cliContext.Duration("oidc.jwks-refresh-interval"),
+		usernameClaim:       cliContext.String("oidc.username-claim"),
+		uidClaim:            cliContext.String("oidc.uid-claim"),
+		groupsClaim:         cliContext.String("oidc.groups-claim"),
+		usernamePrefix:      cliContext.String("oidc.username-prefix"),
+		groupsPrefix:        cliContext.String("oidc.groups-prefix"),
+	}
+
+	cfg.bypass = &bypassConfig{
+		users:               cliContext.StringSlice("bypass.users"),
+		groups:              cliContext.StringSlice("bypass.groups"),
+		clusterView:         cliContext.Bool("bypass.cluster-view"),
+		clusterViewVerb:     cliContext.String("bypass.cluster-view.verb"),
+		clusterViewGroup:    cliContext.String("bypass.cluster-view.group"),
+		clusterViewResource: cliContext.String("bypass.cluster-view.resource"),
+	}
+
+	cfg.session = &sessionConfig{
+		enabled:          cliContext.Bool("session.enabled"),
+		secretFile:       cliContext.String("session.secret-file"),
+		ttl:              cliContext.Duration("session.ttl"),
+		cookieName:       cliContext.String("session.cookie-name"),
+		accessTokenParam: cliContext.String("access-token-param"),
+	}
+
+	cfg.clusterMetrics = &clusterMetricsConfig{
+		selectors:    cliContext.StringSlice("cluster-metrics"),
+		redactLabels: cliContext.StringSlice("cluster-metrics.redact-labels"),
+	}
+
+	cfg.metricPolicyFile = cliContext.String("metric-policy-file")
+
+	cfg.redact = &redactConfig{
+		keyFile:    cliContext.String("redact.key-file"),
+		hashLabels: cliContext.StringSlice("redact.hash-labels"),
+		dropLabels: cliContext.StringSlice("redact.drop-labels"),
+	}
+
+	cfg.tls = &tlsConfig{
+		certFile:          cliContext.String("tls.cert-file"),
+		keyFile:           cliContext.String("tls.key-file"),
+		clientCAFile:      cliContext.String("tls.client-ca-file"),
+		requireClientCert: cliContext.Bool("tls.require-client-cert"),
+		reloadInterval:    cliContext.Duration("tls.reload-interval"),
+	}
+	if (len(cfg.tls.certFile) == 0) != (len(cfg.tls.keyFile) == 0) {
+		log.Fatal("--tls.cert-file and --tls.key-file must be set together")
+	}
+	if !cfg.tls.enabled() && len(cfg.tls.clientCAFile) != 0 {
+		log.Fatal("--tls.client-ca-file requires --tls.cert-file and --tls.key-file")
+	}
+
 	log.Println(cfg)
 
 	reader, err := createAgent(cfg)
@@ -83,17 +200,89 @@ type agentConfig struct {
 	myToken              string
 	listenAddress        string
 	proxyURL             *url.URL
+	proxyURLs            []*url.URL
+	shardURLs            []*url.URL
 	readTimeout          time.Duration
 	maxConnections       int
 	filterReaderLabelSet data.Set
+	verifyReadNamespaces bool
+	writeMode            string
+	scopeMode            string
+	namespaceHistory     bool
+	namespaceHistoryFile string
+	tls                  *tlsConfig
+	upstream             *upstreamConfig
+	tenant               *tenantConfig
+	grpcUpstream         *grpcUpstreamConfig
+	oidc                 *oidcConfig
+	session              *sessionConfig
+	bypass               *bypassConfig
+	clusterMetrics       *clusterMetricsConfig
+	metricPolicyFile     string
+	redact               *redactConfig
 }
 
 func (a *agentConfig) String() string {
 	sb := &strings.Builder{}
 
 	sb.WriteString(fmt.Sprint("listening on ", a.listenAddress))
-	sb.WriteString(fmt.Sprint(", proxying to ", a.proxyURL.String()))
+	if a.tls.enabled() {
+		sb.WriteString(" with TLS")
+		if len(a.tls.clientCAFile) != 0 {
+			sb.WriteString(fmt.Sprintf(" verifying client certificates against %s", a.tls.clientCAFile))
+		}
+	}
+	proxyURLStrings := make([]string, 0, len(a.proxyURLs))
+	for _, proxyURL := range a.proxyURLs {
+		proxyURLStrings = append(proxyURLStrings, proxyURL.String())
+	}
+	sb.WriteString(fmt.Sprint(", proxying to ", strings.Join(proxyURLStrings, ",")))
+	if len(a.shardURLs) != 0 {
+		shardURLStrings := make([]string, 0, len(a.shardURLs))
+		for _, shardURL := range a.shardURLs {
+			shardURLStrings = append(shardURLStrings, shardURL.String())
+		}
+		sb.WriteString(fmt.Sprint(", fanning out to shards ", strings.Join(shardURLStrings, ",")))
+	}
+	if a.upstream != nil {
+		sb.WriteString(a.upstream.String())
+	}
+	if a.tenant != nil {
+		sb.WriteString(a.tenant.String())
+	}
+	if a.grpcUpstream != nil {
+		sb.WriteString(a.grpcUpstream.String())
+	}
+	if a.oidc != nil {
+		sb.WriteString(a.oidc.String())
+	}
+	if a.session != nil {
+		sb.WriteString(a.session.String())
+	}
+	if a.bypass != nil {
+		sb.WriteString(a.bypass.String())
+	}
+	if a.clusterMetrics != nil {
+		sb.WriteString(a.clusterMetrics.String())
+	}
+	if a.redact != nil {
+		sb.WriteString(a.redact.String())
+	}
+	if len(a.metricPolicyFile) != 0 {
+		sb.WriteString(fmt.Sprint(", restricting metric names by ", a.metricPolicyFile))
+	}
 	sb.WriteString(fmt.Sprintf(" with ignoring 'remote reader' labels [%s]", a.filterReaderLabelSet))
+	if a.verifyReadNamespaces {
+		sb.WriteString(", verifying the namespaces of the streamed 'remote reader' series")
+	}
+	sb.WriteString(fmt.Sprintf(", handling the unauthorized written series by %s", a.writeMode))
+	sb.WriteString(fmt.Sprintf(", matching the namespaces out of scope in %s mode", a.scopeMode))
+	if a.namespaceHistory {
+		sb.WriteString(", granting the namespaces for the periods they belong to the projects")
+		if len(a.namespaceHistoryFile) != 0 {
+			sb.WriteString(fmt.Sprint(" recorded in ", a.namespaceHistoryFile))
+		}
+	}
 	sb.WriteString(fmt.Sprintf(", only allow maximum %d connections with %v read timeout", a.maxConnections, a.readTimeout))
 	sb.WriteString(" .")
 
@@ -101,12 +290,22 @@ func (a *agentConfig) String() string {
 }
 
 type agent struct {
-	cfg        *agentConfig
-	userInfo   authentication.UserInfo
-	listener   net.Listener
-	namespaces kube.Namespaces
-	tokens     kube.Tokens
-	remoteAPI  promapiv1.API
+	cfg          *agentConfig
+	userInfo     authentication.UserInfo
+	listener     net.Listener
+	namespaces   kube.Namespaces
+	tokens       kube.Tokens
+	remoteAPI    promapiv1.API
+	upstream     *upstream
+	shards       *shardSet
+	shardAPIs    []promapiv1.API
+	tenants      *tenantResolver
+	grpcUpstream *grpcUpstream
+	sessions     *sessionSigner
+	bypasses     *bypassPolicy
+	clusters     prom.ClusterSelectors
+	redactor     *labelRedactor
+	metricPolicy *metricPolicy
 }
 
 func (a *agent) serve() error {
@@ -114,14 +313,24 @@ func (a *agent) serve() error {
 	httpProxy := a.createHTTPProxy()
 	grpcProxy := a.createGRPCProxy()
 
+	// the gRPC matcher must be registered before the generic HTTP/2 matcher
+	grpcListener := createGRPCListener(listenerMux)
+	httpListener := createHTTPListener(listenerMux)
+	http2Listener := createHTTP2Listener(listenerMux)
+
 	errCh := make(chan error)
 	go func() {
-		if err := httpProxy.Serve(createHTTPListener(listenerMux)); err != nil {
+		if err := httpProxy.Serve(httpListener); err != nil {
 			errCh <- errors.Annotate(err, "failed to start proxy http listener")
 		}
 	}()
 	go func() {
-		if err := grpcProxy.Serve(createGRPCListener(listenerMux, a.cfg.myToken)); err != nil {
+		if err := a.serveHTTP2(httpProxy, http2Listener); err != nil {
+			errCh <- errors.Annotate(err, "failed to start proxy http2 listener")
+		}
+	}()
+	go func() {
+		if err := grpcProxy.Serve(grpcListener); err != nil {
 			errCh <- errors.Annotate(err, "failed to start proxy grpc listener")
 		}
 	}()
@@ -165,6 +374,12 @@ func createAgent(cfg *agentConfig) (*agent, error) {
 		return nil, errors.Annotatef(err, "unable to listen on addr %s", cfg.listenAddress)
 	}
 	listener = netutil.LimitListener(listener, cfg.maxConnections)
+	if cfg.tls.enabled() {
+		listener, err = createTLSListener(cfg.ctx, listener, cfg.tls)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create TLS listener")
+		}
+	}
 
 	// create Kubernetes client
 	k8sConfig, err := rest.InClusterConfig()
@@ -176,14 +391,42 @@ func createAgent(cfg *agentConfig) (*agent, error) {
 		return nil, errors.Annotate(err, "unable to new Kubernetes clientSet")
 	}
 
+	// create upstream transport
+	upstream, err := newUpstream(cfg.proxyURLs, cfg.upstream)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create upstream transport")
+	}
+	go upstream.run(cfg.ctx)
+
+	// create gRPC upstream connection
+	grpcUpstream, err := newGRPCUpstream(cfg.ctx, cfg.grpcUpstream, upstream)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create gRPC upstream")
+	}
+	go grpcUpstream.run(cfg.ctx, cfg.upstream.healthCheckInterval)
+
 	// create Prometheus client
 	promClient, err := promapi.NewClient(promapi.Config{
-		Address: cfg.proxyURL.String(),
+		Address:      cfg.proxyURL.String(),
+		RoundTripper: upstream.roundTripper(),
 	})
 	if err != nil {
 		return nil, errors.Annotate(err, "unable to new Prometheus client")
 	}
 
+	// create shard clients
+	shardAPIs := make([]promapiv1.API, 0, len(cfg.shardURLs))
+	for _, shardURL := range cfg.shardURLs {
+		shardClient, err := promapi.NewClient(promapi.Config{
+			Address:      shardURL.String(),
+			RoundTripper: upstream.shardRoundTripper(),
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to new Prometheus client for shard %s", shardURL)
+		}
+		shardAPIs = append(shardAPIs, promapiv1.NewAPI(shardClient))
+	}
+
 	// create tokens client and get userInfo
 	tokens := kube.NewTokens(cfg.ctx, k8sClient)
 	userInfo, err := tokens.Authenticate(cfg.myToken)
@@ -191,13 +434,75 @@ func createAgent(cfg *agentConfig) (*agent, error) {
 		return nil, errors.Annotate(err, "unable to get userInfo from agent token")
 	}
 
+	// verify the OIDC ID tokens before falling back to the TokenReview
+	if cfg.oidc.enabled() {
+		oidcTokens, err := newOIDCAuthenticator(cfg.ctx, cfg.oidc)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create OIDC authenticator")
+		}
+		tokens = kube.NewChainedTokens(oidcTokens, tokens)
+	}
+
+	// create session signer for browser access
+	sessions, err := newSessionSigner(cfg.session)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create session signer")
+	}
+
+	accessReviews := kube.NewAccessReviews(cfg.ctx, k8sClient)
+	var history *kube.NamespaceHistory
+	if cfg.namespaceHistory {
+		history, err = kube.NewNamespaceHistory(cfg.namespaceHistoryFile)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to load namespace history")
+		}
+	}
+	namespaces := kube.NewNamespaces(cfg.ctx, k8sClient, accessReviews, history)
+
+	// create tenant resolver for multi-tenant upstream
+	tenants, err := newTenantResolver(cfg.tenant, namespaces)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create tenant resolver")
+	}
+
+	// allow the cluster metrics without namespace
+	var clusterSelectors prom.ClusterSelectors
+	var clusterRedactLabels []string
+	if cfg.clusterMetrics != nil {
+		clusterSelectors, err = prom.ParseClusterSelectors(cfg.clusterMetrics.selectors)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to parse cluster metrics")
+		}
+		clusterRedactLabels = cfg.clusterMetrics.redactLabels
+	}
+	redactor, err := newLabelRedactor(cfg.redact, clusterRedactLabels)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create label redactor")
+	}
+
+	// restrict the metric names per tenant
+	metricPolicy, err := loadMetricPolicy(cfg.metricPolicyFile)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to load metric policy")
+	}
+
 	return &agent{
-		cfg:        cfg,
-		userInfo:   userInfo,
-		listener:   listener,
-		namespaces: kube.NewNamespaces(cfg.ctx, k8sClient),
-		tokens:     tokens,
-		remoteAPI:  promapiv1.NewAPI(promClient),
+		cfg:          cfg,
+		userInfo:     userInfo,
+		listener:     listener,
+		namespaces:   namespaces,
+		tokens:       tokens,
+		remoteAPI:    promapiv1.NewAPI(promClient),
+		upstream:     upstream,
+		shards:       newShardSet(cfg.shardURLs, upstream.shardRoundTripper()),
+		shardAPIs:    shardAPIs,
+		tenants:      tenants,
+		grpcUpstream: grpcUpstream,
+		sessions:     sessions,
+		bypasses:     newBypassPolicy(userInfo, cfg.bypass, accessReviews),
+		clusters:     clusterSelectors,
+		redactor:     redactor,
+		metricPolicy: metricPolicy,
 	}, nil
 }
 
@@ -205,6 +510,27 @@ func (a *agent) createHTTPProxy() *http.Server {
 	return &http.Server{
 		Handler:     a.httpBackend(),
 		ReadTimeout: a.cfg.readTimeout,
+		ConnContext: withConnectionState,
+	}
+}
+
+func (a *agent) serveHTTP2(httpProxy *http.Server, listener net.Listener) error {
+	http2Server := &http2.Server{}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		if state := connectionState(conn); state != nil {
+			conn = &tlsStateConn{Conn: conn, state: *state}
+		}
+
+		go http2Server.ServeConn(conn, &http2.ServeConnOpts{
+			Context:    a.cfg.ctx,
+			BaseConfig: httpProxy,
+		})
 	}
 }
 
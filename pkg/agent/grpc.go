@@ -2,20 +2,166 @@ package agent
 
 import (
 	"context"
+	"strings"
 
 	grpcproxy "github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
+var (
+	proxyCodec = grpcproxy.Codec()
+)
+
 func (a *agent) grpcBackend() grpc.StreamHandler {
-	return grpcproxy.TransparentHandler(func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error) {
-		con, err := grpc.DialContext(ctx, a.cfg.proxyURL.String(), grpc.WithDefaultCallOptions(grpc.CallCustomCodec(grpcproxy.Codec())))
+	transparentHandler := grpcproxy.TransparentHandler(a.grpcUpstream.director())
+
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		fullMethodName, ok := grpc.MethodFromServerStream(stream)
+		if !ok {
+			return status.Error(codes.Internal, "unknown method")
+		}
+
+		if !a.grpcUpstream.allowed(fullMethodName) {
+			return status.Errorf(codes.PermissionDenied, "method %s is not allowed", fullMethodName)
+		}
+
+		accessToken := grpcAccessToken(stream.Context())
+		if len(accessToken) == 0 {
+			return status.Error(codes.Unauthenticated, "no access token provided")
+		}
+
+		requested := grpcRequestedScope(stream.Context())
+
+		// direct proxy
+		if accessToken == a.cfg.myToken && requested == nil {
+			return transparentHandler(srv, stream)
+		}
+
+		userInfo, err := a.tokens.Authenticate(accessToken)
 		if err != nil {
-			return ctx, nil, status.Errorf(codes.Unavailable, "Unavailable endpoint")
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		scope := &storeAPIScope{}
+		if a.bypass(userInfo, "grpc") {
+			if requested == nil {
+				return transparentHandler(srv, stream)
+			}
+			scope.namespaceSet = requested
+		} else {
+			scope.grants = a.queryGrants(accessToken, userInfo)
+			scope.namespaceSet, err = narrowScope(a.allowedNamespaces(accessToken, userInfo, scope.grants), requested)
+			if err != nil {
+				return status.Error(codes.PermissionDenied, err.Error())
+			}
+			scope.nameFilter = a.metricNameFilter(userInfo, scope.namespaceSet)
+			scope.redactor = a.redactor
+		}
+
+		// tenants can only access the Thanos StoreAPI
+		rewriter, exist := storeAPIRewriters[fullMethodName]
+		if !exist {
+			return status.Errorf(codes.PermissionDenied, "method %s is not allowed", fullMethodName)
+		}
+		log.Debugf("grpc %s => %s with namespaces [%s]", userInfo.Username, fullMethodName, scope.namespaceSet)
+
+		return transparentHandler(srv, &storeAPIServerStream{
+			ServerStream: stream,
+			rewriter:     rewriter,
+			scope:        scope,
+		})
+	}
+}
+
+func grpcAccessToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	for _, value := range md.Get(strings.ToLower(authorizationHeaderKey)) {
+		if strings.HasPrefix(value, "Bearer ") {
+			return strings.TrimPrefix(value, "Bearer ")
 		}
+	}
+
+	return ""
+}
+
+func grpcRequestedScope(ctx context.Context) data.Set {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	return parseScope(md.Get(strings.ToLower(scopeHeaderKey)))
+}
+
+// outgoingContext passes the incoming metadata through to the upstream,
+// the caller's authorization is replaced by the upstream credentials and the scope is consumed here.
+func outgoingContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	md = md.Copy()
+	delete(md, strings.ToLower(authorizationHeaderKey))
+	delete(md, strings.ToLower(scopeHeaderKey))
+
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// storeAPIServerStream rewrites the raw frames passing through the transparent proxy.
+type storeAPIServerStream struct {
+	grpc.ServerStream
+	rewriter *storeAPIRewriter
+	scope    *storeAPIScope
+	label    string
+}
+
+func (s *storeAPIServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	// the proxy codec exposes the payload of the frame
+	payload, err := proxyCodec.Marshal(m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "unable to read request: %v", err)
+	}
+
+	rewritten, label, err := s.rewriter.rewriteRequest(payload, s.scope)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "unable to rewrite request: %v", err)
+	}
+	s.label = label
+
+	return proxyCodec.Unmarshal(rewritten, m)
+}
+
+func (s *storeAPIServerStream) SendMsg(m interface{}) error {
+	if s.rewriter.rewriteResponse == nil {
+		return s.ServerStream.SendMsg(m)
+	}
+
+	payload, err := proxyCodec.Marshal(m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "unable to read response: %v", err)
+	}
+
+	rewritten, err := s.rewriter.rewriteResponse(payload, s.label, s.scope)
+	if err != nil {
+		return status.Errorf(codes.Internal, "unable to rewrite response: %v", err)
+	}
+	if err := proxyCodec.Unmarshal(rewritten, m); err != nil {
+		return err
+	}
 
-		return ctx, con, nil
-	})
+	return s.ServerStream.SendMsg(m)
 }
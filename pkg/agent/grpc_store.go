@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	namespaceLabelName = "namespace"
+)
+
+// storeAPIRewriter injects the namespace matchers into the Thanos StoreAPI requests.
+//
+// The Thanos LabelMatcher shares the wire format of the Prometheus remote read LabelMatcher,
+// so the requests are rewritten on the wire without depending on the Thanos protos.
+type storeAPIRewriter struct {
+	// number of the repeated LabelMatcher field in the request
+	matchersField uint64
+	// number of the label name field in the request, 0 if not present
+	labelField uint64
+	// numbers of the start and the end fields in milliseconds of the request
+	startField      uint64
+	endField        uint64
+	rewriteResponse func(payload []byte, label string, scope *storeAPIScope) ([]byte, error)
+}
+
+// storeAPIScope is what a tenant can see through the StoreAPI.
+type storeAPIScope struct {
+	namespaceSet data.Set
+	grants       data.Grants
+	nameFilter   *prom.MetricNameFilter
+	redactor     *labelRedactor
+}
+
+var storeAPIRewriters = map[string]*storeAPIRewriter{
+	// SeriesRequest: min_time = 1, max_time = 2, matchers = 3, ...
+	"/thanos.Store/Series": {
+		matchersField:   3,
+		startField:      1,
+		endField:        2,
+		rewriteResponse: rewriteSeriesResponse,
+	},
+	// LabelNamesRequest: partial_response_disabled = 1, partial_response_strategy = 2, start = 3, end = 4, hints = 5, matchers = 6
+	"/thanos.Store/LabelNames": {
+		matchersField: 6,
+		startField:    3,
+		endField:      4,
+	},
+	// LabelValuesRequest: label = 1, partial_response_disabled = 2, partial_response_strategy = 3, start = 4, end = 5, hints = 6, matchers = 7
+	"/thanos.Store/LabelValues": {
+		matchersField:   7,
+		labelField:      1,
+		startField:      4,
+		endField:        5,
+		rewriteResponse: rewriteLabelValuesResponse,
+	},
+}
+
+type wireField struct {
+	number   uint64
+	wireType uint64
+	// the whole field including the tag
+	raw []byte
+	// the payload of a length-delimited field, or the encoded varint
+	value []byte
+}
+
+func scanWireFields(payload []byte) ([]wireField, error) {
+	ret := make([]wireField, 0)
+
+	for offset := 0; offset < len(payload); {
+		start := offset
+
+		tag, n := binary.Uvarint(payload[offset:])
+		if n <= 0 {
+			return nil, errors.New("malformed field tag")
+		}
+		offset += n
+
+		field := wireField{
+			number:   tag >> 3,
+			wireType: tag & 0x7,
+		}
+
+		switch field.wireType {
+		case wireVarint:
+			_, n := binary.Uvarint(payload[offset:])
+			if n <= 0 {
+				return nil, errors.New("malformed varint field")
+			}
+			field.value = payload[offset : offset+n]
+			offset += n
+		case wireFixed64:
+			offset += 8
+		case wireFixed32:
+			offset += 4
+		case wireBytes:
+			length, n := binary.Uvarint(payload[offset:])
+			if n <= 0 || uint64(len(payload)-offset-n) < length {
+				return nil, errors.New("malformed length-delimited field")
+			}
+			offset += n
+			field.value = payload[offset : offset+int(length)]
+			offset += int(length)
+		default:
+			return nil, errors.Errorf("unsupported wire type %d", field.wireType)
+		}
+
+		if offset > len(payload) {
+			return nil, errors.New("truncated field")
+		}
+		field.raw = payload[start:offset]
+
+		ret = append(ret, field)
+	}
+
+	return ret, nil
+}
+
+func appendBytesField(dst []byte, number uint64, value []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+
+	dst = append(dst, buf[:binary.PutUvarint(buf[:], number<<3|wireBytes)]...)
+	dst = append(dst, buf[:binary.PutUvarint(buf[:], uint64(len(value)))]...)
+	return append(dst, value...)
+}
+
+func (r *storeAPIRewriter) rewriteRequest(payload []byte, scope *storeAPIScope) ([]byte, string, error) {
+	fields, err := scanWireFields(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var label string
+	var startMs, endMs int64 = math.MinInt64, math.MaxInt64
+	matchers := make([]*prompb.LabelMatcher, 0)
+	ret := make([]byte, 0, len(payload))
+	for _, field := range fields {
+		if field.wireType == wireBytes && field.number == r.matchersField {
+			matcher := &prompb.LabelMatcher{}
+			if err := matcher.Unmarshal(field.value); err != nil {
+				return nil, "", errors.Annotate(err, "malformed matcher")
+			}
+			matchers = append(matchers, matcher)
+			continue
+		}
+
+		if field.wireType == wireBytes && r.labelField != 0 && field.number == r.labelField {
+			label = string(field.value)
+		}
+		if field.wireType == wireVarint && (field.number == r.startField || field.number == r.endField) {
+			value, _ := binary.Uvarint(field.value)
+			if field.number == r.startField {
+				startMs = int64(value)
+			} else {
+				endMs = int64(value)
+			}
+		}
+
+		ret = append(ret, field.raw...)
+	}
+
+	scope.restrictPeriod(startMs, endMs)
+
+	if scope.redactor != nil {
+		promMatchers, err := prom.FromLabelMatchers(matchers)
+		if err != nil {
+			return nil, "", errors.Annotate(err, "malformed matcher")
+		}
+		if err := scope.redactor.checkMatchers(promMatchers, nil); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, matcher := range scope.nameFilter.FilterLabelMatchers(prom.FilterLabelMatchers(scope.namespaceSet, matchers)) {
+		matcherBytes, err := matcher.Marshal()
+		if err != nil {
+			return nil, "", errors.Annotate(err, "unable to marshal matcher")
+		}
+		ret = appendBytesField(ret, r.matchersField, matcherBytes)
+	}
+
+	return ret, label, nil
+}
+
+// rewriteLabelValuesResponse drops the unauthorized namespaces from LabelValuesResponse (values = 1, warnings = 2, hints = 3),
+// in case the upstream ignores the matchers of LabelValuesRequest, and redacts the values of the redacted labels.
+func rewriteLabelValuesResponse(payload []byte, label string, scope *storeAPIScope) ([]byte, error) {
+	if label != namespaceLabelName && !scope.redactor.redacted(label) {
+		return payload, nil
+	}
+
+	fields, err := scanWireFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, 0, len(payload))
+	for _, field := range fields {
+		if field.wireType != wireBytes || field.number != 1 {
+			ret = append(ret, field.raw...)
+			continue
+		}
+
+		if label == namespaceLabelName {
+			if _, exist := scope.namespaceSet[string(field.value)]; !exist {
+				continue
+			}
+		}
+		for _, value := range scope.redactor.redactLabelValues(label, []string{string(field.value)}) {
+			ret = appendBytesField(ret, 1, []byte(value))
+		}
+	}
+
+	return ret, nil
+}
+
+// rewriteSeriesResponse redacts the labels of SeriesResponse (series = 1, warning = 2, hints = 3).
+func rewriteSeriesResponse(payload []byte, _ string, scope *storeAPIScope) ([]byte, error) {
+	if scope.redactor == nil {
+		return payload, nil
+	}
+
+	fields, err := scanWireFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, 0, len(payload))
+	for _, field := range fields {
+		if field.wireType != wireBytes || field.number != 1 {
+			ret = append(ret, field.raw...)
+			continue
+		}
+
+		series, err := redactStoreAPISeries(field.value, scope.redactor)
+		if err != nil {
+			return nil, err
+		}
+		ret = appendBytesField(ret, 1, series)
+	}
+
+	return ret, nil
+}
+
+// redactStoreAPISeries redacts the labels of Series (labels = 1, chunks = 2),
+// the Thanos Label shares the wire format of the Prometheus remote read Label.
+func redactStoreAPISeries(payload []byte, redactor *labelRedactor) ([]byte, error) {
+	fields, err := scanWireFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	pbLabels := make([]prompb.Label, 0)
+	others := make([]byte, 0, len(payload))
+	for _, field := range fields {
+		if field.wireType != wireBytes || field.number != 1 {
+			others = append(others, field.raw...)
+			continue
+		}
+
+		label := prompb.Label{}
+		if err := label.Unmarshal(field.value); err != nil {
+			return nil, errors.Annotate(err, "malformed label")
+		}
+		pbLabels = append(pbLabels, label)
+	}
+
+	ret := make([]byte, 0, len(payload))
+	for _, label := range redactor.redactPBLabels(pbLabels) {
+		labelBytes, err := label.Marshal()
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to marshal label")
+		}
+		ret = appendBytesField(ret, 1, labelBytes)
+	}
+
+	return append(ret, others...), nil
+}
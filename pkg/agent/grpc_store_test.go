@@ -0,0 +1,101 @@
+//go:build test
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeStoreAPIMatchers(t *testing.T, payload []byte, matchersField uint64) ([]*prompb.LabelMatcher, []wireField) {
+	fields, err := scanWireFields(payload)
+	require.NoError(t, err)
+
+	var matchers []*prompb.LabelMatcher
+	var others []wireField
+	for _, field := range fields {
+		if field.number != matchersField {
+			others = append(others, field)
+			continue
+		}
+
+		matcher := &prompb.LabelMatcher{}
+		require.NoError(t, matcher.Unmarshal(field.value))
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, others
+}
+
+func Test_storeAPIRewriter_Series(t *testing.T) {
+	nameMatcher, err := (&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}).Marshal()
+	require.NoError(t, err)
+
+	// min_time = 100, max_time = 200, matchers = [{__name__="up"}]
+	payload := []byte{0x08, 100, 0x10, 0xc8, 0x01}
+	payload = appendBytesField(payload, 3, nameMatcher)
+
+	rewriter := storeAPIRewriters["/thanos.Store/Series"]
+	rewritten, _, err := rewriter.rewriteRequest(payload, &storeAPIScope{namespaceSet: data.NewSet("ns-a", "ns-b")})
+	require.NoError(t, err)
+
+	matchers, others := decodeStoreAPIMatchers(t, rewritten, 3)
+	require.Len(t, others, 2)
+	require.Equal(t, []byte{0x08, 100}, others[0].raw)
+	require.Equal(t, []byte{0x10, 0xc8, 0x01}, others[1].raw)
+	require.Equal(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_RE, Name: "namespace", Value: "ns-a|ns-b"},
+	}, matchers)
+
+	// matching a namespace out of scope
+	nsMatcher, err := (&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "ns-c"}).Marshal()
+	require.NoError(t, err)
+	payload = appendBytesField(nil, 3, nsMatcher)
+
+	rewritten, _, err = rewriter.rewriteRequest(payload, &storeAPIScope{namespaceSet: data.NewSet("ns-a")})
+	require.NoError(t, err)
+
+	matchers, _ = decodeStoreAPIMatchers(t, rewritten, 3)
+	require.Len(t, matchers, 1)
+	require.NotEqual(t, "ns-c", matchers[0].Value)
+
+	_, _, err = rewriter.rewriteRequest([]byte{0x1a, 0x10}, &storeAPIScope{namespaceSet: data.NewSet("ns-a")})
+	require.Error(t, err)
+}
+
+func Test_storeAPIRewriter_LabelValues(t *testing.T) {
+	rewriter := storeAPIRewriters["/thanos.Store/LabelValues"]
+
+	payload := appendBytesField(nil, 1, []byte("namespace"))
+	rewritten, label, err := rewriter.rewriteRequest(payload, &storeAPIScope{namespaceSet: data.NewSet("ns-a")})
+	require.NoError(t, err)
+	require.Equal(t, "namespace", label)
+
+	matchers, _ := decodeStoreAPIMatchers(t, rewritten, 7)
+	require.Equal(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "ns-a"},
+	}, matchers)
+
+	var response []byte
+	for _, value := range []string{"ns-a", "ns-b", "ns-c"} {
+		response = appendBytesField(response, 1, []byte(value))
+	}
+	response = appendBytesField(response, 2, []byte("partial response"))
+
+	filtered, err := rewriter.rewriteResponse(response, label, &storeAPIScope{namespaceSet: data.NewSet("ns-a")})
+	require.NoError(t, err)
+
+	fields, err := scanWireFields(filtered)
+	require.NoError(t, err)
+	require.Len(t, fields, 2)
+	require.Equal(t, "ns-a", string(fields[0].value))
+	require.Equal(t, "partial response", string(fields[1].value))
+
+	unchanged, err := rewriter.rewriteResponse(response, "job", &storeAPIScope{namespaceSet: data.NewSet("ns-a")})
+	require.NoError(t, err)
+	require.Equal(t, response, unchanged)
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	grpcproxy "github.com/mwitkow/grpc-proxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+type grpcUpstreamConfig struct {
+	target         string
+	insecure       bool
+	keepaliveTime  time.Duration
+	allowedMethods []string
+	deniedMethods  []string
+}
+
+func (c *grpcUpstreamConfig) String() string {
+	sb := &strings.Builder{}
+
+	sb.WriteString(fmt.Sprintf(", proxying gRPC to %s", c.target))
+	if c.insecure {
+		sb.WriteString(" without TLS")
+	}
+	if len(c.allowedMethods) != 0 {
+		sb.WriteString(fmt.Sprintf(" allowing methods [%s]", strings.Join(c.allowedMethods, ",")))
+	}
+	if len(c.deniedMethods) != 0 {
+		sb.WriteString(fmt.Sprintf(" denying methods [%s]", strings.Join(c.deniedMethods, ",")))
+	}
+
+	return sb.String()
+}
+
+// grpcTargetFromURL derives the gRPC target from the upstream URL, i.e. host:port without the scheme.
+func grpcTargetFromURL(u *url.URL) string {
+	if len(u.Port()) != 0 {
+		return u.Host
+	}
+
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// grpcUpstream holds the long-lived connection shared by every proxied gRPC call.
+type grpcUpstream struct {
+	target         string
+	conn           *grpc.ClientConn
+	healthy        int32
+	allowedMethods []string
+	deniedMethods  []string
+}
+
+func newGRPCUpstream(ctx context.Context, cfg *grpcUpstreamConfig, u *upstream) (*grpcUpstream, error) {
+	if len(cfg.target) == 0 {
+		return nil, errors.New("blank gRPC upstream target")
+	}
+
+	for _, pattern := range append(append([]string{}, cfg.allowedMethods...), cfg.deniedMethods...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Annotatef(err, "invalid gRPC method pattern %q", pattern)
+		}
+	}
+
+	dialOptions := u.grpcDialOptions()
+	if cfg.insecure {
+		dialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	dialOptions = append(dialOptions,
+		grpc.WithDefaultCallOptions(grpc.CallCustomCodec(proxyCodec)),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    cfg.keepaliveTime,
+			Timeout: 20 * time.Second,
+		}),
+	)
+
+	// the connection is established lazily and reconnects on its own
+	conn, err := grpc.DialContext(ctx, cfg.target, dialOptions...)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to dial gRPC upstream %s", cfg.target)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	upstreamUpGauge.WithLabelValues(cfg.target).Set(1)
+
+	return &grpcUpstream{
+		target:         cfg.target,
+		conn:           conn,
+		healthy:        1,
+		allowedMethods: cfg.allowedMethods,
+		deniedMethods:  cfg.deniedMethods,
+	}, nil
+}
+
+func (g *grpcUpstream) isHealthy() bool {
+	return atomic.LoadInt32(&g.healthy) == 1
+}
+
+func (g *grpcUpstream) setHealthy(healthy bool) {
+	val := int32(0)
+	if healthy {
+		val = 1
+	}
+
+	if atomic.SwapInt32(&g.healthy, val) != val {
+		if healthy {
+			log.Infof("gRPC upstream %s is serving", g.target)
+		} else {
+			log.Warnf("gRPC upstream %s is not serving", g.target)
+		}
+	}
+	upstreamUpGauge.WithLabelValues(g.target).Set(float64(val))
+}
+
+func (g *grpcUpstream) run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		g.setHealthy(g.probe(ctx, interval))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *grpcUpstream) probe(ctx context.Context, timeout time.Duration) bool {
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := healthpb.NewHealthClient(g.conn).Check(probeCtx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		// the upstream doesn't implement the health service, but it is reachable
+		if status.Code(err) == codes.Unimplemented {
+			return true
+		}
+		log.WithError(err).Debugf("Failed to probe gRPC upstream %s", g.target)
+		return false
+	}
+
+	return resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
+
+// allowed checks the method against the deny list first, then the allow list if present.
+func (g *grpcUpstream) allowed(fullMethodName string) bool {
+	for _, pattern := range g.deniedMethods {
+		if matched, _ := path.Match(pattern, fullMethodName); matched {
+			return false
+		}
+	}
+
+	if len(g.allowedMethods) == 0 {
+		return true
+	}
+	for _, pattern := range g.allowedMethods {
+		if matched, _ := path.Match(pattern, fullMethodName); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *grpcUpstream) director() grpcproxy.StreamDirector {
+	return func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error) {
+		if !g.isHealthy() {
+			return ctx, nil, status.Errorf(codes.Unavailable, "gRPC upstream %s is not serving", g.target)
+		}
+
+		return outgoingContext(ctx), g.conn, nil
+	}
+}
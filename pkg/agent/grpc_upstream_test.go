@@ -0,0 +1,74 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func Test_grpcTargetFromURL(t *testing.T) {
+	testCases := map[string]string{
+		"http://localhost:9090":      "localhost:9090",
+		"http://prometheus":          "prometheus:80",
+		"https://prometheus/prefix":  "prometheus:443",
+		"https://[::1]:10901/prefix": "[::1]:10901",
+	}
+
+	for rawURL, expect := range testCases {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		require.Equal(t, expect, grpcTargetFromURL(u), rawURL)
+	}
+}
+
+func Test_grpcUpstream_allowed(t *testing.T) {
+	g := &grpcUpstream{}
+	require.True(t, g.allowed("/thanos.Store/Series"))
+
+	g = &grpcUpstream{
+		allowedMethods: []string{"/thanos.Store/*", "/thanos.Info/Info"},
+		deniedMethods:  []string{"/thanos.Store/LabelNames"},
+	}
+	require.True(t, g.allowed("/thanos.Store/Series"))
+	require.True(t, g.allowed("/thanos.Info/Info"))
+	require.False(t, g.allowed("/thanos.Store/LabelNames"))
+	require.False(t, g.allowed("/thanos.Rules/Rules"))
+
+	_, err := newGRPCUpstream(context.Background(), &grpcUpstreamConfig{target: "localhost:10901", allowedMethods: []string{"[invalid"}}, nil)
+	require.Error(t, err)
+}
+
+func Test_grpcUpstream_probe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	healthServer := health.NewServer()
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, err := newGRPCUpstream(ctx, &grpcUpstreamConfig{target: listener.Addr().String(), keepaliveTime: time.Minute}, nil)
+	require.NoError(t, err)
+
+	require.True(t, g.probe(ctx, time.Second))
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	require.False(t, g.probe(ctx, time.Second))
+
+	g.setHealthy(false)
+	_, _, err = g.director()(ctx, "/thanos.Store/Series")
+	require.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	log "github.com/sirupsen/logrus"
+	authentication "k8s.io/api/authentication/v1"
+)
+
+const (
+	// the default lookback delta of the Prometheus engine
+	lookbackDelta = 5 * time.Minute
+)
+
+// restrictPeriod narrows the namespaces down to the ones belonging to the projects of the caller for the whole
+// period of [start, end] which the request reads, nothing is narrowed without the namespace history.
+func (c *apiContext) restrictPeriod(start, end time.Time) {
+	if c.grants == nil {
+		return
+	}
+
+	restricted := c.grants.Restrict(c.namespaceSet, start, end)
+	if len(restricted) != len(c.namespaceSet) {
+		leftOut := make([]string, 0, len(c.namespaceSet)-len(restricted))
+		for _, namespace := range c.namespaceSet.Values() {
+			if _, exist := restricted[namespace]; !exist {
+				leftOut = append(leftOut, namespace)
+			}
+		}
+		log.Debugf("period[%s] from %s to %s leaves out namespaces [%s]", c.tag, start.Format(time.RFC3339), end.Format(time.RFC3339), strings.Join(leftOut, ","))
+		c.addWarning("namespaces [" + strings.Join(leftOut, ",") + "] didn't belong to the project for the whole queried period and are left out")
+	}
+	c.namespaceSet = restricted
+}
+
+// limitPeriod narrows the namespaces down to the ones belonging to the projects of the caller for any part of the
+// period of [start, end] which the request reads, the data of the ones belonging for a part of it only has to be
+// limited to the periods of their grants.
+func (c *apiContext) limitPeriod(start, end time.Time) {
+	if c.grants == nil {
+		return
+	}
+
+	c.namespaceSet, c.partialGrants = c.grants.Overlap(c.namespaceSet, start, end)
+	if len(c.partialGrants) != 0 {
+		limited := c.partialGrants.Namespaces().Values()
+		log.Debugf("period[%s] from %s to %s limits namespaces [%s]", c.tag, start.Format(time.RFC3339), end.Format(time.RFC3339), strings.Join(limited, ","))
+		c.addWarning("namespaces [" + strings.Join(limited, ",") + "] belonged to the project for a part of the queried period only, their data is limited to it")
+	}
+}
+
+// limitExpressionPeriod narrows the namespaces down for the samples which the expression reads.
+func (c *apiContext) limitExpressionPeriod(expr parser.Expr, start, end time.Time) {
+	if c.grants == nil {
+		return
+	}
+
+	c.limitPeriod(prom.SelectedPeriod(expr, start, end, lookbackDelta))
+}
+
+// modifyPeriodExpression is modifyExpression of the expression evaluated from start to end,
+// which reads the partially granted namespaces within the periods of their grants only.
+func (c *apiContext) modifyPeriodExpression(originalExpr parser.Expr, start, end time.Time) string {
+	modifiedExpr := c.modifyExpression(originalExpr)
+	if len(c.partialGrants) == 0 || !c.rewriteMatchers {
+		return modifiedExpr
+	}
+
+	// the selectors of the expression are filtered in place
+	return prom.LimitPeriods(originalExpr, c.namespaceSet, c.partialGrants, start, end, lookbackDelta).String()
+}
+
+// limitRequestedPeriod narrows the namespaces down for the optional "start" and "end" parameters, the missing start
+// is the earliest grant of the namespaces and the missing end is now. The requested period is returned.
+func (c *apiContext) limitRequestedPeriod(queries url.Values) (time.Time, time.Time, error) {
+	start, end, err := c.requestedPeriod(queries)
+	if err != nil {
+		return start, end, err
+	}
+	c.limitPeriod(start, end)
+
+	return start, end, nil
+}
+
+// restrictCurrentPeriod narrows the namespaces down for the data which is read at now,
+// the "start" and "end" parameters are validated only.
+func (c *apiContext) restrictCurrentPeriod(queries url.Values) error {
+	if _, _, err := c.requestedPeriod(queries); err != nil {
+		return err
+	}
+	now := time.Now()
+	c.restrictPeriod(now.Add(-lookbackDelta), now)
+
+	return nil
+}
+
+func (c *apiContext) requestedPeriod(queries url.Values) (time.Time, time.Time, error) {
+	start, end := c.grants.Since(c.namespaceSet), time.Now()
+	if t := queries.Get("start"); t != "" {
+		var err error
+		if start, err = parseTime(t); err != nil {
+			return start, end, err
+		}
+	}
+	if t := queries.Get("end"); t != "" {
+		var err error
+		if end, err = parseTime(t); err != nil {
+			return start, end, err
+		}
+	}
+
+	return start, end, nil
+}
+
+// periodQueries returns the queries of the requests reading the namespaces within their grants for the requested
+// period: the namespaces granted for the whole period are read by the original request, the partially granted ones
+// by the requests of the periods of their grants. The modify function sets the "match[]" of the namespaces.
+func (c *apiContext) periodQueries(queries url.Values, start, end time.Time, modify func(url.Values) error) ([]url.Values, error) {
+	namespaceSet := c.namespaceSet
+	defer func() {
+		c.namespaceSet = namespaceSet
+	}()
+
+	whole := data.Set{}
+	var periods []data.Period
+	groups := map[data.Period]data.Set{}
+	for namespace := range namespaceSet {
+		grants, partial := c.partialGrants[namespace]
+		if !partial {
+			whole[namespace] = struct{}{}
+			continue
+		}
+		for _, period := range grants {
+			if groups[period] == nil {
+				periods = append(periods, period)
+				groups[period] = data.Set{}
+			}
+			groups[period][namespace] = struct{}{}
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].Since.Before(periods[j].Since)
+	})
+
+	if len(queries.Get("start")) == 0 && !start.IsZero() {
+		// the data before the earliest grant belongs to no project of the caller
+		queries.Set("start", start.Format(time.RFC3339Nano))
+	}
+	c.namespaceSet = whole
+	if err := modify(queries); err != nil {
+		return nil, err
+	}
+	ret := []url.Values{queries}
+
+	for _, period := range periods {
+		periodQueries := url.Values{}
+		for key, values := range queries {
+			periodQueries[key] = append([]string(nil), values...)
+		}
+		if period.Since.After(start) {
+			periodQueries.Set("start", period.Since.Format(time.RFC3339Nano))
+		}
+		if !period.Until.IsZero() && !period.Until.After(end) {
+			// the period excludes its end
+			periodQueries.Set("end", period.Until.Add(-time.Millisecond).Format(time.RFC3339Nano))
+		}
+
+		c.namespaceSet = groups[period]
+		if err := modify(periodQueries); err != nil {
+			return nil, err
+		}
+		ret = append(ret, periodQueries)
+	}
+
+	return ret, nil
+}
+
+// newPeriodRequests returns the requests of the period queries to the hijacked path.
+func (c *apiContext) newPeriodRequests(periodQueries []url.Values) ([]*http.Request, error) {
+	ret := make([]*http.Request, 0, len(periodQueries))
+	for _, queries := range periodQueries {
+		reqURL := *c.request.URL
+		reqURL.RawQuery = queries.Encode()
+
+		newReq, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, internalErr)
+		}
+		ret = append(ret, newReq)
+	}
+
+	return ret, nil
+}
+
+// restrictPeriod narrows the namespaces of the StoreAPI down for the period in milliseconds.
+func (s *storeAPIScope) restrictPeriod(startMs, endMs int64) {
+	if s.grants == nil {
+		return
+	}
+
+	s.namespaceSet = s.grants.Restrict(s.namespaceSet, timestamp.Time(startMs), timestamp.Time(endMs))
+}
+
+// queryGrants returns the periods which the namespaces belonged to the projects of the caller,
+// nil is returned without the namespace history.
+func (a *agent) queryGrants(accessToken string, userInfo authentication.UserInfo) data.Grants {
+	if !a.cfg.namespaceHistory {
+		return nil
+	}
+
+	return a.namespaces.Grants(accessToken, userInfo)
+}
+
+// allowedNamespaces returns the namespaces of the time-bounded grants if any, or the namespaces granted now.
+func (a *agent) allowedNamespaces(accessToken string, userInfo authentication.UserInfo, grants data.Grants) data.Set {
+	if grants != nil {
+		return grants.Namespaces()
+	}
+
+	return a.queryNamespaces(accessToken, userInfo)
+}
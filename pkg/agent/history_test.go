@@ -0,0 +1,141 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_namespaceHistory(t *testing.T) {
+	var gotQueries []url.Values
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQueries = append(gotQueries, r.URL.Query())
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(r.URL.Path, "/api/v1/query") {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+	})
+
+	// ns-a always belongs to the project, ns-b was moved in and ns-c was moved out
+	moved := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	created := moved.Add(-7 * 24 * time.Hour)
+	grants := data.Grants{
+		"ns-a": {{Since: created}},
+		"ns-b": {{Since: moved}},
+		"ns-c": {{Since: created, Until: moved}},
+	}
+
+	serve := func(handlerURL string, handler apiContextHandler) *httptest.ResponseRecorder {
+		gotQueries = nil
+		req := httptest.NewRequest(http.MethodGet, handlerURL, nil)
+		req = mux.SetURLVars(req, map[string]string{"name": "pod"})
+		res := httptest.NewRecorder()
+		apiCtx := &apiContext{
+			response:        res,
+			request:         req,
+			proxyHandler:    upstream,
+			namespaceSet:    grants.Namespaces(),
+			grants:          grants,
+			rewriteMatchers: true,
+		}
+		handler.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+		return res
+	}
+	query := func(expr string, ts time.Time) string {
+		return fmt.Sprintf("/api/v1/query?query=%s&time=%d", url.QueryEscape(expr), ts.Unix())
+	}
+	gotQuery := func() string {
+		require.Len(t, gotQueries, 1)
+		return gotQueries[0].Get("query")
+	}
+	at := func(t time.Time) string {
+		return fmt.Sprint(float64(t.Unix()))
+	}
+
+	res := serve(query(`up`, moved.Add(time.Hour)), hijackQuery)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, `up{namespace=~"ns-a|ns-b"}`, gotQuery())
+
+	res = serve(query(`up`, moved.Add(-time.Hour)), hijackQuery)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, `up{namespace=~"ns-a|ns-c"}`, gotQuery())
+
+	// the range and the offset read the samples before moving
+	serve(query(`rate(up[2h])`, moved.Add(time.Hour)), hijackQuery)
+	require.Equal(t, `rate(up{namespace="ns-a"}[2h])`, gotQuery())
+	serve(query(`up offset 1h`, moved.Add(2*time.Hour)), hijackQuery)
+	require.Equal(t, `up{namespace=~"ns-a|ns-b"} offset 1h`, gotQuery())
+
+	// the range query reads the moved namespaces within their grants
+	res = serve(fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=60", moved.Add(-time.Hour).Unix(), moved.Add(time.Hour).Unix()), hijackQueryRange)
+	require.Equal(t, fmt.Sprintf(`(up{namespace="ns-a"} or (up{namespace="ns-b"} and on() (vector(time()) >= %s)) or (up{namespace="ns-c"} and on() (vector(time()) >= %s < %s)))`,
+		at(moved.Add(lookbackDelta)), at(created.Add(lookbackDelta)), at(moved)), gotQuery())
+	require.Contains(t, res.Body.String(), `"warnings":["namespaces [ns-b,ns-c] belonged to the project for a part of the queried period only, their data is limited to it"]`)
+
+	// the series are requested for the periods of the grants, the missing start is the earliest grant
+	res = serve("/api/v1/series?match[]=up", hijackSeries)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Len(t, gotQueries, 3)
+	require.Equal(t, []string{`up{namespace="ns-a"}`}, gotQueries[0]["match[]"])
+	require.Equal(t, created.Format(time.RFC3339Nano), gotQueries[0].Get("start"))
+	require.Equal(t, []string{`up{namespace="ns-c"}`}, gotQueries[1]["match[]"])
+	require.Equal(t, created.Format(time.RFC3339Nano), gotQueries[1].Get("start"))
+	require.Equal(t, moved.Add(-time.Millisecond).Format(time.RFC3339Nano), gotQueries[1].Get("end"))
+	require.Equal(t, []string{`up{namespace="ns-b"}`}, gotQueries[2]["match[]"])
+	require.Equal(t, moved.Format(time.RFC3339Nano), gotQueries[2].Get("start"))
+	require.Empty(t, gotQueries[2].Get("end"))
+
+	res = serve(fmt.Sprintf("/api/v1/label/pod/values?match[]=up&start=%d", moved.Add(time.Hour).Unix()), hijackLabelValues)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Len(t, gotQueries, 1)
+	require.Equal(t, []string{`up{namespace=~"ns-a|ns-b"}`}, gotQueries[0]["match[]"])
+
+	// the label values are listed for the requested period only
+	res = serve(fmt.Sprintf("/api/v1/label/namespace/values?start=%d", moved.Unix()), hijackLabelNamespaces)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Contains(t, res.Body.String(), `"data":["ns-a","ns-b"]`)
+
+	res = serve("/api/v1/label/namespace/values?end=yesterday", hijackLabelNamespaces)
+	require.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func Test_storeAPIRewriter_namespaceHistory(t *testing.T) {
+	moved := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	scope := &storeAPIScope{
+		namespaceSet: data.NewSet("ns-a", "ns-b"),
+		grants:       data.Grants{"ns-a": {{}}, "ns-b": {{Since: moved}}},
+	}
+
+	// min_time and max_time of the SeriesRequest are before moving
+	payload := appendVarintField(nil, 1, moved.Add(-time.Hour).UnixNano()/int64(time.Millisecond))
+	payload = appendVarintField(payload, 2, moved.UnixNano()/int64(time.Millisecond)-1)
+
+	rewriter := storeAPIRewriters["/thanos.Store/Series"]
+	rewritten, _, err := rewriter.rewriteRequest(payload, scope)
+	require.NoError(t, err)
+	matchers, _ := decodeStoreAPIMatchers(t, rewritten, rewriter.matchersField)
+	require.Len(t, matchers, 1)
+	require.Equal(t, "ns-a", matchers[0].Value)
+	require.Equal(t, data.NewSet("ns-a"), scope.namespaceSet)
+}
+
+func appendVarintField(dst []byte, number uint64, value int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+
+	dst = append(dst, buf[:binary.PutUvarint(buf[:], number<<3|wireVarint)]...)
+	return append(dst, buf[:binary.PutUvarint(buf[:], uint64(value))]...)
+}
@@ -11,13 +11,15 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/juju/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/rancher/prometheus-auth/pkg/kube"
+	"github.com/rancher/prometheus-auth/pkg/data"
 	log "github.com/sirupsen/logrus"
 	authentication "k8s.io/api/authentication/v1"
 )
 
 func (a *agent) httpBackend() http.Handler {
-	proxy := httputil.NewSingleHostReverseProxy(a.cfg.proxyURL)
+	reverseProxy := httputil.NewSingleHostReverseProxy(a.cfg.proxyURL)
+	reverseProxy.Transport = a.upstream.roundTripper()
+	proxy := a.stripCredentialsHandler(reverseProxy)
 	router := mux.NewRouter()
 
 	if log.GetLevel() == log.DebugLevel {
@@ -33,6 +35,12 @@ func (a *agent) httpBackend() http.Handler {
 	// enable metrics
 	router.Path("/_/metrics").Methods("GET").Handler(promhttp.Handler())
 
+	// enable browser login
+	if a.sessions != nil {
+		router.Path(loginPath).Methods("GET", "POST").Handler(a.loginHandler())
+		router.Path(logoutPath).Methods("GET", "POST").Handler(a.logoutHandler())
+	}
+
 	// proxy white list
 	router.Path("/alerts").Methods("GET").Handler(proxy)
 	router.Path("/graph").Methods("GET").Handler(proxy)
@@ -51,8 +59,11 @@ func (a *agent) httpBackend() http.Handler {
 	router.Path("/-/ready").Methods("GET").Handler(proxy)
 	router.PathPrefix("/debug/").Methods("GET").Handler(proxy)
 
-	// access control
-	router.PathPrefix("/").Handler(accessControl(a, proxy))
+	// access control, optionally scoped by path
+	accessControlHandler := accessControl(a, proxy)
+	router.PathPrefix("/ns/{namespace}/").Handler(a.withPathScope(pathScopeNamespace, accessControlHandler))
+	router.PathPrefix("/project/{projectID}/").Handler(a.withPathScope(pathScopeProject, accessControlHandler))
+	router.PathPrefix("/").Handler(accessControlHandler)
 
 	return router
 }
@@ -62,37 +73,73 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var userInfo authentication.UserInfo
-			var err error
-			accessToken := strings.TrimPrefix(r.Header.Get(authorizationHeaderKey), "Bearer ")
-
-			// try to authenticate the access token
-			if len(accessToken) == 0 {
-				err = errors.New("no access token provided")
-			} else {
-				userInfo, err = agt.tokens.Authenticate(accessToken)
-			}
-
+			accessToken, userInfo, err := agt.authenticate(r)
 			if err != nil {
 				// either not token was provided or user is unauthenticated with k8s API
 				http.Error(w, err.Error(), http.StatusUnauthorized)
 				return
 			}
 
+			requested := requestedScope(r)
+			r = stripScope(agt.stripCredentials(r))
+			r = r.WithContext(context.WithValue(r.Context(), upstreamAffinityKey, userInfo.Username))
+
+			path, _ := r.Context().Value(pathScopeContextKey).(*pathScope)
+			bypassed := agt.bypass(userInfo, "http")
+
 			// direct proxy
-			if kube.MatchingUsers(agt.userInfo, userInfo) {
-				proxyHandler.ServeHTTP(w, r)
+			if bypassed && path == nil && requested == nil {
+				proxyHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantPassThroughContextKey, true)))
 				return
 			}
 
+			var grants data.Grants
+			if !bypassed {
+				grants = agt.queryGrants(accessToken, userInfo)
+			}
+			namespaceSet, err := agt.scopeNamespaces(accessToken, userInfo, bypassed, path, requested, grants)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			rewriteMatchers := true
+			if agt.tenants != nil {
+				tenants, err := agt.tenants.resolve(namespaceSet)
+				if err != nil {
+					log.WithError(err).Errorf("failed to resolve tenants of %s", userInfo.Username)
+					http.Error(w, "unable to resolve the tenants", http.StatusInternalServerError)
+					return
+				}
+				if len(tenants) == 0 {
+					// the upstream falls back to its default tenant without the header
+					http.Error(w, fmt.Sprintf("no tenant is resolved for %s", userInfo.Username), http.StatusForbidden)
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), tenantHeaderContextKey, newTenantHeader(agt.tenants.header, tenants)))
+				rewriteMatchers = agt.cfg.tenant.rewriteMatchers
+			}
+
 			apiCtx := &apiContext{
 				tag:                  fmt.Sprintf("%016x", time.Now().Unix()),
 				response:             w,
 				request:              r,
 				proxyHandler:         proxyHandler,
 				filterReaderLabelSet: agt.cfg.filterReaderLabelSet,
-				namespaceSet:         agt.namespaces.Query(accessToken),
+				verifyReadNamespaces: agt.cfg.verifyReadNamespaces,
+				writeMode:            agt.cfg.writeMode,
+				scopeMode:            agt.cfg.scopeMode,
+				namespaceSet:         namespaceSet,
+				grants:               grants,
+				clusterSelectors:     agt.clusters,
+				rewriteMatchers:      rewriteMatchers,
 				remoteAPI:            agt.remoteAPI,
+				shards:               agt.shards,
+				shardAPIs:            agt.shardAPIs,
+			}
+			if !bypassed {
+				apiCtx.redactor = agt.redactor
+				apiCtx.nameFilter = agt.metricNameFilter(userInfo, namespaceSet)
 			}
 
 			newReqCtx := context.WithValue(r.Context(), apiContextKey, apiCtx)
@@ -104,9 +151,11 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 	router.Path("/api/v1/query_range").Methods("GET", "POST").Handler(apiContextHandler(hijackQueryRange))
 	router.Path("/api/v1/series").Methods("GET").Handler(apiContextHandler(hijackSeries))
 	router.Path("/api/v1/read").Methods("POST").Handler(apiContextHandler(hijackRead))
+	router.Path("/api/v1/write").Methods("POST").Handler(apiContextHandler(hijackWrite))
 	router.Path("/api/v1/label/__name__/values").Methods("GET").Handler(apiContextHandler(hijackLabelName))
 	router.Path("/api/v1/label/namespace/values").Methods("GET").Handler(apiContextHandler(hijackLabelNamespaces))
-	router.Path("/api/v1/label/{name}/values").Methods("GET").Handler(proxyHandler)
+	router.Path("/api/v1/label/{name}/values").Methods("GET").Handler(apiContextHandler(hijackLabelValues))
+	router.Path("/api/v1/metadata").Methods("GET").Handler(apiContextHandler(hijackMetadata))
 	router.Path("/federate").Methods("GET").Handler(apiContextHandler(hijackFederate))
 
 	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -115,3 +164,30 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 
 	return router
 }
+
+// authenticate resolves the caller identity, the token is taken from the bearer header, the query parameter or the session cookie in order,
+// the verified client certificate is the last resort.
+func (a *agent) authenticate(r *http.Request) (string, authentication.UserInfo, error) {
+	accessToken := strings.TrimPrefix(r.Header.Get(authorizationHeaderKey), "Bearer ")
+	if paramName := a.cfg.session.accessTokenParamName(); len(accessToken) == 0 && len(paramName) != 0 {
+		accessToken = r.URL.Query().Get(paramName)
+	}
+	if len(accessToken) == 0 {
+		accessToken = a.sessions.accessToken(r)
+	}
+	if len(accessToken) != 0 {
+		userInfo, err := a.tokens.Authenticate(accessToken)
+		return accessToken, userInfo, err
+	}
+
+	if userInfo, ok := userInfoFromConnectionState(requestConnectionState(r)); ok {
+		return "", userInfo, nil
+	}
+
+	return "", authentication.UserInfo{}, errors.New("no access token provided")
+}
+
+func (a *agent) queryNamespaces(accessToken string, userInfo authentication.UserInfo) data.Set {
+	// identities without token, e.g. client certificates, are only granted by their project memberships
+	return a.namespaces.Query(accessToken, userInfo)
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
 	"strings"
@@ -14,17 +15,21 @@ import (
 	promgo "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/runtime"
 )
 
 const (
 	apiContextKey = "_apiContext_"
+
+	emptyScopeWarning = "no namespace is in the scope, the result is empty"
 )
 
 var (
 	badRequestErr     = errors.BadRequestf("bad_data")
 	notProvisionedErr = errors.NotProvisionedf("execution")
+	forbiddenErr      = errors.Forbiddenf("forbidden")
 	internalErr       = errors.New("internal")
 )
 
@@ -35,8 +40,30 @@ type apiContext struct {
 	request              *http.Request
 	proxyHandler         http.Handler
 	filterReaderLabelSet data.Set
+	verifyReadNamespaces bool
+	writeMode            string
+	scopeMode            string
 	namespaceSet         data.Set
+	grants               data.Grants
+	partialGrants        data.Grants
+	clusterSelectors     prom.ClusterSelectors
+	redactor             *labelRedactor
+	nameFilter           *prom.MetricNameFilter
+	rewriteMatchers      bool
 	remoteAPI            promapiv1.API
+	shards               *shardSet
+	shardAPIs            []promapiv1.API
+	warnings             []string
+}
+
+// addWarning reports a rewrite of the request in the "warnings" of the JSON response.
+func (c *apiContext) addWarning(warning string) {
+	for _, w := range c.warnings {
+		if w == warning {
+			return
+		}
+	}
+	c.warnings = append(c.warnings, warning)
 }
 
 type jsonResponseData struct {
@@ -44,16 +71,22 @@ type jsonResponseData struct {
 	Data      interface{} `json:"data,omitempty"`
 	ErrorType string      `json:"errorType,omitempty"`
 	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+func (c *apiContext) responseJSON(data interface{}) error {
+	return c.responseJSONWithWarnings(data, nil)
 }
 
-func (c *apiContext) responseJSON(data interface{}) (err error) {
+func (c *apiContext) responseJSONWithWarnings(data interface{}, warnings []string) (err error) {
 	c.Do(func() {
 		resp := c.response
 		resp.Header().Set(httputil.ContentTypeHeader, httputil.JSONContentType)
 
 		responseData := &jsonResponseData{
-			Status: "success",
-			Data:   data,
+			Status:   "success",
+			Data:     data,
+			Warnings: append(warnings, c.warnings...),
 		}
 
 		respBytes, marshalErr := json.Marshal(responseData)
@@ -96,7 +129,7 @@ func (c *apiContext) responseProto(data proto.Message) (err error) {
 	return
 }
 
-func (c *apiContext) responseMetrics(data *promgo.MetricFamily) (err error) {
+func (c *apiContext) responseMetrics(data ...*promgo.MetricFamily) (err error) {
 	c.Do(func() {
 		req, resp := c.request, c.response
 
@@ -104,12 +137,11 @@ func (c *apiContext) responseMetrics(data *promgo.MetricFamily) (err error) {
 		respEncoder := expfmt.NewEncoder(resp, respFormat)
 		resp.Header().Set(httputil.ContentTypeHeader, string(respFormat))
 
-		if data == nil {
-			return
-		}
-
-		if encodeErr := respEncoder.Encode(data); encodeErr != nil {
-			err = errors.Wrap(encodeErr, internalErr)
+		for _, family := range data {
+			if encodeErr := respEncoder.Encode(family); encodeErr != nil {
+				err = errors.Wrap(encodeErr, internalErr)
+				return
+			}
 		}
 	})
 
@@ -126,12 +158,75 @@ func (c *apiContext) proxy() error {
 
 func (c *apiContext) proxyWith(request *http.Request) error {
 	c.Do(func() {
-		c.proxyHandler.ServeHTTP(c.response, request)
+		c.proxyHandler.ServeHTTP(c.response, request.WithContext(c.request.Context()))
 	})
 
 	return nil
 }
 
+// captureUpstream proxies the request and keeps the successful response for merging,
+// the other responses are passed through as they are and nil is returned.
+func (c *apiContext) captureUpstream(request *http.Request) (*shardResponse, error) {
+	req := request.WithContext(c.request.Context())
+	// the captured body must be readable
+	req.Header.Del(httputil.AcceptEncodingHeader)
+
+	captured := newCapturedResponse()
+	c.proxyHandler.ServeHTTP(captured, req)
+
+	if captured.code/100 != 2 {
+		c.Do(func() {
+			for key, values := range captured.header {
+				c.response.Header()[key] = values
+			}
+			c.response.WriteHeader(captured.code)
+			_, _ = c.response.Write(captured.body.Bytes())
+		})
+		return nil, nil
+	}
+
+	body := captured.body.Bytes()
+	if strings.EqualFold(captured.header.Get(httputil.ContentEncodingHeader), "snappy") {
+		var err error
+		body, err = snappy.Decode(nil, body)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to decode response of upstream")
+		}
+	}
+
+	return &shardResponse{
+		shard:  request.URL,
+		header: captured.header,
+		body:   body,
+	}, nil
+}
+
+type capturedResponse struct {
+	header http.Header
+	code   int
+	body   *bytes.Buffer
+}
+
+func newCapturedResponse() *capturedResponse {
+	return &capturedResponse{
+		header: http.Header{},
+		code:   http.StatusOK,
+		body:   &bytes.Buffer{},
+	}
+}
+
+func (r *capturedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *capturedResponse) Write(p []byte) (int, error) {
+	return r.body.Write(p)
+}
+
+func (r *capturedResponse) WriteHeader(code int) {
+	r.code = code
+}
+
 type apiContextHandler func(*apiContext) error
 
 func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -165,6 +260,9 @@ func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if errors.IsNotProvisioned(err) {
 		responseCode = http.StatusUnprocessableEntity
 		responseErrType = "execution"
+	} else if errors.IsForbidden(err) {
+		responseCode = http.StatusForbidden
+		responseErrType = "forbidden"
 	}
 
 	acceptHeaderValue := r.Header.Get(httputil.AcceptHeader)
@@ -5,14 +5,19 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/util/httputil"
 	"github.com/golang/snappy"
+	"github.com/gorilla/mux"
 	"github.com/juju/errors"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/expfmt"
 	prommodel "github.com/prometheus/common/model"
 	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -31,16 +36,26 @@ func hijackFederate(apiCtx *apiContext) error {
 	}
 
 	matchFormValues := queries["match[]"]
+	matcherSets := make([][]*promlb.Matcher, 0, len(matchFormValues))
 	for _, rawValue := range matchFormValues {
-		_, err := parser.ParseMetricSelector(rawValue)
+		matchers, err := parser.ParseMetricSelector(rawValue)
 		if err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
+		if err := apiCtx.redactor.checkMatchers(matchers, apiCtx.clusterSelectors); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	now := time.Now()
+	apiCtx.restrictPeriod(now.Add(-lookbackDelta), now)
+	if err := apiCtx.checkScope(matcherSets...); err != nil {
+		return err
 	}
 
 	// quick response
 	if len(matchFormValues) == 0 || len(apiCtx.namespaceSet) == 0 {
-		return apiCtx.responseMetrics(nil)
+		return apiCtx.responseMetrics()
 	}
 
 	// hijack
@@ -52,7 +67,7 @@ func hijackFederate(apiCtx *apiContext) error {
 		}
 
 		log.Debugf("raw federate[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := modifyExpression(expr, apiCtx.namespaceSet)
+		hjkValue := apiCtx.modifyExpression(expr)
 		log.Debugf("hjk federate[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
 
 		queries.Add("match[]", hjkValue)
@@ -67,8 +82,11 @@ func hijackFederate(apiCtx *apiContext) error {
 	if err != nil {
 		return errors.Wrap(err, internalErr)
 	}
+	if apiCtx.decodesResponses() {
+		newReq.Header.Set(httputil.AcceptHeader, string(expfmt.FmtText))
+	}
 
-	return apiCtx.proxyWith(newReq)
+	return apiCtx.proxyWithMerger(newReq, mergeFederate)
 }
 
 func hijackQuery(apiCtx *apiContext) error {
@@ -82,6 +100,15 @@ func hijackQuery(apiCtx *apiContext) error {
 		}
 	}
 
+	ts := time.Now()
+	if t := req.FormValue("time"); len(t) != 0 {
+		parsed, err := parseTime(t)
+		if err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+		ts = parsed
+	}
+
 	queryFormValue := req.FormValue("query")
 	if len(queryFormValue) == 0 {
 		return errors.Wrap(errors.New("unable to get 'query' value from request"), badRequestErr)
@@ -93,6 +120,20 @@ func hijackQuery(apiCtx *apiContext) error {
 		return errors.Wrap(err, badRequestErr)
 	}
 
+	if apiCtx.shards != nil {
+		if err := prom.ValidateFanOut(queryExpr); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
+
+	if err := apiCtx.redactor.checkExpression(queryExpr, apiCtx.clusterSelectors); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+	apiCtx.limitExpressionPeriod(queryExpr, ts, ts)
+	if err := apiCtx.checkExpressionScope(queryExpr); err != nil {
+		return err
+	}
+
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
 		var qs *stats.QueryStats
@@ -101,6 +142,7 @@ func hijackQuery(apiCtx *apiContext) error {
 		}
 
 		if queryExpr.Type() != parser.ValueTypeScalar {
+			apiCtx.addWarning(emptyScopeWarning)
 			var val parser.Value
 			switch queryExpr.Type() {
 			case parser.ValueTypeVector:
@@ -128,7 +170,7 @@ func hijackQuery(apiCtx *apiContext) error {
 	// hijack
 	req.Form.Del("query")
 	log.Debugf("raw query[%s - 0] => %s", apiCtx.tag, rawValue)
-	hjkValue := modifyExpression(queryExpr, apiCtx.namespaceSet)
+	hjkValue := apiCtx.modifyPeriodExpression(queryExpr, ts, ts)
 	log.Debugf("hjk query[%s - 0] => %s", apiCtx.tag, hjkValue)
 	req.Form.Set("query", hjkValue)
 
@@ -142,7 +184,7 @@ func hijackQuery(apiCtx *apiContext) error {
 		return errors.Wrap(err, internalErr)
 	}
 
-	return apiCtx.proxyWith(newReq)
+	return apiCtx.proxyWithMerger(newReq, mergeQuery)
 }
 
 func hijackQueryRange(apiCtx *apiContext) error {
@@ -194,6 +236,20 @@ func hijackQueryRange(apiCtx *apiContext) error {
 		return errors.Wrap(err, badRequestErr)
 	}
 
+	if apiCtx.shards != nil {
+		if err := prom.ValidateFanOut(queryExpr); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
+
+	if err := apiCtx.redactor.checkExpression(queryExpr, apiCtx.clusterSelectors); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+	apiCtx.limitExpressionPeriod(queryExpr, start, end)
+	if err := apiCtx.checkExpressionScope(queryExpr); err != nil {
+		return err
+	}
+
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
 		var qs *stats.QueryStats
@@ -202,6 +258,7 @@ func hijackQueryRange(apiCtx *apiContext) error {
 		}
 
 		if queryExpr.Type() != parser.ValueTypeScalar {
+			apiCtx.addWarning(emptyScopeWarning)
 			var val parser.Value
 			switch queryExpr.Type() {
 			case parser.ValueTypeVector:
@@ -229,7 +286,7 @@ func hijackQueryRange(apiCtx *apiContext) error {
 	// hijack
 	req.Form.Del("query")
 	log.Debugf("raw query[%s - 0] => %s", apiCtx.tag, rawValue)
-	hjkValue := modifyExpression(queryExpr, apiCtx.namespaceSet)
+	hjkValue := apiCtx.modifyPeriodExpression(queryExpr, start, end)
 	log.Debugf("hjk query[%s - 0] => %s", apiCtx.tag, hjkValue)
 	req.Form.Set("query", hjkValue)
 
@@ -243,7 +300,7 @@ func hijackQueryRange(apiCtx *apiContext) error {
 		return errors.Wrap(err, internalErr)
 	}
 
-	return apiCtx.proxyWith(newReq)
+	return apiCtx.proxyWithMerger(newReq, mergeQuery)
 }
 
 func hijackSeries(apiCtx *apiContext) error {
@@ -272,46 +329,61 @@ func hijackSeries(apiCtx *apiContext) error {
 		return errors.Wrap(errors.New("no match[] parameter provided"), badRequestErr)
 	}
 
+	matcherSets := make([][]*promlb.Matcher, 0, len(matchFormValues))
 	for _, rawValue := range matchFormValues {
-		_, err := parser.ParseMetricSelector(rawValue)
+		matchers, err := parser.ParseMetricSelector(rawValue)
 		if err != nil {
 			return errors.Wrap(err, badRequestErr)
 		}
+		if err := apiCtx.redactor.checkMatchers(matchers, apiCtx.clusterSelectors); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	start, end, err := apiCtx.limitRequestedPeriod(queries)
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+	if err := apiCtx.checkScope(matcherSets...); err != nil {
+		return err
 	}
 
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.addWarning(emptyScopeWarning)
 		emptyRespData := make([]promlb.Labels, 0, 0)
 
 		return apiCtx.responseJSON(emptyRespData)
 	}
 
 	// hijack
-	queries.Del("match[]")
-	for idx, rawValue := range matchFormValues {
-		expr, err := parser.ParseExpr(rawValue)
-		if err != nil {
-			return errors.Wrap(err, badRequestErr)
-		}
+	hjkQueries, err := apiCtx.periodQueries(queries, start, end, func(periodQueries url.Values) error {
+		periodQueries.Del("match[]")
+		for idx, rawValue := range matchFormValues {
+			expr, err := parser.ParseExpr(rawValue)
+			if err != nil {
+				return errors.Wrap(err, badRequestErr)
+			}
 
-		log.Debugf("raw series[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := modifyExpression(expr, apiCtx.namespaceSet)
-		log.Debugf("hjk series[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+			log.Debugf("raw series[%s - %d] => %s", apiCtx.tag, idx, rawValue)
+			hjkValue := apiCtx.modifyExpression(expr)
+			log.Debugf("hjk series[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
 
-		queries.Add("match[]", hjkValue)
+			periodQueries.Add("match[]", hjkValue)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// inject
-	reqURL := *apiCtx.request.URL
-	reqURL.RawQuery = queries.Encode()
-
-	// proxy
-	newReq, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	// inject & proxy
+	newReqs, err := apiCtx.newPeriodRequests(hjkQueries)
 	if err != nil {
-		return errors.Wrap(err, internalErr)
+		return err
 	}
 
-	return apiCtx.proxyWith(newReq)
+	return apiCtx.proxyAllWithMerger(newReqs, mergeSeries)
 }
 
 func hijackRead(apiCtx *apiContext) error {
@@ -323,10 +395,43 @@ func hijackRead(apiCtx *apiContext) error {
 		return errors.Wrap(err, badRequestErr)
 	}
 
+	responseType, err := apiCtx.negotiateReadResponseType(pbreq.AcceptedResponseTypes)
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+
 	rawQueries := pbreq.Queries
+	matcherSets := make([][]*promlb.Matcher, 0, len(rawQueries))
+	var startMs, endMs int64 = math.MaxInt64, math.MinInt64
+	for _, rawQuery := range rawQueries {
+		if rawQuery.StartTimestampMs < startMs {
+			startMs = rawQuery.StartTimestampMs
+		}
+		if rawQuery.EndTimestampMs > endMs {
+			endMs = rawQuery.EndTimestampMs
+		}
+		matchers, err := prom.FromLabelMatchers(rawQuery.Matchers)
+		if err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+		if err := apiCtx.redactor.checkMatchers(matchers, apiCtx.clusterSelectors); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	if len(rawQueries) != 0 {
+		apiCtx.restrictPeriod(timestamp.Time(startMs), timestamp.Time(endMs))
+	}
+	if err := apiCtx.checkScope(matcherSets...); err != nil {
+		return err
+	}
 
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			return apiCtx.responseEmptyStream()
+		}
+
 		size := len(rawQueries)
 
 		results := make([]*prompb.QueryResult, 0, size)
@@ -345,12 +450,19 @@ func hijackRead(apiCtx *apiContext) error {
 	hjkQueries := make([]*prompb.Query, 0, len(rawQueries))
 	for idx, rawValue := range rawQueries {
 		log.Debugf("raw read[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := modifyQuery(rawValue, apiCtx.namespaceSet, apiCtx.filterReaderLabelSet)
+		hjkValue := apiCtx.modifyQuery(rawValue)
 		log.Debugf("hjk read[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
 
 		hjkQueries = append(hjkQueries, hjkValue)
 	}
 	pbreq.Queries = hjkQueries
+	if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+		// the frames are passed through
+		pbreq.AcceptedResponseTypes = []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS}
+	} else if apiCtx.mergesReadResponses() {
+		// the sampled responses are merged
+		pbreq.AcceptedResponseTypes = []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES}
+	}
 
 	// inject
 	marshaledData, err := pbreq.Marshal()
@@ -365,12 +477,115 @@ func hijackRead(apiCtx *apiContext) error {
 		return errors.Wrap(err, internalErr)
 	}
 
-	return apiCtx.proxyWith(newReq)
+	if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+		return apiCtx.proxyStreamed(newReq)
+	}
+	if !apiCtx.mergesReadResponses() {
+		return apiCtx.proxyWith(newReq)
+	}
+
+	return apiCtx.mergeUpstream(newReq, mergeRead)
+}
+
+func hijackLabelValues(apiCtx *apiContext) error {
+	apiCtx.response.Header().Set(httputil.ContentTypeHeader, httputil.JSONContentType)
+
+	// pre check
+	if name := mux.Vars(apiCtx.request)["name"]; !prommodel.LabelNameRE.MatchString(name) {
+		return errors.Wrap(errors.Errorf("invalid label name: %q", name), badRequestErr)
+	}
+
+	queries, err := url.ParseQuery(apiCtx.request.URL.RawQuery)
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+
+	if t := queries.Get("start"); t != "" {
+		if _, err := parseTime(t); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
+
+	if t := queries.Get("end"); t != "" {
+		if _, err := parseTime(t); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+	}
+
+	matchFormValues := queries["match[]"]
+	matcherSets := make([][]*promlb.Matcher, 0, len(matchFormValues))
+	for _, rawValue := range matchFormValues {
+		matchers, err := parser.ParseMetricSelector(rawValue)
+		if err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+		if err := apiCtx.redactor.checkMatchers(matchers, apiCtx.clusterSelectors); err != nil {
+			return errors.Wrap(err, badRequestErr)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	start, end, err := apiCtx.limitRequestedPeriod(queries)
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+	if err := apiCtx.checkScope(matcherSets...); err != nil {
+		return err
+	}
+
+	// quick response
+	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.addWarning(emptyScopeWarning)
+		emptyRespData := make([]string, 0, 0)
+
+		return apiCtx.responseJSON(emptyRespData)
+	}
+
+	// hijack
+	hjkQueries, err := apiCtx.periodQueries(queries, start, end, func(periodQueries url.Values) error {
+		periodQueries.Del("match[]")
+		for idx, rawValue := range matchFormValues {
+			expr, err := parser.ParseExpr(rawValue)
+			if err != nil {
+				return errors.Wrap(err, badRequestErr)
+			}
+
+			log.Debugf("raw label values[%s - %d] => %s", apiCtx.tag, idx, rawValue)
+			hjkValue := apiCtx.modifyExpression(expr)
+			log.Debugf("hjk label values[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+
+			periodQueries.Add("match[]", hjkValue)
+		}
+		if len(matchFormValues) == 0 {
+			// the values are taken from what the tenant can see
+			for _, hjkValue := range apiCtx.defaultSelectors() {
+				log.Debugf("hjk label values[%s] => %s", apiCtx.tag, hjkValue)
+				periodQueries.Add("match[]", hjkValue)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// inject & proxy
+	newReqs, err := apiCtx.newPeriodRequests(hjkQueries)
+	if err != nil {
+		return err
+	}
+
+	return apiCtx.proxyAllWithMerger(newReqs, mergeLabelValues)
 }
 
 func hijackLabelNamespaces(apiCtx *apiContext) error {
+	// pre check
+	if _, _, err := apiCtx.limitRequestedPeriod(apiCtx.request.URL.Query()); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.addWarning(emptyScopeWarning)
 		emptyRespData := make([]string, 0, 0)
 
 		return apiCtx.responseJSON(emptyRespData)
@@ -389,35 +604,152 @@ func hijackLabelNamespaces(apiCtx *apiContext) error {
 func hijackLabelName(apiCtx *apiContext) error {
 	apiCtx.response.Header().Set(httputil.ContentTypeHeader, httputil.JSONContentType)
 
+	// pre check
+	// the metric names are read at now
+	if err := apiCtx.restrictCurrentPeriod(apiCtx.request.URL.Query()); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.addWarning(emptyScopeWarning)
 		emptyRespData := make([]string, 0, 0)
 
 		return apiCtx.responseJSON(emptyRespData)
 	}
 
 	// hijack
-	expr := prom.NewExprForCountAllLabels(apiCtx.namespaceSet.Values())
-	vals, warns, err := apiCtx.remoteAPI.Query(apiCtx.request.Context(), expr, time.Time{})
-	for _, warn := range warns {
-		log.Debugf("received warning on query: %s", warn)
+	hjkValueSet, err := apiCtx.metricNames()
+	if err != nil {
+		return err
+	}
+
+	hjkValues := make(prommodel.LabelValues, 0, len(hjkValueSet))
+	for _, v := range hjkValueSet.Values() {
+		hjkValues = append(hjkValues, prommodel.LabelValue(v))
+	}
+
+	return apiCtx.responseJSON(hjkValues)
+}
+
+func hijackMetadata(apiCtx *apiContext) error {
+	apiCtx.response.Header().Set(httputil.ContentTypeHeader, httputil.JSONContentType)
+
+	queries := apiCtx.request.URL.Query()
+	metric := queries.Get("metric")
+	if err := apiCtx.restrictCurrentPeriod(queries); err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+
+	// quick response
+	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.addWarning(emptyScopeWarning)
+		return apiCtx.responseJSON(map[string][]promapiv1.Metadata{})
 	}
+
+	// hijack
+	// the metadata is not scoped by namespace, only the metric names which the tenant can see are kept
+	nameSet, err := apiCtx.metricNames()
 	if err != nil {
-		return errors.Wrap(err, notProvisionedErr)
+		return err
 	}
 
-	vectorVals, ok := vals.(prommodel.Vector)
-	if !ok {
-		return errors.Wrap(err, notProvisionedErr)
+	hjkValue := map[string][]promapiv1.Metadata{}
+	for _, remoteAPI := range apiCtx.remoteAPIs() {
+		metadata, err := remoteAPI.Metadata(apiCtx.request.Context(), metric, "")
+		if err != nil {
+			return errors.Wrap(err, notProvisionedErr)
+		}
+
+		for name, entries := range metadata {
+			if _, exist := nameSet[name]; !exist {
+				continue
+			}
+			if _, exist := hjkValue[name]; !exist {
+				hjkValue[name] = entries
+			}
+		}
 	}
 
-	hjkValues := make(prommodel.LabelValues, 0, len(vectorVals))
-	for _, vectorVal := range vectorVals {
-		valLabelSet := prommodel.LabelSet(vectorVal.Metric)
-		hjkValues = append(hjkValues, valLabelSet["__name__"])
+	if limit, err := strconv.Atoi(queries.Get("limit")); err == nil && limit >= 0 && len(hjkValue) > limit {
+		names := make([]string, 0, len(hjkValue))
+		for name := range hjkValue {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names[limit:] {
+			delete(hjkValue, name)
+		}
 	}
 
-	return apiCtx.responseJSON(hjkValues)
+	return apiCtx.responseJSON(hjkValue)
+}
+
+func (c *apiContext) remoteAPIs() []promapiv1.API {
+	if c.shards != nil {
+		return c.shardAPIs
+	}
+
+	return []promapiv1.API{c.remoteAPI}
+}
+
+// defaultSelectors returns the selectors of the namespaces and of the cluster metrics with the metric name filter,
+// which replace the missing match[] of a request.
+func (c *apiContext) defaultSelectors() []string {
+	instantVectorSelectors := []string{`{__name__=~".+"}`}
+	if c.rewriteMatchers {
+		instantVectorSelectors = c.clusterSelectors.NewInstantVectorSelectors(c.namespaceSet.Values())
+	}
+
+	ret := make([]string, 0, len(instantVectorSelectors))
+	for _, instantVectorSelector := range instantVectorSelectors {
+		matchers, err := parser.ParseMetricSelector(instantVectorSelector)
+		if err != nil {
+			log.WithError(err).Errorf("unable to parse selector %s", instantVectorSelector)
+			continue
+		}
+		filtered := c.nameFilter.FilterMatchers(matchers)
+		if !c.rewriteMatchers && len(filtered) == len(matchers) {
+			// the upstream isolates the tenants by itself
+			return nil
+		}
+		ret = append(ret, (&parser.VectorSelector{LabelMatchers: filtered}).String())
+	}
+
+	return ret
+}
+
+// metricNames returns the metric names which the tenant can see.
+func (c *apiContext) metricNames() (data.Set, error) {
+	expr := c.clusterSelectors.NewExprForCountAllLabels(c.namespaceSet.Values())
+	if !c.rewriteMatchers {
+		expr = prom.NewExprForCountAllNames()
+	}
+
+	ret := data.Set{}
+	for _, remoteAPI := range c.remoteAPIs() {
+		vals, warns, err := remoteAPI.Query(c.request.Context(), expr, time.Time{})
+		for _, warn := range warns {
+			log.Debugf("received warning on query: %s", warn)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, notProvisionedErr)
+		}
+
+		vectorVals, ok := vals.(prommodel.Vector)
+		if !ok {
+			return nil, errors.Wrap(errors.Errorf("unexpected value type %q", vals.Type()), notProvisionedErr)
+		}
+
+		for _, vectorVal := range vectorVals {
+			name := string(prommodel.LabelSet(vectorVal.Metric)["__name__"])
+			if c.nameFilter.Allowed(name) {
+				ret[name] = struct{}{}
+			}
+		}
+	}
+
+	return ret, nil
 }
 
 func parseTime(s string) (time.Time, error) {
@@ -446,25 +778,34 @@ func parseDuration(s string) (time.Duration, error) {
 	return 0, errors.Errorf("cannot parse %q to a valid duration", s)
 }
 
-func modifyExpression(originalExpr parser.Expr, namespaceSet data.Set) (modifiedExpr string) {
+func (c *apiContext) modifyExpression(originalExpr parser.Expr) string {
+	return modifyExpression(originalExpr, func(matchers []*promlb.Matcher) []*promlb.Matcher {
+		// the upstream isolates the tenants by itself
+		if c.rewriteMatchers {
+			matchers = c.clusterSelectors.FilterMatchers(c.namespaceSet, matchers)
+		}
+
+		return c.nameFilter.FilterMatchers(matchers)
+	})
+}
+
+func (c *apiContext) modifyQuery(originalQuery *prompb.Query) *prompb.Query {
+	filteredQuery := filterQuery(originalQuery, c.filterReaderLabelSet)
+
+	if c.rewriteMatchers {
+		filteredQuery.Matchers = c.clusterSelectors.FilterLabelMatchers(c.namespaceSet, filteredQuery.Matchers)
+	}
+	filteredQuery.Matchers = c.nameFilter.FilterLabelMatchers(filteredQuery.Matchers)
+
+	return filteredQuery
+}
+
+func modifyExpression(originalExpr parser.Expr, filterMatchers func([]*promlb.Matcher) []*promlb.Matcher) (modifiedExpr string) {
+	// the vector selector of a matrix selector is inspected as its child, it must be filtered only once,
+	// e.g. the "namespace" matcher added for a cluster metric is not one of the caller
 	parser.Inspect(originalExpr, func(node parser.Node, _ []parser.Node) error {
-		switch n := node.(type) {
-		case *parser.VectorSelector:
-			n.LabelMatchers = prom.FilterMatchers(namespaceSet, n.LabelMatchers)
-		case *parser.MatrixSelector:
-			vs, ok := n.VectorSelector.(*parser.VectorSelector)
-			if !ok {
-				// If it is not a vector selector, we don't need to modify the labelMatchers
-				//
-				// However, this is unexpected since we always expect to be able to extract
-				// the VectorSelector from the MatrixSelector.
-				//
-				// If this is not the case, we may be encountering an unexpected error here.
-				log.Errorf("unable to extract vector selector from matrix selector")
-				return nil
-			}
-			vs.LabelMatchers = prom.FilterMatchers(namespaceSet, vs.LabelMatchers)
-			n.VectorSelector = vs
+		if n, ok := node.(*parser.VectorSelector); ok {
+			n.LabelMatchers = filterMatchers(n.LabelMatchers)
 		}
 		return nil
 	})
@@ -472,7 +813,7 @@ func modifyExpression(originalExpr parser.Expr, namespaceSet data.Set) (modified
 	return originalExpr.String()
 }
 
-func modifyQuery(originalQuery *prompb.Query, namespaceSet, filterReaderLabelSet data.Set) (modifiedQuery *prompb.Query) {
+func filterQuery(originalQuery *prompb.Query, filterReaderLabelSet data.Set) (filteredQuery *prompb.Query) {
 	rawMatchers := originalQuery.GetMatchers()
 	filteredMatchers := make([]*prompb.LabelMatcher, 0, len(rawMatchers))
 	for _, rawMatcher := range rawMatchers {
@@ -481,6 +822,6 @@ func modifyQuery(originalQuery *prompb.Query, namespaceSet, filterReaderLabelSet
 		}
 	}
 
-	originalQuery.Matchers = prom.FilterLabelMatchers(namespaceSet, filteredMatchers)
+	originalQuery.Matchers = filteredMatchers
 	return originalQuery
 }
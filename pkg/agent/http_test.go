@@ -616,11 +616,49 @@ func sortReadResponse(rr *prompb.ReadResponse) {
 }
 
 type fakeOwnedNamespaces struct {
-	token2Namespaces map[string]data.Set
+	token2Namespaces    map[string]data.Set
+	user2ProjectIDs     map[string][]string
+	namespace2ProjectID map[string]string
+	namespace2Periods   map[string][]data.Period
 }
 
-func (f *fakeOwnedNamespaces) Query(token string) data.Set {
-	return f.token2Namespaces[token]
+func (f *fakeOwnedNamespaces) Query(token string, userInfo authentication.UserInfo) data.Set {
+	ret := data.Set{}
+	for namespace := range f.token2Namespaces[token] {
+		ret[namespace] = struct{}{}
+	}
+	for _, projectID := range f.user2ProjectIDs[userInfo.Username] {
+		for namespace := range f.ProjectNamespaces(projectID) {
+			ret[namespace] = struct{}{}
+		}
+	}
+	return ret
+}
+
+func (f *fakeOwnedNamespaces) Grants(token string, userInfo authentication.UserInfo) data.Grants {
+	ret := data.Grants{}
+	for namespace := range f.Query(token, userInfo) {
+		ret[namespace] = []data.Period{{}}
+		if periods, exist := f.namespace2Periods[namespace]; exist {
+			ret[namespace] = periods
+		}
+	}
+	return ret
+}
+
+func (f *fakeOwnedNamespaces) ProjectID(namespace string) (string, bool) {
+	projectID, exist := f.namespace2ProjectID[namespace]
+	return projectID, exist
+}
+
+func (f *fakeOwnedNamespaces) ProjectNamespaces(projectID string) data.Set {
+	ret := data.Set{}
+	for namespace, nsProjectID := range f.namespace2ProjectID {
+		if nsProjectID == projectID {
+			ret[namespace] = struct{}{}
+		}
+	}
+	return ret
 }
 
 func mockOwnedNamespaces() kube.Namespaces {
@@ -629,6 +667,14 @@ func mockOwnedNamespaces() kube.Namespaces {
 			"noneNamespacesToken": {},
 			"someNamespacesToken": data.NewSet("ns-a", "ns-b"),
 		},
+		user2ProjectIDs: map[string][]string{
+			"multiProjectsUser": {"p-ab", "p-c"},
+		},
+		namespace2ProjectID: map[string]string{
+			"ns-a": "p-ab",
+			"ns-b": "p-ab",
+			"ns-c": "p-c",
+		},
 	}
 }
 
@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -14,6 +13,8 @@ import (
 
 const (
 	authorizationHeaderKey = "Authorization"
+
+	grpcContentType = "application/grpc"
 )
 
 func createHTTPListener(mux cmux.CMux) net.Listener {
@@ -22,15 +23,38 @@ func createHTTPListener(mux cmux.CMux) net.Listener {
 	)
 }
 
-func createGRPCListener(mux cmux.CMux, hostAccessToken string) net.Listener {
+func createHTTP2Listener(mux cmux.CMux) net.Listener {
 	return mux.Match(
-		http2HeaderFieldEqual(map[string]string{
-			"Content-Type":         "application/grpc",
-			authorizationHeaderKey: fmt.Sprintf("Bearer %s", hostAccessToken),
+		cmux.HTTP2(),
+	)
+}
+
+// createGRPCListener matches every gRPC call, the callers are authenticated by the gRPC backend.
+func createGRPCListener(mux cmux.CMux) net.Listener {
+	return mux.Match(
+		http2HeaderFieldMatch(map[string]func(string) bool{
+			"Content-Type": isGRPCContentType,
 		}),
 	)
 }
 
+// isGRPCContentType accepts "application/grpc" and its subtypes, e.g. "application/grpc+proto" sent by Thanos.
+func isGRPCContentType(value string) bool {
+	if !strings.HasPrefix(value, grpcContentType) {
+		return false
+	}
+	if len(value) == len(grpcContentType) {
+		return true
+	}
+
+	switch value[len(grpcContentType)] {
+	case '+', ';':
+		return true
+	}
+
+	return false
+}
+
 func hasHTTP2Preface(r io.Reader) bool {
 	var b [len(http2.ClientPreface)]byte
 	if _, err := io.ReadFull(r, b[:]); err != nil {
@@ -40,20 +64,21 @@ func hasHTTP2Preface(r io.Reader) bool {
 	return string(b[:]) == http2.ClientPreface
 }
 
-func http2HeaderFieldEqual(nameValuePairs map[string]string) cmux.Matcher {
+func http2HeaderFieldMatch(nameMatchers map[string]func(string) bool) cmux.Matcher {
 	return func(r io.Reader) (matched bool) {
 		if !hasHTTP2Preface(r) {
 			return false
 		}
 
 		framer := http2.NewFramer(ioutil.Discard, r)
+		matchedNames := make(map[string]struct{}, len(nameMatchers))
 		hdec := hpack.NewDecoder(uint32(4<<10), func(hf hpack.HeaderField) {
-			for name, value := range nameValuePairs {
-				matched = strings.EqualFold(hf.Name, name) && hf.Value == value
-				if !matched {
-					break
+			for name, match := range nameMatchers {
+				if strings.EqualFold(hf.Name, name) && match(hf.Value) {
+					matchedNames[name] = struct{}{}
 				}
 			}
+			matched = len(matchedNames) == len(nameMatchers)
 		})
 		for {
 			f, err := framer.ReadFrame()
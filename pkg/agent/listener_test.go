@@ -0,0 +1,44 @@
+//go:build test
+
+package agent
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func Test_grpcListenerMatcher(t *testing.T) {
+	testCases := map[string]bool{
+		"application/grpc":               true,
+		"application/grpc+proto":         true,
+		"application/grpc;charset=utf-8": true,
+		"application/grpc-web":           false,
+		"application/json":               false,
+	}
+
+	matcher := http2HeaderFieldMatch(map[string]func(string) bool{
+		"Content-Type": isGRPCContentType,
+	})
+
+	for contentType, expect := range testCases {
+		headers := &bytes.Buffer{}
+		henc := hpack.NewEncoder(headers)
+		require.NoError(t, henc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"}))
+		require.NoError(t, henc.WriteField(hpack.HeaderField{Name: "content-type", Value: contentType}))
+
+		conn := bytes.NewBufferString(http2.ClientPreface)
+		framer := http2.NewFramer(conn, nil)
+		require.NoError(t, framer.WriteSettings())
+		require.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: headers.Bytes(),
+			EndHeaders:    true,
+		}))
+
+		require.Equal(t, expect, matcher(conn), contentType)
+	}
+}
@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "prometheus_auth"
+)
+
+var (
+	upstreamUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_up",
+		Help:      "Whether the upstream replica passed the last readiness probe.",
+	}, []string{"upstream"})
+
+	upstreamRetriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_retries_total",
+		Help:      "Total number of requests retried against another upstream replica.",
+	}, []string{"upstream"})
+
+	bypassDecisionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bypass_decisions_total",
+		Help:      "Total number of bypass decisions by protocol and reason, 'none' means the caller is restricted to the owned namespaces.",
+	}, []string{"protocol", "reason"})
+)
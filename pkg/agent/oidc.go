@@ -0,0 +1,339 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	authentication "k8s.io/api/authentication/v1"
+)
+
+const (
+	// the minimum interval to refetch the JWKS URL when a token is signed by an unknown key
+	jwksRefetchBackoff = 10 * time.Second
+
+	// disables the default username prefix, like the Kubernetes OIDC authenticator
+	oidcNoUsernamePrefix = "-"
+
+	// the identities reserved for the Kubernetes components
+	systemIdentityPrefix = "system:"
+)
+
+type oidcConfig struct {
+	issuerURL           string
+	clientID            string
+	jwksFile            string
+	jwksURL             string
+	caFile              string
+	jwksRefreshInterval time.Duration
+	usernameClaim       string
+	uidClaim            string
+	groupsClaim         string
+	usernamePrefix      string
+	groupsPrefix        string
+}
+
+func (c *oidcConfig) enabled() bool {
+	return c != nil && len(c.issuerURL) != 0
+}
+
+func (c *oidcConfig) String() string {
+	if !c.enabled() {
+		return ""
+	}
+
+	jwks := c.jwksFile
+	if len(jwks) == 0 {
+		jwks = c.jwksURL
+	}
+
+	return fmt.Sprintf(", authenticating JWT issued by %s for %s against %s", c.issuerURL, c.clientID, jwks)
+}
+
+// withDefaultUsernamePrefix prefixes the usernames other than the emails with the issuer URL unless a prefix is configured,
+// so they never collide with the Kubernetes users, '-' disables the prefix.
+func (c *oidcConfig) withDefaultUsernamePrefix() *oidcConfig {
+	ret := *c
+
+	switch {
+	case ret.usernamePrefix == oidcNoUsernamePrefix:
+		ret.usernamePrefix = ""
+	case len(ret.usernamePrefix) == 0 && ret.usernameClaim != "email":
+		ret.usernamePrefix = ret.issuerURL + "#"
+	}
+
+	return &ret
+}
+
+// oidcAuthenticator verifies the OIDC ID tokens against the JWKS of the issuer,
+// it is chained before the TokenReview, so the tokens of other issuers fall through.
+type oidcAuthenticator struct {
+	cfg  *oidcConfig
+	keys *jwksSource
+}
+
+func newOIDCAuthenticator(ctx context.Context, cfg *oidcConfig) (*oidcAuthenticator, error) {
+	if (len(cfg.jwksFile) == 0) == (len(cfg.jwksURL) == 0) {
+		return nil, errors.New("exactly one of JWKS file and JWKS URL is required")
+	}
+	if len(cfg.clientID) == 0 {
+		return nil, errors.New("blank OIDC client ID")
+	}
+	if len(cfg.usernameClaim) == 0 {
+		return nil, errors.New("blank OIDC username claim")
+	}
+
+	cfg = cfg.withDefaultUsernamePrefix()
+
+	keys := &jwksSource{
+		file:            cfg.jwksFile,
+		url:             cfg.jwksURL,
+		refreshInterval: cfg.jwksRefreshInterval,
+		client:          http.DefaultClient,
+	}
+	if len(cfg.caFile) != 0 {
+		rootCAs, err := loadCertPool(cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: rootCAs}
+		keys.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	}
+
+	if err := keys.load(ctx); err != nil {
+		if len(cfg.jwksFile) != 0 {
+			return nil, err
+		}
+		// the issuer may come up later than us
+		log.WithError(err).Warnf("Failed to fetch JWKS from %s, retry on the first token", cfg.jwksURL)
+	}
+
+	return &oidcAuthenticator{
+		cfg:  cfg,
+		keys: keys,
+	}, nil
+}
+
+func (a *oidcAuthenticator) Authenticate(token string) (authentication.UserInfo, error) {
+	var userInfo authentication.UserInfo
+
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return userInfo, errors.Annotate(err, "not a JWT")
+	}
+
+	unverified := jwt.Claims{}
+	if err := parsed.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return userInfo, errors.Annotate(err, "malformed JWT claims")
+	}
+	if unverified.Issuer != a.cfg.issuerURL {
+		return userInfo, errors.Errorf("JWT is not issued by %s", a.cfg.issuerURL)
+	}
+
+	var kid string
+	if len(parsed.Headers) != 0 {
+		kid = parsed.Headers[0].KeyID
+	}
+	keySet, err := a.keys.get(context.TODO(), kid)
+	if err != nil {
+		return userInfo, err
+	}
+	key, err := signingKey(keySet, kid)
+	if err != nil {
+		return userInfo, err
+	}
+
+	claims := jwt.Claims{}
+	rawClaims := map[string]interface{}{}
+	if err := parsed.Claims(key, &claims, &rawClaims); err != nil {
+		return userInfo, errors.Annotate(err, "invalid JWT signature")
+	}
+	if claims.Expiry == nil {
+		return userInfo, errors.New("JWT without expiry")
+	}
+	if err := claims.Validate(jwt.Expected{
+		Issuer:   a.cfg.issuerURL,
+		Audience: jwt.Audience{a.cfg.clientID},
+		Time:     time.Now(),
+	}); err != nil {
+		return userInfo, errors.Annotate(err, "invalid JWT claims")
+	}
+
+	username, ok := rawClaims[a.cfg.usernameClaim].(string)
+	if !ok || len(username) == 0 {
+		return userInfo, errors.Errorf("JWT without %q claim", a.cfg.usernameClaim)
+	}
+	username = a.cfg.usernamePrefix + username
+	if strings.HasPrefix(username, systemIdentityPrefix) {
+		return userInfo, errors.Errorf("JWT username %q is reserved", username)
+	}
+
+	var groups []string
+	if len(a.cfg.groupsClaim) != 0 {
+		for _, group := range claimStrings(rawClaims[a.cfg.groupsClaim]) {
+			group = a.cfg.groupsPrefix + group
+			if strings.HasPrefix(group, systemIdentityPrefix) {
+				return userInfo, errors.Errorf("JWT group %q is reserved", group)
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	userInfo.Username = username
+	userInfo.Groups = groups
+	if len(a.cfg.uidClaim) != 0 {
+		userInfo.UID, _ = rawClaims[a.cfg.uidClaim].(string)
+	}
+
+	return userInfo, nil
+}
+
+// signingKey picks the key by ID, a token without key ID is only accepted when the JWKS has a single key.
+func signingKey(keySet *jose.JSONWebKeySet, kid string) (*jose.JSONWebKey, error) {
+	var candidates []jose.JSONWebKey
+	if len(kid) != 0 {
+		candidates = keySet.Key(kid)
+	} else if len(keySet.Keys) == 1 {
+		candidates = keySet.Keys
+	}
+
+	for idx := range candidates {
+		key := &candidates[idx]
+		if key.IsPublic() && (len(key.Use) == 0 || key.Use == "sig") {
+			return key, nil
+		}
+	}
+
+	return nil, errors.Errorf("no signing key %q in JWKS", kid)
+}
+
+// claimStrings accepts either a single string or an array of strings, like the Kubernetes OIDC authenticator.
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		ret := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+
+	return nil
+}
+
+// jwksSource reloads the JWKS file when it changes on disk,
+// and refetches the JWKS URL periodically or when a token is signed by an unknown key.
+type jwksSource struct {
+	sync.RWMutex
+	file            string
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+	keys            *jose.JSONWebKeySet
+	modTime         time.Time
+	loadedAt        time.Time
+}
+
+func (s *jwksSource) get(ctx context.Context, kid string) (*jose.JSONWebKeySet, error) {
+	s.RLock()
+	keys, loadedAt, loadedModTime := s.keys, s.loadedAt, s.modTime
+	s.RUnlock()
+
+	var stale bool
+	if len(s.file) != 0 {
+		currentModTime, _ := modTime(s.file)
+		stale = keys == nil || !loadedModTime.Equal(currentModTime)
+	} else {
+		age := time.Since(loadedAt)
+		unknownKey := keys == nil || len(keys.Key(kid)) == 0
+		stale = (unknownKey && age > jwksRefetchBackoff) || (s.refreshInterval > 0 && age > s.refreshInterval)
+	}
+
+	if stale {
+		if err := s.load(ctx); err != nil {
+			if keys == nil {
+				return nil, err
+			}
+			log.WithError(err).Warn("Failed to reload JWKS, keep using the previous keys")
+		}
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	if s.keys == nil {
+		return nil, errors.New("no JWKS loaded")
+	}
+	return s.keys, nil
+}
+
+func (s *jwksSource) load(ctx context.Context) error {
+	var (
+		content []byte
+		mtime   time.Time
+		err     error
+	)
+
+	if len(s.file) != 0 {
+		mtime, _ = modTime(s.file)
+		content, err = ioutil.ReadFile(s.file)
+		if err != nil {
+			return errors.Annotatef(err, "unable to read JWKS file %s", s.file)
+		}
+	} else {
+		content, err = s.fetch(ctx)
+		if err != nil {
+			// don't hammer the issuer when it is down
+			s.Lock()
+			s.loadedAt = time.Now()
+			s.Unlock()
+			return err
+		}
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(content, keys); err != nil {
+		return errors.Annotate(err, "unable to parse JWKS")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.keys = keys
+	s.modTime = mtime
+	s.loadedAt = time.Now()
+
+	return nil
+}
+
+func (s *jwksSource) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to create request for JWKS %s", s.url)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to fetch JWKS %s", s.url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unable to fetch JWKS %s: %s", s.url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,239 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/kube"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testIssuer   = "https://keycloak.example.com/realms/rancher"
+	testClientID = "prometheus-auth"
+)
+
+type testSigner struct {
+	key    *rsa.PrivateKey
+	signer jose.Signer
+}
+
+func newTestSigner(t *testing.T, kid string) *testSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+	require.NoError(t, err)
+
+	return &testSigner{key: key, signer: signer}
+}
+
+func (s *testSigner) jwk(kid string) jose.JSONWebKey {
+	return jose.JSONWebKey{Key: &s.key.PublicKey, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+func (s *testSigner) sign(t *testing.T, claims jwt.Claims, extra map[string]interface{}) string {
+	token, err := jwt.Signed(s.signer).Claims(claims).Claims(extra).CompactSerialize()
+	require.NoError(t, err)
+
+	return token
+}
+
+func writeJWKS(t *testing.T, path string, keys ...jose.JSONWebKey) {
+	content, err := json.Marshal(&jose.JSONWebKeySet{Keys: keys})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, content, 0600))
+}
+
+func validClaims() jwt.Claims {
+	return jwt.Claims{
+		Issuer:   testIssuer,
+		Subject:  "f9a5a1a4",
+		Audience: jwt.Audience{testClientID},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+}
+
+func Test_oidcAuthenticator(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile, signer.jwk("key-1"))
+
+	authenticator, err := newOIDCAuthenticator(context.Background(), &oidcConfig{
+		issuerURL:      testIssuer,
+		clientID:       testClientID,
+		jwksFile:       jwksFile,
+		usernameClaim:  "preferred_username",
+		uidClaim:       "sub",
+		groupsClaim:    "groups",
+		usernamePrefix: "oidc:",
+		groupsPrefix:   "oidc:",
+	})
+	require.NoError(t, err)
+
+	extra := map[string]interface{}{
+		"preferred_username": "alice",
+		"groups":             []string{"devs", "ops"},
+	}
+
+	userInfo, err := authenticator.Authenticate(signer.sign(t, validClaims(), extra))
+	require.NoError(t, err)
+	require.Equal(t, "oidc:alice", userInfo.Username)
+	require.Equal(t, "f9a5a1a4", userInfo.UID)
+	require.Equal(t, []string{"oidc:devs", "oidc:ops"}, userInfo.Groups)
+
+	// a single group is accepted as string
+	userInfo, err = authenticator.Authenticate(signer.sign(t, validClaims(), map[string]interface{}{"preferred_username": "bob", "groups": "devs"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"oidc:devs"}, userInfo.Groups)
+
+	expired := validClaims()
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	_, err = authenticator.Authenticate(signer.sign(t, expired, extra))
+	require.Error(t, err)
+
+	otherAudience := validClaims()
+	otherAudience.Audience = jwt.Audience{"grafana"}
+	_, err = authenticator.Authenticate(signer.sign(t, otherAudience, extra))
+	require.Error(t, err)
+
+	otherIssuer := validClaims()
+	otherIssuer.Issuer = "kubernetes/serviceaccount"
+	_, err = authenticator.Authenticate(signer.sign(t, otherIssuer, extra))
+	require.Error(t, err)
+
+	_, err = authenticator.Authenticate(signer.sign(t, validClaims(), map[string]interface{}{"groups": "devs"}))
+	require.Error(t, err)
+
+	// signed by a key out of the JWKS
+	forger := newTestSigner(t, "key-1")
+	_, err = authenticator.Authenticate(forger.sign(t, validClaims(), extra))
+	require.Error(t, err)
+
+	_, err = authenticator.Authenticate("not-a-jwt")
+	require.Error(t, err)
+
+	// the JWKS file is reloaded after the key rotation
+	rotated := newTestSigner(t, "key-2")
+	writeJWKS(t, jwksFile, signer.jwk("key-1"), rotated.jwk("key-2"))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(jwksFile, future, future))
+
+	_, err = authenticator.Authenticate(rotated.sign(t, validClaims(), extra))
+	require.NoError(t, err)
+}
+
+func Test_oidcAuthenticator_reservedIdentities(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile, signer.jwk("key-1"))
+
+	newAuthenticator := func(usernameClaim, usernamePrefix string) *oidcAuthenticator {
+		authenticator, err := newOIDCAuthenticator(context.Background(), &oidcConfig{
+			issuerURL:      testIssuer,
+			clientID:       testClientID,
+			jwksFile:       jwksFile,
+			usernameClaim:  usernameClaim,
+			groupsClaim:    "groups",
+			usernamePrefix: usernamePrefix,
+		})
+		require.NoError(t, err)
+		return authenticator
+	}
+
+	// the username is prefixed by the issuer unless it is an email
+	userInfo, err := newAuthenticator("preferred_username", "").Authenticate(signer.sign(t, validClaims(), map[string]interface{}{"preferred_username": "system:admin"}))
+	require.NoError(t, err)
+	require.Equal(t, testIssuer+"#system:admin", userInfo.Username)
+
+	userInfo, err = newAuthenticator("email", "").Authenticate(signer.sign(t, validClaims(), map[string]interface{}{"email": "alice@example.com"}))
+	require.NoError(t, err)
+	require.Equal(t, "alice@example.com", userInfo.Username)
+
+	// the identities of the Kubernetes components can't be claimed
+	_, err = newAuthenticator("preferred_username", oidcNoUsernamePrefix).Authenticate(signer.sign(t, validClaims(), map[string]interface{}{"preferred_username": "system:admin"}))
+	require.Error(t, err)
+
+	_, err = newAuthenticator("preferred_username", "").Authenticate(signer.sign(t, validClaims(), map[string]interface{}{"preferred_username": "alice", "groups": []string{"devs", "system:masters"}}))
+	require.Error(t, err)
+}
+
+func Test_oidcAuthenticator_jwksURL(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	rotated := newTestSigner(t, "key-2")
+
+	keys := []jose.JSONWebKey{signer.jwk("key-1")}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(&jose.JSONWebKeySet{Keys: keys})
+	}))
+	defer server.Close()
+
+	authenticator, err := newOIDCAuthenticator(context.Background(), &oidcConfig{
+		issuerURL:     testIssuer,
+		clientID:      testClientID,
+		jwksURL:       server.URL,
+		usernameClaim: "sub",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, fetches)
+
+	userInfo, err := authenticator.Authenticate(signer.sign(t, validClaims(), nil))
+	require.NoError(t, err)
+	require.Equal(t, testIssuer+"#f9a5a1a4", userInfo.Username)
+	require.Equal(t, 1, fetches)
+
+	// the unknown key is refetched after the backoff
+	keys = append(keys, rotated.jwk("key-2"))
+	_, err = authenticator.Authenticate(rotated.sign(t, validClaims(), nil))
+	require.Error(t, err)
+	require.Equal(t, 1, fetches)
+
+	authenticator.keys.loadedAt = time.Now().Add(-jwksRefetchBackoff - time.Second)
+	_, err = authenticator.Authenticate(rotated.sign(t, validClaims(), nil))
+	require.NoError(t, err)
+	require.Equal(t, 2, fetches)
+}
+
+func Test_chainedTokens(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile, signer.jwk("key-1"))
+
+	authenticator, err := newOIDCAuthenticator(context.Background(), &oidcConfig{
+		issuerURL:     testIssuer,
+		clientID:      testClientID,
+		jwksFile:      jwksFile,
+		usernameClaim: "sub",
+	})
+	require.NoError(t, err)
+
+	tokens := kube.NewChainedTokens(authenticator, mockTokenAuth())
+
+	userInfo, err := tokens.Authenticate(signer.sign(t, validClaims(), nil))
+	require.NoError(t, err)
+	require.Equal(t, testIssuer+"#f9a5a1a4", userInfo.Username)
+
+	// TokenReview stays the fallback
+	userInfo, err = tokens.Authenticate("someNamespacesToken")
+	require.NoError(t, err)
+	require.Equal(t, "someNamespacesUser", userInfo.Username)
+
+	_, err = tokens.Authenticate("unknownToken")
+	require.Error(t, err)
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	authentication "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// metricPolicyRule restricts the metric names of the tenants matching any of its users, groups or projects,
+// a rule without subjects applies to every tenant.
+type metricPolicyRule struct {
+	Users    []string `json:"users,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Projects []string `json:"projects,omitempty"`
+	// the metric names matching these regular expressions are hidden
+	Deny []string `json:"deny,omitempty"`
+	// only the metric names matching these regular expressions are visible if any
+	Allow []string `json:"allow,omitempty"`
+}
+
+func (r *metricPolicyRule) appliesTo(userInfo authentication.UserInfo, projectIDs data.Set) bool {
+	if len(r.Users) == 0 && len(r.Groups) == 0 && len(r.Projects) == 0 {
+		return true
+	}
+
+	for _, user := range r.Users {
+		if user == userInfo.Username {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		for _, userGroup := range userInfo.Groups {
+			if group == userGroup {
+				return true
+			}
+		}
+	}
+	for _, projectID := range r.Projects {
+		if _, exist := projectIDs[projectID]; exist {
+			return true
+		}
+	}
+
+	return false
+}
+
+type metricPolicy struct {
+	Rules []metricPolicyRule `json:"rules"`
+}
+
+func loadMetricPolicy(file string) (*metricPolicy, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read metric policy file %s", file)
+	}
+
+	ret := &metricPolicy{}
+	if err := yaml.UnmarshalStrict(content, ret); err != nil {
+		return nil, errors.Annotatef(err, "unable to parse metric policy file %s", file)
+	}
+
+	for idx, rule := range ret.Rules {
+		for _, expr := range append(append([]string(nil), rule.Deny...), rule.Allow...) {
+			if _, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", expr)); err != nil {
+				return nil, errors.Annotatef(err, "invalid metric name expression %q of rule %d", expr, idx)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// resolve merges the applicable rules into one filter, nil if no rule applies.
+func (p *metricPolicy) resolve(userInfo authentication.UserInfo, projectIDs data.Set) *prom.MetricNameFilter {
+	if p == nil {
+		return nil
+	}
+
+	var allows, denies []string
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(userInfo, projectIDs) {
+			continue
+		}
+		for _, expr := range rule.Allow {
+			allows = append(allows, fmt.Sprintf("(?:%s)", expr))
+		}
+		for _, expr := range rule.Deny {
+			denies = append(denies, fmt.Sprintf("(?:%s)", expr))
+		}
+	}
+
+	if len(allows) == 0 && len(denies) == 0 {
+		return nil
+	}
+
+	return &prom.MetricNameFilter{
+		Allow: strings.Join(allows, "|"),
+		Deny:  strings.Join(denies, "|"),
+	}
+}
+
+// projectIDs returns the projects of the namespaces.
+func (a *agent) projectIDs(namespaceSet data.Set) data.Set {
+	ret := data.Set{}
+	for namespace := range namespaceSet {
+		if projectID, exist := a.namespaces.ProjectID(namespace); exist {
+			ret[projectID] = struct{}{}
+		}
+	}
+
+	return ret
+}
+
+// metricNameFilter resolves the metric name restriction of a tenant.
+func (a *agent) metricNameFilter(userInfo authentication.UserInfo, namespaceSet data.Set) *prom.MetricNameFilter {
+	if a.metricPolicy == nil {
+		return nil
+	}
+
+	return a.metricPolicy.resolve(userInfo, a.projectIDs(namespaceSet))
+}
@@ -0,0 +1,81 @@
+//go:build test
+
+package agent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	"github.com/stretchr/testify/require"
+	authentication "k8s.io/api/authentication/v1"
+)
+
+const testMetricPolicy = `
+rules:
+- deny: ['kube_secret_.*']
+- projects: [p-ab]
+  deny: ['cost_.*|billing_.*']
+- groups: [auditors]
+  allow: ['audit_.*', 'up']
+`
+
+func Test_metricPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(testMetricPolicy), 0600))
+
+	policy, err := loadMetricPolicy(file)
+	require.NoError(t, err)
+	require.Len(t, policy.Rules, 3)
+
+	filter := policy.resolve(authentication.UserInfo{Username: "alice"}, data.NewSet("p-c"))
+	require.Equal(t, &prom.MetricNameFilter{Deny: "(?:kube_secret_.*)"}, filter)
+
+	filter = policy.resolve(authentication.UserInfo{Username: "alice"}, data.NewSet("p-ab"))
+	require.False(t, filter.Allowed("kube_secret_info"))
+	require.False(t, filter.Allowed("billing_total"))
+	require.True(t, filter.Allowed("up"))
+
+	filter = policy.resolve(authentication.UserInfo{Username: "bob", Groups: []string{"auditors"}}, data.NewSet())
+	require.True(t, filter.Allowed("audit_events_total"))
+	require.True(t, filter.Allowed("up"))
+	require.False(t, filter.Allowed("upstream"))
+
+	// the rules are validated on load
+	require.NoError(t, ioutil.WriteFile(file, []byte("rules:\n- deny: ['(']\n"), 0600))
+	_, err = loadMetricPolicy(file)
+	require.Error(t, err)
+
+	policy, err = loadMetricPolicy("")
+	require.NoError(t, err)
+	require.Nil(t, policy.resolve(authentication.UserInfo{Username: "alice"}, data.NewSet("p-ab")))
+}
+
+func Test_apiContext_nameFilter(t *testing.T) {
+	apiCtx := &apiContext{
+		namespaceSet:    data.NewSet("ns-a"),
+		rewriteMatchers: true,
+		nameFilter:      &prom.MetricNameFilter{Deny: "kube_secret_.*"},
+	}
+
+	expr, err := parser.ParseExpr(`sum(rate(up[5m]))`)
+	require.NoError(t, err)
+	require.Equal(t, `sum(rate(up{__name__!~"kube_secret_.*",namespace="ns-a"}[5m]))`, apiCtx.modifyExpression(expr))
+
+	query := apiCtx.modifyQuery(&prompb.Query{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: ".+"}}})
+	require.Equal(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: ".+"},
+		{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "ns-a"},
+		{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: "kube_secret_.*"},
+	}, query.Matchers)
+
+	// the names are restricted even if the upstream isolates the tenants
+	apiCtx.rewriteMatchers = false
+	expr, err = parser.ParseExpr(`up`)
+	require.NoError(t, err)
+	require.Equal(t, `up{__name__!~"kube_secret_.*"}`, apiCtx.modifyExpression(expr))
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/util/httputil"
+	"github.com/gogo/protobuf/proto"
+	"github.com/juju/errors"
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	streamedReadContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// negotiateReadResponseType picks the response type of the remote read like Prometheus does,
+// the streamed chunks of the shards can't be de-duplicated, so the samples are preferred across shards.
+func (c *apiContext) negotiateReadResponseType(accepted []prompb.ReadRequest_ResponseType) (prompb.ReadRequest_ResponseType, error) {
+	responseType, err := remote.NegotiateResponseType(accepted)
+	if err != nil {
+		return 0, err
+	}
+
+	if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS && c.shards != nil {
+		for _, accept := range accepted {
+			if accept == prompb.ReadRequest_SAMPLES {
+				return prompb.ReadRequest_SAMPLES, nil
+			}
+		}
+		return 0, errors.New("streamed remote read is not supported across shards, accept the samples instead")
+	}
+
+	return responseType, nil
+}
+
+// responseEmptyStream answers a streamed remote read without any frame.
+func (c *apiContext) responseEmptyStream() error {
+	c.Do(func() {
+		c.response.Header().Set(httputil.ContentTypeHeader, streamedReadContentType)
+		c.response.WriteHeader(http.StatusOK)
+	})
+
+	return nil
+}
+
+// rewritesFrames returns true if the streamed frames are decoded instead of copied.
+func (c *apiContext) rewritesFrames() bool {
+	return c.verifyReadNamespaces || c.redactor != nil || len(c.filterReaderLabelSet) != 0
+}
+
+// proxyStreamed passes the streamed remote read through frame by frame.
+func (c *apiContext) proxyStreamed(request *http.Request) error {
+	if !c.rewritesFrames() {
+		return c.proxyWith(request)
+	}
+
+	c.Do(func() {
+		w := &streamedReadWriter{
+			ResponseWriter: c.response,
+			rewrite:        c.rewriteFrame,
+		}
+		c.proxyHandler.ServeHTTP(w, request.WithContext(c.request.Context()))
+		if len(w.pending) != 0 {
+			log.Warnf("streamed read[%s] ended with a truncated frame of %d bytes", c.tag, len(w.pending))
+		}
+	})
+
+	return nil
+}
+
+// rewriteFrame rewrites the series of a ChunkedReadResponse, nil is returned if no series is left.
+func (c *apiContext) rewriteFrame(frame []byte) ([]byte, error) {
+	resp := &prompb.ChunkedReadResponse{}
+	if err := proto.Unmarshal(frame, resp); err != nil {
+		return nil, errors.Annotate(err, "unable to decode frame")
+	}
+
+	series := resp.ChunkedSeries[:0]
+	for _, s := range resp.ChunkedSeries {
+		if c.verifyReadNamespaces && !c.authorizedSeries(s.Labels) {
+			log.Warnf("streamed read[%s] dropped series of unauthorized namespace %q", c.tag, prompbLabelValue(s.Labels, namespaceLabelName))
+			continue
+		}
+		s.Labels = stripPBLabels(c.redactor.redactPBLabels(s.Labels), c.filterReaderLabelSet)
+		series = append(series, s)
+	}
+	if len(series) == 0 {
+		return nil, nil
+	}
+	resp.ChunkedSeries = series
+
+	return proto.Marshal(resp)
+}
+
+// authorizedSeries returns true if the series belongs to the namespaces, or is selected by the cluster selectors.
+func (c *apiContext) authorizedSeries(pbLabels []prompb.Label) bool {
+	namespace := prompbLabelValue(pbLabels, namespaceLabelName)
+	if len(namespace) == 0 {
+		lbs := make(promlb.Labels, 0, len(pbLabels))
+		for _, l := range pbLabels {
+			lbs = append(lbs, promlb.Label{Name: l.Name, Value: l.Value})
+		}
+		return c.clusterSelectors.Selects(lbs)
+	}
+
+	_, exist := c.namespaceSet[namespace]
+	return exist
+}
+
+func prompbLabelValue(pbLabels []prompb.Label, name string) string {
+	for _, l := range pbLabels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+
+	return ""
+}
+
+// streamedReadWriter rewrites the frames of the streamed remote read response, each frame has
+// the uvarint size, the big-endian Castagnoli CRC-32 checksum and the ChunkedReadResponse.
+type streamedReadWriter struct {
+	http.ResponseWriter
+	rewrite     func(frame []byte) ([]byte, error)
+	wroteHeader bool
+	streamed    bool
+	discarded   bool
+	pending     []byte
+}
+
+func (w *streamedReadWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if code/100 == 2 {
+		if !strings.HasPrefix(w.Header().Get(httputil.ContentTypeHeader), "application/x-streamed-protobuf") {
+			// the sampled response of an upstream ignoring the accepted response types can't be rewritten
+			w.discarded = true
+			for key := range w.Header() {
+				w.Header().Del(key)
+			}
+			http.Error(w.ResponseWriter, "upstream doesn't support streamed remote read", http.StatusBadGateway)
+			return
+		}
+		w.streamed = true
+		// the rewritten frames differ in size
+		w.Header().Del("Content-Length")
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamedReadWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discarded {
+		return len(p), nil
+	}
+	if !w.streamed {
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.pending = append(w.pending, p...)
+	for {
+		size, n := binary.Uvarint(w.pending)
+		if n < 0 || size > remote.DefaultChunkedReadLimit {
+			return 0, errors.New("malformed frame size of streamed read")
+		}
+		if n == 0 || uint64(len(w.pending)-n) < 4+size {
+			// wait for the rest of the frame
+			return len(p), nil
+		}
+
+		checksum := binary.BigEndian.Uint32(w.pending[n : n+4])
+		frame := w.pending[n+4 : n+4+int(size)]
+		if crc32.Checksum(frame, castagnoliTable) != checksum {
+			return 0, errors.New("corrupted frame of streamed read, checksum mismatch")
+		}
+
+		rewritten, err := w.rewrite(frame)
+		if err != nil {
+			return 0, err
+		}
+		if len(rewritten) != 0 {
+			if _, err := remote.NewChunkedWriter(w.ResponseWriter, w).Write(rewritten); err != nil {
+				return 0, err
+			}
+		}
+
+		w.pending = w.pending[n+4+int(size):]
+	}
+}
+
+func (w *streamedReadWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
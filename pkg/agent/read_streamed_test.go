@@ -0,0 +1,145 @@
+//go:build test
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	"github.com/stretchr/testify/require"
+)
+
+func newStreamedReadRequest(t *testing.T, accepted ...prompb.ReadRequest_ResponseType) *http.Request {
+	reqBuf, err := proto.Marshal(&prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: ".+"}},
+		}},
+		AcceptedResponseTypes: accepted,
+	})
+	require.NoError(t, err)
+
+	return httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, reqBuf)))
+}
+
+func serveRead(apiCtx *apiContext) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	apiCtx.response = res
+	req := apiCtx.request
+	apiContextHandler(hijackRead).ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+	return res
+}
+
+func readFrames(t *testing.T, body io.Reader) []*prompb.ChunkedReadResponse {
+	var ret []*prompb.ChunkedReadResponse
+	reader := remote.NewChunkedReader(body, remote.DefaultChunkedReadLimit, nil)
+	for {
+		resp := &prompb.ChunkedReadResponse{}
+		err := reader.NextProto(resp)
+		if err == io.EOF {
+			return ret
+		}
+		require.NoError(t, err)
+		ret = append(ret, resp)
+	}
+}
+
+func Test_streamedRead(t *testing.T) {
+	// the tenants without namespaces get an empty stream
+	res := serveRead(&apiContext{
+		request: newStreamedReadRequest(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS),
+	})
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, streamedReadContentType, res.Header().Get("Content-Type"))
+	require.Empty(t, res.Body.Bytes())
+
+	// the chunks can't be merged across shards
+	res = serveRead(&apiContext{
+		request:      newStreamedReadRequest(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS),
+		namespaceSet: data.NewSet("ns-a"),
+		shards:       newShardSet([]*url.URL{{Scheme: "http", Host: "localhost:9090"}}, http.DefaultTransport),
+	})
+	require.Equal(t, http.StatusBadRequest, res.Code)
+
+	selectors, err := prom.ParseClusterSelectors([]string{`{__name__=~"node_.*"}`})
+	require.NoError(t, err)
+
+	var gotReq prompb.ReadRequest
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		reqBuf, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		require.NoError(t, proto.Unmarshal(reqBuf, &gotReq))
+
+		w.Header().Set("Content-Type", streamedReadContentType)
+		w.WriteHeader(http.StatusOK)
+		writer := remote.NewChunkedWriter(w, w.(http.Flusher))
+		for _, series := range [][]prompb.Label{
+			{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "ns-a"}, {Name: "prometheus", Value: "cluster-level/test"}},
+			{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "ns-c"}},
+			{{Name: "__name__", Value: "node_load1"}, {Name: "instance", Value: "n1"}},
+			{{Name: "__name__", Value: "kube_node_info"}, {Name: "node", Value: "n1"}},
+		} {
+			frame, err := proto.Marshal(&prompb.ChunkedReadResponse{
+				ChunkedSeries: []*prompb.ChunkedSeries{{Labels: series, Chunks: []prompb.Chunk{{MinTimeMs: 1, MaxTimeMs: 2, Type: prompb.Chunk_XOR, Data: []byte{0x00, 0x01}}}}},
+			})
+			require.NoError(t, err)
+			_, err = writer.Write(frame)
+			require.NoError(t, err)
+		}
+	})
+
+	// the frames are passed through with the unauthorized series dropped
+	res = serveRead(&apiContext{
+		request:              newStreamedReadRequest(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS, prompb.ReadRequest_SAMPLES),
+		proxyHandler:         upstream,
+		filterReaderLabelSet: data.NewSet("prometheus"),
+		verifyReadNamespaces: true,
+		namespaceSet:         data.NewSet("ns-a"),
+		clusterSelectors:     selectors,
+		rewriteMatchers:      true,
+	})
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS}, gotReq.AcceptedResponseTypes)
+
+	frames := readFrames(t, res.Body)
+	require.Len(t, frames, 2)
+	require.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "ns-a"}}, frames[0].ChunkedSeries[0].Labels)
+	require.Equal(t, []byte{0x00, 0x01}, frames[0].ChunkedSeries[0].Chunks[0].Data)
+	require.Equal(t, []prompb.Label{{Name: "__name__", Value: "node_load1"}, {Name: "instance", Value: "n1"}}, frames[1].ChunkedSeries[0].Labels)
+
+	// the frames are copied if nothing is rewritten
+	res = serveRead(&apiContext{
+		request:      newStreamedReadRequest(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS),
+		proxyHandler: upstream,
+		namespaceSet: data.NewSet("ns-a"),
+	})
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Len(t, readFrames(t, res.Body), 4)
+
+	// the samples of an upstream ignoring the accepted response types can't be rewritten
+	sampled := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		_, _ = w.Write(snappy.Encode(nil, nil))
+	})
+	res = serveRead(&apiContext{
+		request:              newStreamedReadRequest(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS),
+		proxyHandler:         sampled,
+		verifyReadNamespaces: true,
+		namespaceSet:         data.NewSet("ns-a"),
+	})
+	require.Equal(t, http.StatusBadGateway, res.Code)
+}
@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+	promgo "github.com/prometheus/client_model/go"
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	redactedHashLength = 16
+)
+
+type redactConfig struct {
+	keyFile    string
+	hashLabels []string
+	dropLabels []string
+}
+
+func (c *redactConfig) String() string {
+	if c == nil {
+		return ""
+	}
+
+	sb := &strings.Builder{}
+	if len(c.hashLabels) != 0 {
+		sb.WriteString(fmt.Sprintf(", hashing labels [%s]", strings.Join(c.hashLabels, ",")))
+	}
+	if len(c.dropLabels) != 0 {
+		sb.WriteString(fmt.Sprintf(", dropping labels [%s]", strings.Join(c.dropLabels, ",")))
+	}
+
+	return sb.String()
+}
+
+// labelRedactor hashes or drops the sensitive labels in the responses to the tenants,
+// the hashed values stay distinct and stable but can't be read.
+type labelRedactor struct {
+	key        []byte
+	hashLabels data.Set
+	dropLabels data.Set
+	// hashed on the series without namespace only
+	clusterLabels data.Set
+}
+
+func newLabelRedactor(cfg *redactConfig, clusterLabels []string) (*labelRedactor, error) {
+	if cfg == nil {
+		cfg = &redactConfig{}
+	}
+	if len(cfg.hashLabels) == 0 && len(cfg.dropLabels) == 0 && len(clusterLabels) == 0 {
+		return nil, nil
+	}
+
+	var key []byte
+	if len(cfg.keyFile) != 0 {
+		content, err := ioutil.ReadFile(cfg.keyFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to read redact key file %s", cfg.keyFile)
+		}
+		key = []byte(strings.TrimSpace(string(content)))
+		if len(key) < 32 {
+			return nil, errors.Errorf("redact key in %s must have at least 32 bytes", cfg.keyFile)
+		}
+	} else {
+		// the hashes change on restart and differ among the instances
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Annotate(err, "unable to generate redact key")
+		}
+		if len(cfg.hashLabels) != 0 || len(clusterLabels) != 0 {
+			log.Warn("No redact key file provided, the redacted label values change on restart")
+		}
+	}
+
+	return &labelRedactor{
+		key:           key,
+		hashLabels:    data.NewSet(cfg.hashLabels...),
+		dropLabels:    data.NewSet(cfg.dropLabels...),
+		clusterLabels: data.NewSet(clusterLabels...),
+	}, nil
+}
+
+func (r *labelRedactor) hash(value string) string {
+	h := hmac.New(sha256.New, r.key)
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil))[:redactedHashLength]
+}
+
+// redacted returns true if the label is hashed or dropped on every series.
+func (r *labelRedactor) redacted(name string) bool {
+	if r == nil {
+		return false
+	}
+
+	_, hashed := r.hashLabels[name]
+	_, dropped := r.dropLabels[name]
+	return hashed || dropped
+}
+
+// redactLabels returns the labels without the dropped ones and with the hashed values,
+// the cluster labels are only hashed on the series without namespace.
+func (r *labelRedactor) redactLabels(lbs promlb.Labels) promlb.Labels {
+	if r == nil {
+		return lbs
+	}
+
+	cluster := len(lbs.Get(namespaceLabelName)) == 0
+
+	var ret promlb.Labels
+	for idx, l := range lbs {
+		_, dropped := r.dropLabels[l.Name]
+		_, hashed := r.hashLabels[l.Name]
+		if !hashed && cluster {
+			_, hashed = r.clusterLabels[l.Name]
+		}
+		if !dropped && (!hashed || len(l.Value) == 0) {
+			if ret != nil {
+				ret = append(ret, l)
+			}
+			continue
+		}
+
+		if ret == nil {
+			ret = make(promlb.Labels, 0, len(lbs))
+			ret = append(ret, lbs[:idx]...)
+		}
+		if !dropped {
+			ret = append(ret, promlb.Label{Name: l.Name, Value: r.hash(l.Value)})
+		}
+	}
+
+	if ret == nil {
+		return lbs
+	}
+	return ret
+}
+
+// redactLabelValues redacts the values of the label values API.
+func (r *labelRedactor) redactLabelValues(name string, values []string) []string {
+	if r == nil {
+		return values
+	}
+	if _, dropped := r.dropLabels[name]; dropped {
+		return []string{}
+	}
+	if _, hashed := r.hashLabels[name]; !hashed {
+		return values
+	}
+
+	ret := make([]string, 0, len(values))
+	for _, value := range values {
+		ret = append(ret, r.hash(value))
+	}
+
+	return ret
+}
+
+func (r *labelRedactor) redactLabelPairs(pairs []*promgo.LabelPair) []*promgo.LabelPair {
+	if r == nil {
+		return pairs
+	}
+
+	lbs := make(promlb.Labels, 0, len(pairs))
+	for _, lp := range pairs {
+		lbs = append(lbs, promlb.Label{Name: lp.GetName(), Value: lp.GetValue()})
+	}
+
+	redacted := r.redactLabels(lbs)
+	ret := make([]*promgo.LabelPair, 0, len(redacted))
+	for _, l := range redacted {
+		name, value := l.Name, l.Value
+		ret = append(ret, &promgo.LabelPair{Name: &name, Value: &value})
+	}
+
+	return ret
+}
+
+func (r *labelRedactor) redactPBLabels(pbLabels []prompb.Label) []prompb.Label {
+	if r == nil {
+		return pbLabels
+	}
+
+	lbs := make(promlb.Labels, 0, len(pbLabels))
+	for _, l := range pbLabels {
+		lbs = append(lbs, promlb.Label{Name: l.Name, Value: l.Value})
+	}
+
+	redacted := r.redactLabels(lbs)
+	ret := make([]prompb.Label, 0, len(redacted))
+	for _, l := range redacted {
+		ret = append(ret, prompb.Label{Name: l.Name, Value: l.Value})
+	}
+
+	return ret
+}
+
+// checkMatchers refuses the matchers on the redacted labels, which would reveal the values by probing,
+// the cluster labels are refused on the selectors of the cluster metrics.
+func (r *labelRedactor) checkMatchers(matchers []*promlb.Matcher, clusterSelectors prom.ClusterSelectors) error {
+	if r == nil {
+		return nil
+	}
+
+	cluster := len(r.clusterLabels) != 0 && clusterSelectors.Covers(matchers)
+	for _, m := range matchers {
+		_, clusterLabel := r.clusterLabels[m.Name]
+		if r.redacted(m.Name) || (cluster && clusterLabel) {
+			return errors.Errorf("matching the redacted label %q is not allowed", m.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkExpression refuses the expressions matching the redacted labels or copying them into other labels.
+func (r *labelRedactor) checkExpression(expr parser.Expr, clusterSelectors prom.ClusterSelectors) error {
+	if r == nil {
+		return nil
+	}
+
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			err = r.checkMatchers(n.LabelMatchers, clusterSelectors)
+		case *parser.Call:
+			var srcLabels parser.Expressions
+			switch n.Func.Name {
+			case "label_replace":
+				srcLabels = n.Args[3:4]
+			case "label_join":
+				srcLabels = n.Args[3:]
+			}
+			for _, arg := range srcLabels {
+				srcLabel, ok := arg.(*parser.StringLiteral)
+				if !ok {
+					continue
+				}
+				_, clusterLabel := r.clusterLabels[srcLabel.Val]
+				if r.redacted(srcLabel.Val) || clusterLabel {
+					err = errors.Errorf("reading the redacted label %q is not allowed", srcLabel.Val)
+				}
+			}
+		}
+		return err
+	})
+
+	return err
+}
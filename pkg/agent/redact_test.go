@@ -0,0 +1,197 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_clusterMetrics(t *testing.T) {
+	selectors, err := prom.ParseClusterSelectors([]string{`{__name__=~"node_.*"}`})
+	require.NoError(t, err)
+
+	redactor, err := newLabelRedactor(nil, []string{"instance"})
+	require.NoError(t, err)
+
+	var gotQuery string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("query")
+		if strings.Contains(gotQuery, "broken") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"broken"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[` +
+			`{"metric":{"__name__":"node_load1","instance":"10.0.0.1:9100"},"value":[1,"1"]},` +
+			`{"metric":{"__name__":"node_load1","instance":"10.0.0.2:9100"},"value":[1,"2"]},` +
+			`{"metric":{"__name__":"kube_pod_info","instance":"10.0.0.3:8080","namespace":"ns-a"},"value":[1,"1"]}]}}`))
+	})
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		res := httptest.NewRecorder()
+		apiCtx := &apiContext{
+			response:         res,
+			request:          req,
+			proxyHandler:     upstream,
+			namespaceSet:     data.NewSet("ns-a"),
+			clusterSelectors: selectors,
+			redactor:         redactor,
+			rewriteMatchers:  true,
+		}
+		apiContextHandler(hijackQuery).ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+		return res
+	}
+
+	res := serve("/api/v1/query?query=node_load1+or+kube_pod_info")
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, `node_load1{namespace=""} or kube_pod_info{namespace="ns-a"}`, gotQuery)
+
+	body := res.Body.String()
+	require.NotContains(t, body, "10.0.0.1")
+	require.NotContains(t, body, "10.0.0.2")
+	require.Contains(t, body, redactor.hash("10.0.0.1:9100"))
+	require.Contains(t, body, redactor.hash("10.0.0.2:9100"))
+	// the series of the namespaces are not redacted
+	require.Contains(t, body, `"instance":"10.0.0.3:8080"`)
+
+	// the failures are passed through
+	res = serve("/api/v1/query?query=broken")
+	require.Equal(t, http.StatusBadRequest, res.Code)
+	require.Equal(t, `{"status":"error","errorType":"bad_data","error":"broken"}`, res.Body.String())
+}
+
+func Test_labelRedactor(t *testing.T) {
+	redactor, err := newLabelRedactor(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, redactor)
+
+	redactor, err = newLabelRedactor(nil, []string{"node"})
+	require.NoError(t, err)
+
+	hashed := redactor.hash("worker-1")
+	require.Len(t, hashed, redactedHashLength)
+	require.Equal(t, hashed, redactor.hash("worker-1"))
+	require.NotEqual(t, hashed, redactor.hash("worker-2"))
+}
+
+func Test_redactLabels(t *testing.T) {
+	redactor, err := newLabelRedactor(&redactConfig{hashLabels: []string{"pod_ip"}, dropLabels: []string{"node"}}, nil)
+	require.NoError(t, err)
+
+	var gotQuery string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("query")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[` +
+			`{"metric":{"__name__":"kube_pod_info","namespace":"ns-a","node":"worker-1","pod_ip":"10.42.0.1"},"value":[1,"1"]}]}}`))
+	})
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		res := httptest.NewRecorder()
+		apiCtx := &apiContext{
+			response:        res,
+			request:         req,
+			proxyHandler:    upstream,
+			namespaceSet:    data.NewSet("ns-a"),
+			redactor:        redactor,
+			rewriteMatchers: true,
+		}
+		apiContextHandler(hijackQuery).ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+		return res
+	}
+
+	res := serve("/api/v1/query?query=kube_pod_info")
+	require.Equal(t, http.StatusOK, res.Code)
+	body := res.Body.String()
+	require.NotContains(t, body, "worker-1")
+	require.NotContains(t, body, `"node"`)
+	require.NotContains(t, body, "10.42.0.1")
+	require.Contains(t, body, `"pod_ip":"`+redactor.hash("10.42.0.1")+`"`)
+
+	// probing the redacted values is refused before reaching the upstream
+	gotQuery = ""
+	for _, query := range []string{
+		`kube_pod_info{node="worker-1"}`,
+		`kube_pod_info{pod_ip=~"10\\.42.*"}`,
+		`label_replace(kube_pod_info, "ip", "$1", "pod_ip", "(.*)")`,
+		`label_join(kube_pod_info, "where", ",", "pod", "node")`,
+	} {
+		res = serve("/api/v1/query?query=" + url.QueryEscape(query))
+		require.Equal(t, http.StatusBadRequest, res.Code, query)
+		require.Contains(t, res.Body.String(), "redacted label", query)
+	}
+	require.Empty(t, gotQuery)
+
+	require.Equal(t, []string{}, redactor.redactLabelValues("node", []string{"worker-1"}))
+	require.Equal(t, []string{redactor.hash("10.42.0.1")}, redactor.redactLabelValues("pod_ip", []string{"10.42.0.1"}))
+	require.Equal(t, []string{"ns-a"}, redactor.redactLabelValues("namespace", []string{"ns-a"}))
+}
+
+func Test_rewriteSeriesResponse(t *testing.T) {
+	redactor, err := newLabelRedactor(&redactConfig{hashLabels: []string{"pod_ip"}, dropLabels: []string{"node"}}, nil)
+	require.NoError(t, err)
+
+	var series []byte
+	for _, l := range []prompb.Label{
+		{Name: "__name__", Value: "kube_pod_info"},
+		{Name: "namespace", Value: "ns-a"},
+		{Name: "node", Value: "worker-1"},
+		{Name: "pod_ip", Value: "10.42.0.1"},
+	} {
+		labelBytes, err := l.Marshal()
+		require.NoError(t, err)
+		series = appendBytesField(series, 1, labelBytes)
+	}
+	series = appendBytesField(series, 2, []byte("chunk"))
+	response := appendBytesField(nil, 1, series)
+
+	unchanged, err := rewriteSeriesResponse(response, "", &storeAPIScope{})
+	require.NoError(t, err)
+	require.Equal(t, response, unchanged)
+
+	redacted, err := rewriteSeriesResponse(response, "", &storeAPIScope{redactor: redactor})
+	require.NoError(t, err)
+
+	fields, err := scanWireFields(redacted)
+	require.NoError(t, err)
+	require.Len(t, fields, 1)
+	seriesFields, err := scanWireFields(fields[0].value)
+	require.NoError(t, err)
+
+	var labels []prompb.Label
+	for _, field := range seriesFields {
+		if field.number != 1 {
+			require.Equal(t, "chunk", string(field.value))
+			continue
+		}
+		l := prompb.Label{}
+		require.NoError(t, l.Unmarshal(field.value))
+		labels = append(labels, l)
+	}
+	require.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "kube_pod_info"},
+		{Name: "namespace", Value: "ns-a"},
+		{Name: "pod_ip", Value: redactor.hash("10.42.0.1")},
+	}, labels)
+
+	// the matchers on the redacted labels are refused
+	rewriter := storeAPIRewriters["/thanos.Store/Series"]
+	nodeMatcher, err := (&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "node", Value: "worker-1"}).Marshal()
+	require.NoError(t, err)
+	payload := appendBytesField(nil, 3, nodeMatcher)
+	_, _, err = rewriter.rewriteRequest(payload, &storeAPIScope{namespaceSet: data.NewSet("ns-a"), redactor: redactor})
+	require.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	roundRobinRouting = "round-robin"
+	stickyRouting     = "sticky"
+
+	upstreamAffinityKey = "_upstreamAffinity_"
+)
+
+type replica struct {
+	url     *url.URL
+	healthy int32
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *replica) setHealthy(healthy bool) {
+	val := int32(0)
+	if healthy {
+		val = 1
+	}
+
+	if atomic.SwapInt32(&r.healthy, val) != val {
+		if healthy {
+			log.Infof("Upstream %s is ready", r.url)
+		} else {
+			log.Warnf("Upstream %s is not ready", r.url)
+		}
+	}
+	upstreamUpGauge.WithLabelValues(r.url.String()).Set(float64(val))
+}
+
+// replicaPool routes the upstream requests to the healthy Prometheus replicas,
+// the idempotent requests are retried against another replica on connection errors.
+type replicaPool struct {
+	primary   *url.URL
+	replicas  []*replica
+	routing   string
+	counter   uint32
+	transport http.RoundTripper
+}
+
+func newReplicaPool(urls []*url.URL, routing string, transport http.RoundTripper) (*replicaPool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no upstream URL")
+	}
+
+	switch routing {
+	case "", roundRobinRouting:
+		routing = roundRobinRouting
+	case stickyRouting:
+	default:
+		return nil, errors.Errorf("unknown upstream routing %q", routing)
+	}
+
+	replicas := make([]*replica, 0, len(urls))
+	for _, u := range urls {
+		upstreamUpGauge.WithLabelValues(u.String()).Set(1)
+		replicas = append(replicas, &replica{url: u, healthy: 1})
+	}
+
+	return &replicaPool{
+		primary:   urls[0],
+		replicas:  replicas,
+		routing:   routing,
+		transport: transport,
+	}, nil
+}
+
+func (p *replicaPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+
+	tried := make(map[*replica]struct{}, len(p.replicas))
+	for {
+		r := p.pick(req, tried)
+		tried[r] = struct{}{}
+
+		resp, err := p.transport.RoundTrip(p.rewrite(req, r))
+		if err == nil {
+			return resp, nil
+		}
+
+		if req.Context().Err() != nil || !idempotent || len(tried) == len(p.replicas) {
+			return nil, err
+		}
+
+		r.setHealthy(false)
+		upstreamRetriesCounter.WithLabelValues(r.url.String()).Inc()
+		log.WithError(err).Debugf("Retrying %s %s against another upstream", req.Method, req.URL.Path)
+	}
+}
+
+// pick chooses a healthy replica which has not been tried yet,
+// falls back to the unhealthy ones when none of the replicas is ready.
+func (p *replicaPool) pick(req *http.Request, tried map[*replica]struct{}) *replica {
+	candidates := make([]*replica, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		if _, exist := tried[r]; !exist && r.isHealthy() {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, r := range p.replicas {
+			if _, exist := tried[r]; !exist {
+				candidates = append(candidates, r)
+			}
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	if p.routing == stickyRouting {
+		if affinity, _ := req.Context().Value(upstreamAffinityKey).(string); len(affinity) != 0 {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(affinity))
+			return candidates[h.Sum32()%uint32(len(candidates))]
+		}
+	}
+
+	return candidates[atomic.AddUint32(&p.counter, 1)%uint32(len(candidates))]
+}
+
+func (p *replicaPool) rewrite(req *http.Request, r *replica) *http.Request {
+	if r.url == p.primary {
+		return req
+	}
+
+	ret := req.Clone(req.Context())
+	ret.URL.Scheme = r.url.Scheme
+	ret.URL.Host = r.url.Host
+	ret.URL.Path = singleJoiningSlash(r.url.Path, strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(p.primary.Path, "/")))
+	ret.URL.RawPath = ""
+	ret.Host = ""
+
+	return ret
+}
+
+func (p *replicaPool) run(ctx context.Context, interval time.Duration) {
+	if len(p.replicas) < 2 || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, r := range p.replicas {
+			r.setHealthy(p.probe(ctx, r, interval))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *replicaPool) probe(ctx context.Context, r *replica, timeout time.Duration) bool {
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	probeURL := *r.url
+	probeURL.Path = singleJoiningSlash(r.url.Path, "/-/ready")
+	req, err := http.NewRequestWithContext(probeCtx, http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		log.WithError(err).Debugf("Failed to probe upstream %s", r.url)
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+func parseProxyURLs(value string) ([]*url.URL, error) {
+	ret := make([]*url.URL, 0)
+	for _, rawURL := range strings.Split(value, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if len(rawURL) == 0 {
+			continue
+		}
+
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to parse %q", rawURL)
+		}
+		ret = append(ret, u)
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.New("no URL")
+	}
+
+	return ret, nil
+}
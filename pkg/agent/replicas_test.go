@@ -0,0 +1,113 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newReplicaServer(t *testing.T, name string, ready bool) (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/-/ready" && !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(name))
+	}))
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	return server, serverURL
+}
+
+func doReplicaRequest(t *testing.T, pool *replicaPool, method, user string) (string, error) {
+	ctx := context.WithValue(context.Background(), upstreamAffinityKey, user)
+	req, err := http.NewRequestWithContext(ctx, method, pool.primary.String()+"/api/v1/query", nil)
+	require.NoError(t, err)
+
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return string(body), nil
+}
+
+func Test_replicaPool(t *testing.T) {
+	serverA, urlA := newReplicaServer(t, "a", true)
+	defer serverA.Close()
+	serverB, urlB := newReplicaServer(t, "b", false)
+	defer serverB.Close()
+	serverC, urlC := newReplicaServer(t, "c", true)
+	serverC.Close()
+
+	pool, err := newReplicaPool([]*url.URL{urlA, urlB, urlC}, roundRobinRouting, http.DefaultTransport)
+	require.NoError(t, err)
+
+	// health checking
+	require.True(t, pool.probe(context.Background(), pool.replicas[0], time.Second))
+	require.False(t, pool.probe(context.Background(), pool.replicas[1], time.Second))
+	require.False(t, pool.probe(context.Background(), pool.replicas[2], time.Second))
+
+	// failover, the broken replica is marked as unhealthy
+	pool.replicas[1].setHealthy(false)
+	for i := 0; i < 4; i++ {
+		got, err := doReplicaRequest(t, pool, http.MethodGet, "")
+		require.NoError(t, err)
+		require.Equal(t, "a", got)
+	}
+	require.False(t, pool.replicas[2].isHealthy())
+
+	// non-idempotent requests are not retried
+	pool.replicas[2].setHealthy(true)
+	pool.replicas[0].setHealthy(false)
+	_, err = doReplicaRequest(t, pool, http.MethodPost, "")
+	require.Error(t, err)
+
+	// fall back to the unhealthy replicas
+	for _, r := range pool.replicas {
+		r.setHealthy(false)
+	}
+	got, err := doReplicaRequest(t, pool, http.MethodGet, "")
+	require.NoError(t, err)
+	require.Contains(t, []string{"a", "b"}, got)
+
+	_, err = newReplicaPool([]*url.URL{urlA}, "random", http.DefaultTransport)
+	require.Error(t, err)
+}
+
+func Test_replicaPool_sticky(t *testing.T) {
+	serverA, urlA := newReplicaServer(t, "a", true)
+	defer serverA.Close()
+	serverB, urlB := newReplicaServer(t, "b", true)
+	defer serverB.Close()
+
+	pool, err := newReplicaPool([]*url.URL{urlA, urlB}, stickyRouting, http.DefaultTransport)
+	require.NoError(t, err)
+
+	seen := map[string]struct{}{}
+	for _, user := range []string{"alice", "bob", "carol", "dave", "eve", "frank"} {
+		first, err := doReplicaRequest(t, pool, http.MethodGet, user)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			got, err := doReplicaRequest(t, pool, http.MethodGet, user)
+			require.NoError(t, err)
+			require.Equal(t, first, got, user)
+		}
+		seen[first] = struct{}{}
+	}
+	require.Len(t, seen, 2)
+}
@@ -23,4 +23,5 @@ type jsonResponseData struct {
 	Data      interface{} `json:"data,omitempty"`
 	ErrorType string      `json:"errorType,omitempty"`
 	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
 }
@@ -24,8 +24,9 @@ var NoneNamespacesTokenLabelScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []string{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []string{},
 		},
 	},
 	"namespace": {
@@ -34,8 +35,9 @@ var NoneNamespacesTokenLabelScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []string{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []string{},
 		},
 	},
 	"foo": {
@@ -44,11 +46,9 @@ var NoneNamespacesTokenLabelScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data: []string{
-				"bar",
-				"boo",
-			},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []string{},
 		},
 	},
 	"does_not_match_anything": {
@@ -57,8 +57,9 @@ var NoneNamespacesTokenLabelScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []string{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []string{},
 		},
 	},
 	"test_metric_without_labels": {
@@ -67,8 +68,9 @@ var NoneNamespacesTokenLabelScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []string{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []string{},
 		},
 	},
 }
@@ -119,7 +121,6 @@ var SomeNamespacesTokenLabelScenarios = map[string]Scenario{
 			Status: "success",
 			Data: []string{
 				"bar",
-				"boo",
 			},
 		},
 	},
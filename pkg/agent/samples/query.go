@@ -77,7 +77,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeVector,
 				Result:     promql.Vector{},
@@ -91,7 +92,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"namespaces [ns-c] are outside of the scope and select nothing", "no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeVector,
 				Result:     promql.Vector{},
@@ -105,7 +107,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeVector,
 				Result:     promql.Vector{},
@@ -119,7 +122,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeVector,
 				Result:     promql.Vector{},
@@ -133,7 +137,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeVector,
 				Result:     promql.Vector{},
@@ -250,7 +255,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeMatrix,
 				Result:     promql.Matrix{},
@@ -267,7 +273,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"namespaces [ns-c] are outside of the scope and select nothing", "no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeMatrix,
 				Result:     promql.Matrix{},
@@ -284,7 +291,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeMatrix,
 				Result:     promql.Matrix{},
@@ -301,7 +309,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeMatrix,
 				Result:     promql.Matrix{},
@@ -318,7 +327,8 @@ var NoneNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeVector,
 				Result:     promql.Vector{},
@@ -418,7 +428,8 @@ var SomeNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"namespaces [ns-c] are outside of the scope and select nothing"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeVector,
 				Result:     promql.Vector{},
@@ -650,7 +661,8 @@ var SomeNamespacesTokenQueryScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
+			Status:   "success",
+			Warnings: []string{"namespaces [ns-c] are outside of the scope and select nothing"},
 			Data: &queryData{
 				ResultType: parser.ValueTypeMatrix,
 				Result:     promql.Matrix{},
@@ -139,7 +139,6 @@ func SomeNamespacesTokenReadScenarios(t *testing.T) map[string]Scenario {
 								{Name: "__name__", Value: "test_metric1"},
 								{Name: "foo", Value: "bar"},
 								{Name: "namespace", Value: "ns-a"},
-								{Name: "prometheus", Value: "cluster-level/test"},
 							},
 							Samples: []prompb.Sample{
 								{Value: 0, Timestamp: 0},
@@ -174,7 +173,6 @@ func SomeNamespacesTokenReadScenarios(t *testing.T) map[string]Scenario {
 								{Name: "__name__", Value: "test_metric1"},
 								{Name: "foo", Value: "bar"},
 								{Name: "namespace", Value: "ns-a"},
-								{Name: "prometheus", Value: "cluster-level/test"},
 							},
 							Samples: []prompb.Sample{
 								{Value: 0, Timestamp: 0},
@@ -36,8 +36,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"test_metric1{namespace='ns-c'}": {
@@ -46,8 +47,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"namespaces [ns-c] are outside of the scope and select nothing", "no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"test_metric2{foo='boo'}": {
@@ -56,8 +58,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"{foo='boo'}": {
@@ -66,8 +69,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"two matches": {
@@ -76,8 +80,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"two matches, but one is `none`": {
@@ -86,8 +91,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"test_metric_without_labels": {
@@ -96,8 +102,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"does_not_match_anything": {
@@ -106,8 +113,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"start and end before series starts": {
@@ -118,8 +126,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"start and end after series ends": {
@@ -130,8 +139,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"start and end within series": {
@@ -142,8 +152,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"start within series, end after": {
@@ -154,8 +165,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"start before series, end within series": {
@@ -166,8 +178,9 @@ var NoneNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"no namespace is in the scope, the result is empty"},
+			Data:     []labels.Labels{},
 		},
 	},
 }
@@ -211,8 +224,9 @@ var SomeNamespacesTokenSeriesScenarios = map[string]Scenario{
 		},
 		RespCode: http.StatusOK,
 		RespBody: &jsonResponseData{
-			Status: "success",
-			Data:   []labels.Labels{},
+			Status:   "success",
+			Warnings: []string{"namespaces [ns-c] are outside of the scope and select nothing"},
+			Data:     []labels.Labels{},
 		},
 	},
 	"test_metric2{foo='boo'}": {
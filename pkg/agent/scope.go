@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/prom"
+	authentication "k8s.io/api/authentication/v1"
+)
+
+const (
+	scopeHeaderKey = "X-Prometheus-Auth-Namespaces"
+	scopeQueryKey  = "namespace"
+
+	pathScopeContextKey = "_pathScope_"
+
+	pathScopeNamespace = "namespace"
+	pathScopeProject   = "project"
+)
+
+// pathScope is the scope taken from the "/ns/{namespace}/" or "/project/{projectID}/" prefix.
+type pathScope struct {
+	kind       string
+	name       string
+	namespaces data.Set
+}
+
+// restrict intersects the path scope with the allowed namespaces,
+// it is forbidden if the caller isn't allowed to see any namespace in the path scope.
+func (p *pathScope) restrict(allowed data.Set) (data.Set, error) {
+	ret := data.Set{}
+	for namespace := range p.namespaces {
+		if _, exist := allowed[namespace]; exist {
+			ret[namespace] = struct{}{}
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.Forbiddenf("%s %s is not allowed", p.kind, p.name)
+	}
+
+	return ret, nil
+}
+
+// withPathScope serves the access control API tree under the path prefix, the prefix is stripped before proxying.
+func (a *agent) withPathScope(kind string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		scope := &pathScope{kind: kind}
+		prefix := ""
+		switch kind {
+		case pathScopeNamespace:
+			scope.name = vars["namespace"]
+			scope.namespaces = data.NewSet(scope.name)
+			prefix = "/ns/" + scope.name
+		case pathScopeProject:
+			scope.name = vars["projectID"]
+			scope.namespaces = a.namespaces.ProjectNamespaces(scope.name)
+			prefix = "/project/" + scope.name
+		}
+
+		req := r.Clone(context.WithValue(r.Context(), pathScopeContextKey, scope))
+		req.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		req.URL.RawPath = ""
+		req.RequestURI = req.URL.RequestURI()
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// scopeNamespaces resolves the effective namespaces from the grants, the path scope and the requested scope,
+// the namespaces of the time-bounded grants are allowed if any, which are narrowed per request later.
+func (a *agent) scopeNamespaces(accessToken string, userInfo authentication.UserInfo, bypassed bool, path *pathScope, requested data.Set, grants data.Grants) (data.Set, error) {
+	var allowed data.Set
+
+	switch {
+	case bypassed && path != nil:
+		allowed = path.namespaces
+	case bypassed:
+		// bypassed callers can narrow down to any namespaces
+		return requested, nil
+	default:
+		allowed = a.allowedNamespaces(accessToken, userInfo, grants)
+		if path != nil {
+			var err error
+			if allowed, err = path.restrict(allowed); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return narrowScope(allowed, requested)
+}
+
+// parseScope splits the comma separated namespaces, returns nil if nothing is requested.
+func parseScope(values []string) data.Set {
+	var ret data.Set
+
+	for _, value := range values {
+		for _, namespace := range strings.Split(value, ",") {
+			namespace = strings.TrimSpace(namespace)
+			if len(namespace) == 0 {
+				continue
+			}
+			if ret == nil {
+				ret = data.Set{}
+			}
+			ret[namespace] = struct{}{}
+		}
+	}
+
+	return ret
+}
+
+// requestedScope reads the namespaces which the caller narrows down to, from either the header or the query parameter.
+func requestedScope(r *http.Request) data.Set {
+	if ret := parseScope(r.Header.Values(scopeHeaderKey)); ret != nil {
+		return ret
+	}
+
+	return parseScope(r.URL.Query()[scopeQueryKey])
+}
+
+// stripScope drops the scope header and query parameter, which are meaningless to the upstream.
+func stripScope(r *http.Request) *http.Request {
+	hasHeader := len(r.Header.Values(scopeHeaderKey)) != 0
+	hasParam := r.URL.Query().Has(scopeQueryKey)
+	if !hasHeader && !hasParam {
+		return r
+	}
+
+	ret := r.Clone(r.Context())
+	ret.Header.Del(scopeHeaderKey)
+	if hasParam {
+		query := ret.URL.Query()
+		query.Del(scopeQueryKey)
+		ret.URL.RawQuery = query.Encode()
+		ret.RequestURI = ret.URL.RequestURI()
+	}
+
+	return ret
+}
+
+// narrowScope intersects the allowed namespaces with the requested ones,
+// requesting any namespace out of the allowed ones is forbidden.
+func narrowScope(allowed, requested data.Set) (data.Set, error) {
+	if requested == nil {
+		return allowed, nil
+	}
+
+	forbidden := make([]string, 0)
+	for namespace := range requested {
+		if _, exist := allowed[namespace]; !exist {
+			forbidden = append(forbidden, namespace)
+		}
+	}
+	if len(forbidden) != 0 {
+		sort.Strings(forbidden)
+		return nil, errors.Forbiddenf("namespaces [%s] are not allowed", strings.Join(forbidden, ","))
+	}
+
+	return requested, nil
+}
+
+const (
+	// the selected namespaces outside of the scope are rewritten to select nothing
+	scopeModeLenient = "lenient"
+	// the selected namespaces outside of the scope are forbidden
+	scopeModeStrict = "strict"
+)
+
+func validateScopeMode(mode string) error {
+	switch mode {
+	case scopeModeLenient, scopeModeStrict:
+		return nil
+	}
+
+	return errors.Errorf("unknown scope mode %q, expected %s or %s", mode, scopeModeLenient, scopeModeStrict)
+}
+
+// checkScope handles the matchers naming namespaces outside of the scope, e.g. `absent(up{namespace="ns-x"})`,
+// they are forbidden in strict mode and reported as warnings in lenient mode. The narrowed patterns are reported as well.
+func (c *apiContext) checkScope(matcherSets ...[]*promlb.Matcher) error {
+	if c.namespaceSet == nil {
+		return nil
+	}
+
+	namespaceSet := data.Set{}
+	for _, matchers := range matcherSets {
+		for _, namespace := range prom.OutOfScopeNamespaces(c.namespaceSet, matchers) {
+			namespaceSet[namespace] = struct{}{}
+		}
+	}
+	if len(namespaceSet) != 0 {
+		namespaces := namespaceSet.Values()
+		sort.Strings(namespaces)
+		if c.scopeMode == scopeModeStrict {
+			return errors.Wrap(errors.Errorf("namespaces [%s] are outside of the scope", strings.Join(namespaces, ",")), forbiddenErr)
+		}
+		c.addWarning(fmt.Sprintf("namespaces [%s] are outside of the scope and select nothing", strings.Join(namespaces, ",")))
+	}
+
+	// the upstream isolates the tenants by itself
+	if !c.rewriteMatchers || len(c.namespaceSet) == 0 {
+		return nil
+	}
+	for _, matchers := range matcherSets {
+		for _, m := range matchers {
+			if namespaces, narrowed := prom.NarrowedNamespaces(c.namespaceSet, m); narrowed {
+				c.addWarning(fmt.Sprintf("results of %s are restricted to namespaces [%s]", m, strings.Join(namespaces, ",")))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *apiContext) checkExpressionScope(expr parser.Expr) error {
+	var matcherSets [][]*promlb.Matcher
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if n, ok := node.(*parser.VectorSelector); ok {
+			matcherSets = append(matcherSets, n.LabelMatchers)
+		}
+		return nil
+	})
+
+	return c.checkScope(matcherSets...)
+}
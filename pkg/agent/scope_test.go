@@ -0,0 +1,187 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+	authentication "k8s.io/api/authentication/v1"
+)
+
+func Test_requestedScope(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series?match[]=up", nil)
+	require.Nil(t, requestedScope(req))
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series?match[]=up&namespace=ns-a&namespace=ns-b,", nil)
+	require.Equal(t, data.NewSet("ns-a", "ns-b"), requestedScope(req))
+
+	// the header takes precedence
+	req.Header.Set(scopeHeaderKey, " ns-c ")
+	require.Equal(t, data.NewSet("ns-c"), requestedScope(req))
+
+	stripped := stripScope(req)
+	require.Equal(t, "match%5B%5D=up", stripped.URL.RawQuery)
+	require.Empty(t, stripped.Header.Get(scopeHeaderKey))
+
+	// blank values don't scope down
+	req = httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series?namespace=", nil)
+	require.Nil(t, requestedScope(req))
+}
+
+func Test_narrowScope(t *testing.T) {
+	allowed := data.NewSet("ns-a", "ns-b")
+
+	namespaceSet, err := narrowScope(allowed, nil)
+	require.NoError(t, err)
+	require.Equal(t, allowed, namespaceSet)
+
+	namespaceSet, err = narrowScope(allowed, data.NewSet("ns-b"))
+	require.NoError(t, err)
+	require.Equal(t, data.NewSet("ns-b"), namespaceSet)
+
+	_, err = narrowScope(allowed, data.NewSet("ns-b", "ns-c"))
+	require.EqualError(t, err, "namespaces [ns-c] are not allowed")
+}
+
+func Test_accessControl_scopeForbidden(t *testing.T) {
+	handler := mockAgent(t).httpBackend()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series?match[]=up", nil)
+	req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+	req.Header.Set(scopeHeaderKey, "ns-a,ns-c")
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	require.Equal(t, http.StatusForbidden, res.Code)
+	require.Contains(t, res.Body.String(), "ns-c")
+}
+
+func Test_scopeNamespaces(t *testing.T) {
+	agt := mockAgent(t)
+
+	namespaceSet, err := agt.scopeNamespaces("someNamespacesToken", authentication.UserInfo{Username: "someNamespacesUser"}, false, nil, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, data.NewSet("ns-a", "ns-b"), namespaceSet)
+
+	projectScope := &pathScope{kind: pathScopeProject, name: "p-ab", namespaces: agt.namespaces.ProjectNamespaces("p-ab")}
+	namespaceSet, err = agt.scopeNamespaces("someNamespacesToken", authentication.UserInfo{Username: "someNamespacesUser"}, false, projectScope, data.NewSet("ns-b"), nil)
+	require.NoError(t, err)
+	require.Equal(t, data.NewSet("ns-b"), namespaceSet)
+
+	namespaceScope := &pathScope{kind: pathScopeNamespace, name: "ns-c", namespaces: data.NewSet("ns-c")}
+	_, err = agt.scopeNamespaces("someNamespacesToken", authentication.UserInfo{Username: "someNamespacesUser"}, false, namespaceScope, nil, nil)
+	require.EqualError(t, err, "namespace ns-c is not allowed")
+
+	// the header can't widen the path scope
+	namespaceScope = &pathScope{kind: pathScopeNamespace, name: "ns-a", namespaces: data.NewSet("ns-a")}
+	_, err = agt.scopeNamespaces("someNamespacesToken", authentication.UserInfo{Username: "someNamespacesUser"}, false, namespaceScope, data.NewSet("ns-b"), nil)
+	require.Error(t, err)
+
+	// bypassed callers get the path scope as it is
+	namespaceSet, err = agt.scopeNamespaces("myToken", agt.userInfo, true, &pathScope{kind: pathScopeProject, name: "p-c", namespaces: data.NewSet("ns-c")}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, data.NewSet("ns-c"), namespaceSet)
+
+	// members of several projects get the union of them, even without token
+	namespaceSet, err = agt.scopeNamespaces("", authentication.UserInfo{Username: "multiProjectsUser"}, false, nil, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, data.NewSet("ns-a", "ns-b", "ns-c"), namespaceSet)
+}
+
+func Test_withPathScope(t *testing.T) {
+	agt := mockAgent(t)
+
+	var (
+		gotPath  string
+		gotScope *pathScope
+	)
+	recorder := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotScope, _ = r.Context().Value(pathScopeContextKey).(*pathScope)
+	})
+
+	router := mux.NewRouter()
+	router.PathPrefix("/ns/{namespace}/").Handler(agt.withPathScope(pathScopeNamespace, recorder))
+	router.PathPrefix("/project/{projectID}/").Handler(agt.withPathScope(pathScopeProject, recorder))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.org/ns/ns-a/api/v1/query?query=up", nil))
+	require.Equal(t, "/api/v1/query", gotPath)
+	require.Equal(t, data.NewSet("ns-a"), gotScope.namespaces)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.org/project/p-ab/api/v1/series", nil))
+	require.Equal(t, "/api/v1/series", gotPath)
+	require.Equal(t, data.NewSet("ns-a", "ns-b"), gotScope.namespaces)
+}
+
+func Test_accessControl_pathScopeForbidden(t *testing.T) {
+	handler := mockAgent(t).httpBackend()
+
+	for path, message := range map[string]string{
+		"/ns/ns-c/api/v1/series?match[]=up":     "namespace ns-c is not allowed",
+		"/project/p-c/api/v1/series?match[]=up": "project p-c is not allowed",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.org"+path, nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		require.Equal(t, http.StatusForbidden, res.Code, path)
+		require.Contains(t, res.Body.String(), message, path)
+	}
+}
+
+func Test_scopeMode(t *testing.T) {
+	var gotQuery string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("query")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	})
+
+	serve := func(mode, handlerURL string, handler apiContextHandler) *httptest.ResponseRecorder {
+		gotQuery = ""
+		req := httptest.NewRequest(http.MethodGet, handlerURL, nil)
+		res := httptest.NewRecorder()
+		apiCtx := &apiContext{
+			response:        res,
+			request:         req,
+			proxyHandler:    upstream,
+			namespaceSet:    data.NewSet("ns-a"),
+			rewriteMatchers: true,
+			scopeMode:       mode,
+		}
+		handler.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+		return res
+	}
+
+	query := "/api/v1/query?query=" + url.QueryEscape(`absent(up{namespace="ns-x"}) or absent(up{namespace=~"ns-a|ns-y|team-.*"})`)
+
+	// the out of scope namespaces select nothing and are reported
+	res := serve(scopeModeLenient, query, hijackQuery)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, `absent(up{namespace="______"}) or absent(up{namespace="ns-a"})`, gotQuery)
+	require.Equal(t, `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["namespaces [ns-x,ns-y] are outside of the scope and select nothing","results of namespace=~\"ns-a|ns-y|team-.*\" are restricted to namespaces [ns-a]"]}`, res.Body.String())
+
+	res = serve(scopeModeStrict, query, hijackQuery)
+	require.Equal(t, http.StatusForbidden, res.Code)
+	require.Equal(t, `{"status":"error","errorType":"forbidden","error":"namespaces [ns-x,ns-y] are outside of the scope"}`, res.Body.String())
+	require.Empty(t, gotQuery)
+
+	res = serve(scopeModeStrict, "/api/v1/series?match[]="+url.QueryEscape(`up{namespace="ns-x"}`), hijackSeries)
+	require.Equal(t, http.StatusForbidden, res.Code)
+
+	// the namespaces in scope and the patterns are still rewritten
+	res = serve(scopeModeStrict, "/api/v1/query?query="+url.QueryEscape(`absent(up{namespace="ns-a"}) or absent(up{namespace=~"ns-.*"})`), hijackQuery)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, `absent(up{namespace="ns-a"}) or absent(up{namespace="ns-a"})`, gotQuery)
+	require.Contains(t, res.Body.String(), `"warnings":["results of namespace=~\"ns-.*\" are restricted to namespaces [ns-a]"]`)
+
+	require.Error(t, validateScopeMode("loose"))
+}
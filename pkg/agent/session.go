@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	loginPath  = "/_/login"
+	logoutPath = "/_/logout"
+
+	defaultLoginRedirect = "/graph"
+)
+
+type sessionConfig struct {
+	enabled          bool
+	secretFile       string
+	ttl              time.Duration
+	cookieName       string
+	accessTokenParam string
+}
+
+func (c *sessionConfig) String() string {
+	if c == nil {
+		return ""
+	}
+
+	var ret string
+	if c.enabled {
+		ret = fmt.Sprintf(", accepting session cookie %q valid for %v", c.cookieName, c.ttl)
+	}
+	if len(c.accessTokenParam) != 0 {
+		ret += fmt.Sprintf(", accepting query parameter %q", c.accessTokenParam)
+	}
+
+	return ret
+}
+
+// sessionSigner issues the browser sessions, the cookie carries the access token and its expiry signed by HMAC-SHA256.
+type sessionSigner struct {
+	secret     []byte
+	ttl        time.Duration
+	cookieName string
+}
+
+func newSessionSigner(cfg *sessionConfig) (*sessionSigner, error) {
+	if cfg == nil || !cfg.enabled {
+		return nil, nil
+	}
+
+	if len(cfg.cookieName) == 0 {
+		return nil, errors.New("blank session cookie name")
+	}
+	if cfg.ttl <= 0 {
+		return nil, errors.New("session TTL must be positive")
+	}
+
+	var secret []byte
+	if len(cfg.secretFile) != 0 {
+		content, err := ioutil.ReadFile(cfg.secretFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to read session secret file %s", cfg.secretFile)
+		}
+		secret = []byte(strings.TrimSpace(string(content)))
+		if len(secret) < 32 {
+			return nil, errors.Errorf("session secret in %s must have at least 32 bytes", cfg.secretFile)
+		}
+	} else {
+		// the sessions don't survive restarts and are not shared among the instances
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, errors.Annotate(err, "unable to generate session secret")
+		}
+		log.Warn("No session secret file provided, the browser sessions are invalidated on restart")
+	}
+
+	return &sessionSigner{
+		secret:     secret,
+		ttl:        cfg.ttl,
+		cookieName: cfg.cookieName,
+	}, nil
+}
+
+func (s *sessionSigner) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+func (s *sessionSigner) sign(accessToken string, expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(expiry.Unix(), 10) + "." + accessToken))
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+func (s *sessionSigner) verify(value string, now time.Time) (string, error) {
+	idx := strings.LastIndexByte(value, '.')
+	if idx < 0 {
+		return "", errors.New("malformed session")
+	}
+	payload, signature := value[:idx], value[idx+1:]
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return "", errors.New("invalid session signature")
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errors.New("malformed session")
+	}
+	parts := strings.SplitN(string(decoded), ".", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed session")
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed session")
+	}
+	if now.Unix() >= expiry {
+		return "", errors.New("session expired")
+	}
+
+	return parts[1], nil
+}
+
+// accessToken reads the access token from the session cookie, returns blank if there isn't a valid one.
+func (s *sessionSigner) accessToken(r *http.Request) string {
+	if s == nil {
+		return ""
+	}
+
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil {
+		return ""
+	}
+
+	accessToken, err := s.verify(cookie.Value, time.Now())
+	if err != nil {
+		log.Debugf("Ignore session cookie: %v", err)
+		return ""
+	}
+
+	return accessToken
+}
+
+func (s *sessionSigner) cookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.cookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   requestConnectionState(r) != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Prometheus Auth - Login</title>
+</head>
+<body>
+  <h3>Paste your access token</h3>
+  {{ if .Error }}<p style="color: red">{{ .Error }}</p>{{ end }}
+  <form method="POST" action="{{ .Action }}">
+    <input type="hidden" name="redirect" value="{{ .Redirect }}">
+    <textarea name="token" rows="8" cols="80" autocomplete="off" required></textarea><br>
+    <button type="submit">Login</button>
+  </form>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	Action   string
+	Redirect string
+	Error    string
+}
+
+// loginHandler exchanges a pasted token for the session cookie, so that the Prometheus UI can call the APIs.
+func (a *agent) loginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			a.renderLogin(w, http.StatusOK, safeRedirect(r.URL.Query().Get("redirect")), "")
+			return
+		}
+
+		redirect := safeRedirect(r.PostFormValue("redirect"))
+		accessToken := strings.TrimPrefix(strings.TrimSpace(r.PostFormValue("token")), "Bearer ")
+		if len(accessToken) == 0 {
+			a.renderLogin(w, http.StatusBadRequest, redirect, "no access token provided")
+			return
+		}
+
+		userInfo, err := a.tokens.Authenticate(accessToken)
+		if err != nil {
+			a.renderLogin(w, http.StatusUnauthorized, redirect, err.Error())
+			return
+		}
+		log.Debugf("%s logged in via browser", userInfo.Username)
+
+		value := a.sessions.sign(accessToken, time.Now().Add(a.sessions.ttl))
+		http.SetCookie(w, a.sessions.cookie(r, value, int(a.sessions.ttl.Seconds())))
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	})
+}
+
+func (a *agent) logoutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, a.sessions.cookie(r, "", -1))
+		http.Redirect(w, r, loginPath, http.StatusSeeOther)
+	})
+}
+
+func (a *agent) renderLogin(w http.ResponseWriter, code int, redirect, errMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	if err := loginTemplate.Execute(w, &loginPageData{Action: loginPath, Redirect: redirect, Error: errMsg}); err != nil {
+		log.WithError(err).Warn("Failed to render login page")
+	}
+}
+
+// safeRedirect only accepts the local paths, to avoid redirecting to other sites after login.
+func safeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return defaultLoginRedirect
+	}
+
+	return redirect
+}
+
+// stripCredentials drops the access token query parameter and the session cookie, which must not reach the upstream.
+func (a *agent) stripCredentials(r *http.Request) *http.Request {
+	paramName := a.cfg.session.accessTokenParamName()
+	hasParam := len(paramName) != 0 && r.URL.Query().Has(paramName)
+	hasCookie := a.sessions != nil && len(r.Header.Values("Cookie")) != 0
+	if !hasParam && !hasCookie {
+		return r
+	}
+
+	ret := r.Clone(r.Context())
+
+	if hasParam {
+		query := ret.URL.Query()
+		query.Del(paramName)
+		ret.URL.RawQuery = query.Encode()
+		ret.RequestURI = ret.URL.RequestURI()
+	}
+
+	if hasCookie {
+		cookies := ret.Cookies()
+		ret.Header.Del("Cookie")
+		for _, cookie := range cookies {
+			if cookie.Name != a.sessions.cookieName {
+				ret.AddCookie(cookie)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (a *agent) stripCredentialsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, a.stripCredentials(r))
+	})
+}
+
+func (c *sessionConfig) accessTokenParamName() string {
+	if c == nil {
+		return ""
+	}
+
+	return c.accessTokenParam
+}
@@ -0,0 +1,183 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mockSessionAgent(t *testing.T) *agent {
+	agt := mockAgent(t)
+	agt.cfg.session = &sessionConfig{
+		enabled:          true,
+		ttl:              time.Hour,
+		cookieName:       "prometheus_auth_session",
+		accessTokenParam: "access_token",
+	}
+
+	sessions, err := newSessionSigner(agt.cfg.session)
+	require.NoError(t, err)
+	agt.sessions = sessions
+
+	return agt
+}
+
+func Test_sessionSigner(t *testing.T) {
+	signer, err := newSessionSigner(&sessionConfig{enabled: true, ttl: time.Hour, cookieName: "session"})
+	require.NoError(t, err)
+
+	now := time.Now()
+	value := signer.sign("someNamespacesToken", now.Add(time.Hour))
+
+	accessToken, err := signer.verify(value, now)
+	require.NoError(t, err)
+	require.Equal(t, "someNamespacesToken", accessToken)
+
+	_, err = signer.verify(value, now.Add(2*time.Hour))
+	require.Error(t, err)
+
+	// forged by another secret
+	other, err := newSessionSigner(&sessionConfig{enabled: true, ttl: time.Hour, cookieName: "session"})
+	require.NoError(t, err)
+	_, err = signer.verify(other.sign("myToken", now.Add(time.Hour)), now)
+	require.Error(t, err)
+
+	// tampered payload
+	tampered := signer.sign("myToken", now.Add(time.Hour))
+	tampered = tampered[:strings.LastIndexByte(tampered, '.')] + value[strings.LastIndexByte(value, '.'):]
+	_, err = signer.verify(tampered, now)
+	require.Error(t, err)
+
+	_, err = signer.verify("garbage", now)
+	require.Error(t, err)
+}
+
+func Test_safeRedirect(t *testing.T) {
+	require.Equal(t, "/graph?g0.expr=up", safeRedirect("/graph?g0.expr=up"))
+	require.Equal(t, defaultLoginRedirect, safeRedirect(""))
+	require.Equal(t, defaultLoginRedirect, safeRedirect("https://evil.example.com"))
+	require.Equal(t, defaultLoginRedirect, safeRedirect("//evil.example.com"))
+	require.Equal(t, defaultLoginRedirect, safeRedirect("/\\evil.example.com"))
+}
+
+func Test_loginHandler(t *testing.T) {
+	agt := mockSessionAgent(t)
+	handler := agt.httpBackend()
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "http://example.org/_/login?redirect=/alerts", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Contains(t, res.Body.String(), `value="/alerts"`)
+
+	login := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{"token": {token}, "redirect": {"/alerts"}}
+		req := httptest.NewRequest(http.MethodPost, "http://example.org/_/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res = login("unknownToken")
+	require.Equal(t, http.StatusUnauthorized, res.Code)
+	require.Empty(t, res.Result().Cookies())
+
+	res = login("someNamespacesToken")
+	require.Equal(t, http.StatusSeeOther, res.Code)
+	require.Equal(t, "/alerts", res.Header().Get("Location"))
+
+	cookies := res.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, "prometheus_auth_session", cookies[0].Name)
+	require.True(t, cookies[0].HttpOnly)
+	require.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+
+	// the session cookie is accepted by the access control
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series", nil)
+	req.AddCookie(cookies[0])
+	accessToken, userInfo, err := agt.authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "someNamespacesToken", accessToken)
+	require.Equal(t, "someNamespacesUser", userInfo.Username)
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "http://example.org/_/logout", nil))
+	require.Equal(t, http.StatusSeeOther, res.Code)
+	require.Equal(t, -1, res.Result().Cookies()[0].MaxAge)
+}
+
+func Test_authenticate_accessTokenParam(t *testing.T) {
+	agt := mockSessionAgent(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series?match[]=up&access_token=someNamespacesToken", nil)
+	req.AddCookie(&http.Cookie{Name: "prometheus_auth_session", Value: "garbage"})
+	req.AddCookie(&http.Cookie{Name: "other", Value: "kept"})
+
+	accessToken, userInfo, err := agt.authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "someNamespacesToken", accessToken)
+	require.Equal(t, "someNamespacesUser", userInfo.Username)
+
+	// the bearer header takes precedence
+	req.Header.Set(authorizationHeaderKey, "Bearer noneNamespacesToken")
+	accessToken, _, err = agt.authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "noneNamespacesToken", accessToken)
+
+	stripped := agt.stripCredentials(req)
+	require.Equal(t, "match%5B%5D=up", stripped.URL.RawQuery)
+	_, err = stripped.Cookie("prometheus_auth_session")
+	require.Error(t, err)
+	cookie, err := stripped.Cookie("other")
+	require.NoError(t, err)
+	require.Equal(t, "kept", cookie.Value)
+
+	// the query parameter is disabled by default
+	agt.cfg.session.accessTokenParam = ""
+	_, _, err = agt.authenticate(httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series?access_token=someNamespacesToken", nil))
+	require.Error(t, err)
+}
+
+func Test_sessionDisabled(t *testing.T) {
+	agt := mockAgent(t)
+	agt.cfg.session = &sessionConfig{
+		ttl:        time.Hour,
+		cookieName: "prometheus_auth_session",
+	}
+
+	sessions, err := newSessionSigner(agt.cfg.session)
+	require.NoError(t, err)
+	require.Nil(t, sessions)
+
+	res := httptest.NewRecorder()
+	agt.httpBackend().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "http://example.org/_/login", nil))
+	require.NotEqual(t, http.StatusOK, res.Code)
+
+	// a cookie signed by an enabled instance is ignored
+	signer := mockSessionAgent(t).sessions
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/api/v1/series", nil)
+	req.AddCookie(signer.cookie(req, signer.sign("someNamespacesToken", time.Now().Add(time.Hour)), 3600))
+	_, _, err = agt.authenticate(req)
+	require.Error(t, err)
+}
+
+func Test_sessionCookieSecure(t *testing.T) {
+	signer := mockSessionAgent(t).sessions
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.org/_/login", nil)
+	require.False(t, signer.cookie(req, "value", 3600).Secure)
+
+	// the TLS connections are terminated before cmux hands them to the HTTP server
+	req = req.WithContext(context.WithValue(req.Context(), tlsStateContextKey, &tls.ConnectionState{}))
+	require.True(t, signer.cookie(req, "value", 3600).Secure)
+}
@@ -0,0 +1,543 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/util/httputil"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+	promgo "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+// shardSet fans out the requests to every Prometheus shard,
+// the responses are merged and de-duplicated by label set.
+type shardSet struct {
+	urls      []*url.URL
+	transport http.RoundTripper
+}
+
+type shardResponse struct {
+	shard  *url.URL
+	header http.Header
+	body   []byte
+}
+
+type shardMerger func(c *apiContext, responses []*shardResponse) error
+
+func newShardSet(urls []*url.URL, transport http.RoundTripper) *shardSet {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	return &shardSet{
+		urls:      urls,
+		transport: transport,
+	}
+}
+
+func (s *shardSet) fanOut(req *http.Request, body []byte) ([]*shardResponse, error) {
+	responses := make([]*shardResponse, len(s.urls))
+	errs := make([]error, len(s.urls))
+
+	wg := &sync.WaitGroup{}
+	for idx, shard := range s.urls {
+		wg.Add(1)
+		go func(idx int, shard *url.URL) {
+			defer wg.Done()
+			responses[idx], errs[idx] = s.do(req, body, shard)
+		}(idx, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return responses, nil
+}
+
+func (s *shardSet) do(req *http.Request, body []byte, shard *url.URL) (*shardResponse, error) {
+	shardURL := *shard
+	shardURL.Path = singleJoiningSlash(shard.Path, req.URL.Path)
+	shardURL.RawQuery = req.URL.RawQuery
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	shardReq, err := http.NewRequestWithContext(req.Context(), req.Method, shardURL.String(), bodyReader)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to create request for shard %s", shard)
+	}
+	for key, values := range req.Header {
+		if strings.EqualFold(key, authorizationHeaderKey) {
+			continue
+		}
+		shardReq.Header[key] = values
+	}
+
+	resp, err := s.transport.RoundTrip(shardReq)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to request shard %s", shard)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read response of shard %s", shard)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		// the error responses of Prometheus API are JSON, pass the reason through
+		errData := &jsonResponseData{}
+		if json.Unmarshal(respBody, errData) == nil && len(errData.Error) != 0 {
+			return nil, errors.Errorf("shard %s: %s", shard, errData.Error)
+		}
+		return nil, errors.Errorf("shard %s responded %d", shard, resp.StatusCode)
+	}
+
+	if strings.EqualFold(resp.Header.Get(httputil.ContentEncodingHeader), "snappy") {
+		respBody, err = snappy.Decode(nil, respBody)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to decode response of shard %s", shard)
+		}
+	}
+
+	return &shardResponse{
+		shard:  shard,
+		header: resp.Header,
+		body:   respBody,
+	}, nil
+}
+
+// mergesResponses returns true if the responses are decoded and merged instead of streamed back,
+// either to fan in the shards or to redact the labels.
+func (c *apiContext) mergesResponses() bool {
+	return c.shards != nil || c.redactor != nil
+}
+
+// mergesReadResponses returns true if the remote read responses are decoded,
+// which is also required to strip the filtered reader labels from the series.
+func (c *apiContext) mergesReadResponses() bool {
+	return c.mergesResponses() || len(c.filterReaderLabelSet) != 0
+}
+
+// decodesResponses returns true if the responses are decoded, to be merged or to carry the warnings.
+func (c *apiContext) decodesResponses() bool {
+	return c.mergesResponses() || len(c.warnings) != 0
+}
+
+func (c *apiContext) proxyWithMerger(request *http.Request, merger shardMerger) error {
+	if !c.decodesResponses() {
+		return c.proxyWith(request)
+	}
+
+	return c.mergeUpstream(request, merger)
+}
+
+// proxyAllWithMerger merges the responses of all the requests, a single request is proxied by proxyWithMerger.
+func (c *apiContext) proxyAllWithMerger(requests []*http.Request, merger shardMerger) error {
+	if len(requests) == 1 {
+		return c.proxyWithMerger(requests[0], merger)
+	}
+
+	var responses []*shardResponse
+	for _, request := range requests {
+		upstreamResponses, err := c.collectUpstream(request)
+		if err != nil || upstreamResponses == nil {
+			return err
+		}
+		responses = append(responses, upstreamResponses...)
+	}
+
+	return merger(c, responses)
+}
+
+// mergeUpstream merges the responses of the shards, or of the upstream if there are no shards.
+func (c *apiContext) mergeUpstream(request *http.Request, merger shardMerger) error {
+	responses, err := c.collectUpstream(request)
+	if err != nil || responses == nil {
+		return err
+	}
+
+	return merger(c, responses)
+}
+
+// collectUpstream returns the responses of the shards, or of the upstream if there are no shards,
+// nil is returned if the response of the upstream is passed through.
+func (c *apiContext) collectUpstream(request *http.Request) ([]*shardResponse, error) {
+	if c.shards == nil {
+		response, err := c.captureUpstream(request)
+		if err != nil {
+			return nil, errors.Wrap(err, notProvisionedErr)
+		}
+		if response == nil {
+			return nil, nil
+		}
+		return []*shardResponse{response}, nil
+	}
+
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(request.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, badRequestErr)
+		}
+	}
+
+	responses, err := c.shards.fanOut(request.WithContext(c.request.Context()), body)
+	if err != nil {
+		return nil, errors.Wrap(err, notProvisionedErr)
+	}
+
+	return responses, nil
+}
+
+type shardJSONResponse struct {
+	Status   string          `json:"status"`
+	Data     json.RawMessage `json:"data"`
+	Error    string          `json:"error,omitempty"`
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+func decodeShardJSON(responses []*shardResponse) ([]json.RawMessage, []string, error) {
+	ret := make([]json.RawMessage, 0, len(responses))
+	var warnings []string
+
+	for _, resp := range responses {
+		shardResp := &shardJSONResponse{}
+		if err := json.Unmarshal(resp.body, shardResp); err != nil {
+			return nil, nil, errors.Annotatef(err, "unable to decode response of shard %s", resp.shard)
+		}
+		if shardResp.Status != "success" {
+			return nil, nil, errors.Errorf("shard %s: %s", resp.shard, shardResp.Error)
+		}
+
+		ret = append(ret, shardResp.Data)
+		warnings = append(warnings, shardResp.Warnings...)
+	}
+
+	return ret, warnings, nil
+}
+
+func mergeSeries(c *apiContext, responses []*shardResponse) error {
+	datas, warnings, err := decodeShardJSON(responses)
+	if err != nil {
+		return errors.Wrap(err, notProvisionedErr)
+	}
+
+	seen := map[string]struct{}{}
+	merged := make([]promlb.Labels, 0)
+	for _, data := range datas {
+		var series []promlb.Labels
+		if err := json.Unmarshal(data, &series); err != nil {
+			return errors.Wrap(err, notProvisionedErr)
+		}
+
+		for _, lbs := range series {
+			lbs = c.redactor.redactLabels(lbs)
+			key := lbs.String()
+			if _, exist := seen[key]; exist {
+				continue
+			}
+			seen[key] = struct{}{}
+			merged = append(merged, lbs)
+		}
+	}
+
+	return c.responseJSONWithWarnings(merged, warnings)
+}
+
+func mergeLabelValues(c *apiContext, responses []*shardResponse) error {
+	datas, warnings, err := decodeShardJSON(responses)
+	if err != nil {
+		return errors.Wrap(err, notProvisionedErr)
+	}
+
+	name := mux.Vars(c.request)["name"]
+	seen := map[string]struct{}{}
+	merged := make([]string, 0)
+	for _, data := range datas {
+		var values []string
+		if err := json.Unmarshal(data, &values); err != nil {
+			return errors.Wrap(err, notProvisionedErr)
+		}
+		values = c.redactor.redactLabelValues(name, values)
+
+		for _, value := range values {
+			if _, exist := seen[value]; exist {
+				continue
+			}
+			seen[value] = struct{}{}
+			merged = append(merged, value)
+		}
+	}
+	sort.Strings(merged)
+
+	return c.responseJSONWithWarnings(merged, warnings)
+}
+
+type shardQueryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+	Stats      json.RawMessage `json:"stats,omitempty"`
+}
+
+type shardQuerySeries struct {
+	Metric map[string]string `json:"metric"`
+}
+
+func mergeQuery(c *apiContext, responses []*shardResponse) error {
+	datas, warnings, err := decodeShardJSON(responses)
+	if err != nil {
+		return errors.Wrap(err, notProvisionedErr)
+	}
+
+	var ret *shardQueryData
+	merged := make([]json.RawMessage, 0)
+	seen := map[string]struct{}{}
+	for _, data := range datas {
+		queryData := &shardQueryData{}
+		if err := json.Unmarshal(data, queryData); err != nil {
+			return errors.Wrap(err, notProvisionedErr)
+		}
+
+		if ret == nil {
+			ret = queryData
+			if len(responses) > 1 {
+				ret.Stats = nil
+			}
+		} else if ret.ResultType != queryData.ResultType {
+			return errors.Wrap(errors.Errorf("shards responded different result types %s and %s", ret.ResultType, queryData.ResultType), notProvisionedErr)
+		}
+
+		switch queryData.ResultType {
+		case "vector", "matrix":
+			var series []json.RawMessage
+			if err := json.Unmarshal(queryData.Result, &series); err != nil {
+				return errors.Wrap(err, notProvisionedErr)
+			}
+
+			for _, s := range series {
+				metric := &shardQuerySeries{}
+				if err := json.Unmarshal(s, metric); err != nil {
+					return errors.Wrap(err, notProvisionedErr)
+				}
+
+				lbs := promlb.FromMap(metric.Metric)
+				if redacted := c.redactor.redactLabels(lbs); !promlb.Equal(lbs, redacted) {
+					if s, err = replaceQuerySeriesMetric(s, redacted); err != nil {
+						return errors.Wrap(err, internalErr)
+					}
+					lbs = redacted
+				}
+
+				key := lbs.String()
+				if _, exist := seen[key]; exist {
+					continue
+				}
+				seen[key] = struct{}{}
+				merged = append(merged, s)
+			}
+		}
+	}
+
+	if ret == nil {
+		return errors.Wrap(errors.New("no shard responded"), notProvisionedErr)
+	}
+
+	if ret.ResultType == "vector" || ret.ResultType == "matrix" {
+		result, err := json.Marshal(merged)
+		if err != nil {
+			return errors.Wrap(err, internalErr)
+		}
+		ret.Result = result
+	}
+
+	return c.responseJSONWithWarnings(ret, warnings)
+}
+
+func replaceQuerySeriesMetric(series json.RawMessage, lbs promlb.Labels) (json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(series, &fields); err != nil {
+		return nil, err
+	}
+
+	metric, err := json.Marshal(lbs.Map())
+	if err != nil {
+		return nil, err
+	}
+	fields["metric"] = metric
+
+	return json.Marshal(fields)
+}
+
+func mergeFederate(c *apiContext, responses []*shardResponse) error {
+	families := map[string]*promgo.MetricFamily{}
+	seen := map[string]struct{}{}
+
+	for _, resp := range responses {
+		parser := &expfmt.TextParser{}
+		shardFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(resp.body))
+		if err != nil {
+			return errors.Wrap(errors.Annotatef(err, "unable to decode response of shard %s", resp.shard), notProvisionedErr)
+		}
+
+		for name, shardFamily := range shardFamilies {
+			family, exist := families[name]
+			if !exist {
+				family = &promgo.MetricFamily{
+					Name: shardFamily.Name,
+					Help: shardFamily.Help,
+					Type: shardFamily.Type,
+				}
+				families[name] = family
+			}
+
+			for _, metric := range shardFamily.Metric {
+				metric.Label = c.redactor.redactLabelPairs(metric.Label)
+				key := metricKey(name, metric)
+				if _, exist := seen[key]; exist {
+					continue
+				}
+				seen[key] = struct{}{}
+				family.Metric = append(family.Metric, metric)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := make([]*promgo.MetricFamily, 0, len(names))
+	for _, name := range names {
+		merged = append(merged, families[name])
+	}
+
+	return c.responseMetrics(merged...)
+}
+
+func metricKey(name string, metric *promgo.Metric) string {
+	lbs := make(promlb.Labels, 0, len(metric.Label)+1)
+	lbs = append(lbs, promlb.Label{Name: "__name__", Value: name})
+	for _, lp := range metric.Label {
+		lbs = append(lbs, promlb.Label{Name: lp.GetName(), Value: lp.GetValue()})
+	}
+	sort.Sort(lbs)
+
+	return lbs.String()
+}
+
+func mergeRead(c *apiContext, responses []*shardResponse) error {
+	var merged *prompb.ReadResponse
+	seen := map[int]map[string]*prompb.TimeSeries{}
+
+	for _, resp := range responses {
+		readResp := &prompb.ReadResponse{}
+		if err := proto.Unmarshal(resp.body, readResp); err != nil {
+			return errors.Wrap(errors.Annotatef(err, "unable to decode response of shard %s", resp.shard), notProvisionedErr)
+		}
+
+		if merged == nil {
+			merged = &prompb.ReadResponse{
+				Results: make([]*prompb.QueryResult, len(readResp.Results)),
+			}
+			for idx := range merged.Results {
+				merged.Results[idx] = &prompb.QueryResult{}
+				seen[idx] = map[string]*prompb.TimeSeries{}
+			}
+		}
+		if len(readResp.Results) != len(merged.Results) {
+			return errors.Wrap(errors.Errorf("shard %s responded %d results, expected %d", resp.shard, len(readResp.Results), len(merged.Results)), notProvisionedErr)
+		}
+
+		for idx, result := range readResp.Results {
+			for _, ts := range result.Timeseries {
+				ts.Labels = stripPBLabels(c.redactor.redactPBLabels(ts.Labels), c.filterReaderLabelSet)
+				key := prompbLabelsKey(ts.Labels)
+				if existing, exist := seen[idx][key]; exist {
+					// the replicas may miss different samples, e.g. during restarts
+					existing.Samples = mergePBSamples(existing.Samples, ts.Samples)
+					continue
+				}
+				seen[idx][key] = ts
+				merged.Results[idx].Timeseries = append(merged.Results[idx].Timeseries, ts)
+			}
+		}
+	}
+
+	return c.responseProto(merged)
+}
+
+// mergePBSamples merges the samples sorted by timestamp, the first one wins if both have the same timestamp.
+func mergePBSamples(a, b []prompb.Sample) []prompb.Sample {
+	ret := make([]prompb.Sample, 0, len(a)+len(b))
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Timestamp < b[j].Timestamp:
+			ret = append(ret, a[i])
+			i++
+		case a[i].Timestamp > b[j].Timestamp:
+			ret = append(ret, b[j])
+			j++
+		default:
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	ret = append(ret, a[i:]...)
+	ret = append(ret, b[j:]...)
+
+	return ret
+}
+
+// stripPBLabels removes the labels of the set, e.g. the external labels of the upstream,
+// the series only differing by them are deduplicated by the merger.
+func stripPBLabels(pbLabels []prompb.Label, labelSet data.Set) []prompb.Label {
+	if len(labelSet) == 0 {
+		return pbLabels
+	}
+
+	ret := make([]prompb.Label, 0, len(pbLabels))
+	for _, l := range pbLabels {
+		if _, exist := labelSet[l.Name]; !exist {
+			ret = append(ret, l)
+		}
+	}
+
+	return ret
+}
+
+func prompbLabelsKey(pbLabels []prompb.Label) string {
+	lbs := make(promlb.Labels, 0, len(pbLabels))
+	for _, l := range pbLabels {
+		lbs = append(lbs, promlb.Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Sort(lbs)
+
+	return lbs.String()
+}
@@ -0,0 +1,243 @@
+//go:build test
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func newShardServer(t *testing.T, responses map[string]string) (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, exist := responses[r.URL.Path]
+		if !exist {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	return server, serverURL
+}
+
+func Test_shards(t *testing.T) {
+	serverA, urlA := newShardServer(t, map[string]string{
+		"/api/v1/series":           `{"status":"success","data":[{"__name__":"up","namespace":"ns-a"},{"__name__":"up","namespace":"ns-b"}]}`,
+		"/api/v1/label/job/values": `{"status":"success","data":["b","a"]}`,
+		"/api/v1/query":            `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"ns-a"},"value":[1,"1"]}]}}`,
+		"/api/v1/query_range":      `{"status":"error","errorType":"bad_data","error":"broken"}`,
+	})
+	defer serverA.Close()
+	serverB, urlB := newShardServer(t, map[string]string{
+		"/api/v1/series":           `{"status":"success","data":[{"__name__":"up","namespace":"ns-b"}],"warnings":["partial"]}`,
+		"/api/v1/label/job/values": `{"status":"success","data":["c","a"]}`,
+		"/api/v1/query":            `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"ns-b"},"value":[1,"2"]},{"metric":{"__name__":"up","namespace":"ns-a"},"value":[1,"1"]}]}}`,
+		"/api/v1/query_range":      `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+	})
+	defer serverB.Close()
+
+	shards := newShardSet([]*url.URL{urlA, urlB}, http.DefaultTransport)
+
+	testCases := []struct {
+		name    string
+		url     string
+		handler apiContextHandler
+		code    int
+		expect  string
+	}{
+		{
+			name:    "series",
+			url:     "/api/v1/series?match[]=up",
+			handler: hijackSeries,
+			code:    http.StatusOK,
+			expect:  `{"status":"success","data":[{"__name__":"up","namespace":"ns-a"},{"__name__":"up","namespace":"ns-b"}],"warnings":["partial"]}`,
+		},
+		{
+			name:    "label values",
+			url:     "/api/v1/label/job/values",
+			handler: hijackLabelValues,
+			code:    http.StatusOK,
+			expect:  `{"status":"success","data":["a","b","c"]}`,
+		},
+		{
+			name:    "query",
+			url:     "/api/v1/query?query=up",
+			handler: hijackQuery,
+			code:    http.StatusOK,
+			expect:  `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"ns-a"},"value":[1,"1"]},{"metric":{"__name__":"up","namespace":"ns-b"},"value":[1,"2"]}]}}`,
+		},
+		{
+			name:    "aggregation",
+			url:     "/api/v1/query?query=sum(up)",
+			handler: hijackQuery,
+			code:    http.StatusBadRequest,
+			expect:  `{"status":"error","errorType":"bad_data","error":"aggregation \"sum\" is not supported across shards, query the raw series instead"}`,
+		},
+		{
+			name:    "failed shard",
+			url:     "/api/v1/query_range?query=up&start=0&end=1&step=1",
+			handler: hijackQueryRange,
+			code:    http.StatusUnprocessableEntity,
+			expect:  `{"status":"error","errorType":"execution","error":"shard ` + urlA.String() + `: broken"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, tc.url, nil), map[string]string{"name": "job"})
+		req.Header.Set("Accept", "application/json")
+		res := httptest.NewRecorder()
+		apiCtx := &apiContext{
+			response:        res,
+			request:         req,
+			namespaceSet:    data.NewSet("ns-a", "ns-b"),
+			rewriteMatchers: true,
+			shards:          shards,
+		}
+
+		tc.handler.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+
+		require.Equal(t, tc.code, res.Code, tc.name)
+		require.Equal(t, tc.expect, res.Body.String(), tc.name)
+	}
+}
+
+func Test_labelValuesScope(t *testing.T) {
+	var gotMatches []string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMatches = r.URL.Query()["match[]"]
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":["pod-a"]}`))
+	})
+
+	serve := func(name, query string) *httptest.ResponseRecorder {
+		gotMatches = nil
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/label/"+name+"/values"+query, nil), map[string]string{"name": name})
+		res := httptest.NewRecorder()
+		apiCtx := &apiContext{
+			response:        res,
+			request:         req,
+			proxyHandler:    upstream,
+			namespaceSet:    data.NewSet("ns-a", "ns-b"),
+			rewriteMatchers: true,
+			scopeMode:       scopeModeStrict,
+		}
+		apiContextHandler(hijackLabelValues).ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+		return res
+	}
+
+	// the values of the other namespaces are not selected
+	res := serve("pod", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, []string{`{namespace=~"ns-a|ns-b"}`}, gotMatches)
+
+	res = serve("pod", "?match[]="+url.QueryEscape(`up{namespace=~"ns-.*"}`))
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, []string{`up{namespace=~"ns-a|ns-b"}`}, gotMatches)
+
+	res = serve("pod", "?match[]="+url.QueryEscape(`up{namespace="ns-c"}`))
+	require.Equal(t, http.StatusForbidden, res.Code)
+	require.Nil(t, gotMatches)
+
+	res = serve("invalid-name", "")
+	require.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func Test_stripReaderLabels(t *testing.T) {
+	var gotReq prompb.ReadRequest
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		reqBuf, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		require.NoError(t, proto.Unmarshal(reqBuf, &gotReq))
+
+		respBuf, err := proto.Marshal(&prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "ns-a"}, {Name: "prometheus", Value: "cattle-prometheus/cluster-monitoring"}, {Name: "prometheus_replica", Value: "prometheus-0"}},
+						Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+					},
+					{
+						Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "ns-a"}, {Name: "prometheus", Value: "cattle-prometheus/cluster-monitoring"}, {Name: "prometheus_replica", Value: "prometheus-1"}},
+						Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}},
+					},
+				},
+			}},
+		})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		_, _ = w.Write(snappy.Encode(nil, respBuf))
+	})
+
+	reqBuf, err := proto.Marshal(&prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_EQ, Name: "prometheus", Value: "cattle-prometheus/cluster-monitoring"},
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, reqBuf)))
+	res := httptest.NewRecorder()
+	apiCtx := &apiContext{
+		response:             res,
+		request:              req,
+		proxyHandler:         upstream,
+		filterReaderLabelSet: data.NewSet("prometheus", "prometheus_replica"),
+		namespaceSet:         data.NewSet("ns-a"),
+		rewriteMatchers:      true,
+	}
+	apiContextHandler(hijackRead).ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+	require.Equal(t, http.StatusOK, res.Code)
+
+	// the matchers of the filtered labels are removed and the samples are requested
+	require.Equal(t, []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES}, gotReq.AcceptedResponseTypes)
+	for _, m := range gotReq.Queries[0].Matchers {
+		require.NotEqual(t, "prometheus", m.Name)
+	}
+
+	respBuf, err := snappy.Decode(nil, res.Body.Bytes())
+	require.NoError(t, err)
+	var readResp prompb.ReadResponse
+	require.NoError(t, proto.Unmarshal(respBuf, &readResp))
+
+	// the replicas are deduplicated once the labels are stripped
+	require.Len(t, readResp.Results, 1)
+	require.Len(t, readResp.Results[0].Timeseries, 1)
+	require.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "ns-a"}}, readResp.Results[0].Timeseries[0].Labels)
+	// the samples of the replicas are merged
+	require.Equal(t, []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}}, readResp.Results[0].Timeseries[0].Samples)
+}
+
+func Test_mergePBSamples(t *testing.T) {
+	a := []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 3, Timestamp: 3000}}
+	b := []prompb.Sample{{Value: 9, Timestamp: 1000}, {Value: 2, Timestamp: 2000}, {Value: 4, Timestamp: 4000}}
+
+	require.Equal(t, []prompb.Sample{
+		{Value: 1, Timestamp: 1000},
+		{Value: 2, Timestamp: 2000},
+		{Value: 3, Timestamp: 3000},
+		{Value: 4, Timestamp: 4000},
+	}, mergePBSamples(a, b))
+	require.Equal(t, a, mergePBSamples(a, nil))
+}
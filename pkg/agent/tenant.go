@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/juju/errors"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/rancher/prometheus-auth/pkg/kube"
+)
+
+const (
+	tenantMappingProject   = "project"
+	tenantMappingNamespace = "namespace"
+	tenantMappingTemplate  = "template"
+
+	tenantHeaderContextKey = "_tenantHeader_"
+	// the bypassed callers pick the tenants by themselves
+	tenantPassThroughContextKey = "_tenantPassThrough_"
+
+	// Cortex, Thanos and Mimir accept multiple tenants separated by '|' for the queries
+	tenantSeparator = "|"
+)
+
+type tenantConfig struct {
+	header          string
+	mapping         string
+	template        string
+	rewriteMatchers bool
+}
+
+func (c *tenantConfig) enabled() bool {
+	return c != nil && len(c.mapping) != 0
+}
+
+func (c *tenantConfig) String() string {
+	if !c.enabled() {
+		return ""
+	}
+
+	ret := fmt.Sprintf(" injecting %q by %s", c.header, c.mapping)
+	if !c.rewriteMatchers {
+		ret += " without rewriting matchers"
+	}
+
+	return ret
+}
+
+// tenantResolver maps the namespaces of the caller to the org IDs of a multi-tenant upstream.
+type tenantResolver struct {
+	header     string
+	mapping    string
+	template   *template.Template
+	namespaces kube.Namespaces
+}
+
+type tenantTemplateData struct {
+	Namespace string
+	ProjectID string
+}
+
+func newTenantResolver(cfg *tenantConfig, namespaces kube.Namespaces) (*tenantResolver, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+
+	if len(cfg.header) == 0 {
+		return nil, errors.New("blank tenant header")
+	}
+
+	ret := &tenantResolver{
+		header:     cfg.header,
+		mapping:    cfg.mapping,
+		namespaces: namespaces,
+	}
+
+	switch cfg.mapping {
+	case tenantMappingProject, tenantMappingNamespace:
+	case tenantMappingTemplate:
+		tmpl, err := template.New("tenant").Option("missingkey=error").Parse(cfg.template)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to parse tenant template")
+		}
+		ret.template = tmpl
+	default:
+		return nil, errors.Errorf("unknown tenant mapping %q", cfg.mapping)
+	}
+
+	return ret, nil
+}
+
+func (t *tenantResolver) resolve(namespaceSet data.Set) ([]string, error) {
+	tenants := data.Set{}
+
+	for _, namespace := range namespaceSet.Values() {
+		projectID, _ := t.namespaces.ProjectID(namespace)
+
+		var tenant string
+		switch t.mapping {
+		case tenantMappingProject:
+			tenant = projectID
+		case tenantMappingNamespace:
+			tenant = namespace
+		case tenantMappingTemplate:
+			sb := &strings.Builder{}
+			if err := t.template.Execute(sb, &tenantTemplateData{Namespace: namespace, ProjectID: projectID}); err != nil {
+				return nil, errors.Annotatef(err, "unable to render tenant of namespace %s", namespace)
+			}
+			tenant = strings.TrimSpace(sb.String())
+		}
+
+		if len(tenant) != 0 {
+			tenants[tenant] = struct{}{}
+		}
+	}
+
+	return tenants.Values(), nil
+}
+
+type tenantHeader struct {
+	name  string
+	value string
+}
+
+func newTenantHeader(name string, tenants []string) *tenantHeader {
+	sortedTenants := append([]string(nil), tenants...)
+	sort.Strings(sortedTenants)
+
+	return &tenantHeader{
+		name:  name,
+		value: strings.Join(sortedTenants, tenantSeparator),
+	}
+}
+
+// tenantRoundTripper sets the tenant header resolved for the caller, a header sent by the caller
+// is never passed through, e.g. to the whitelisted paths, unless the caller is bypassed.
+type tenantRoundTripper struct {
+	header string
+	next   http.RoundTripper
+}
+
+func (rt *tenantRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	header, ok := req.Context().Value(tenantHeaderContextKey).(*tenantHeader)
+	if !ok {
+		passThrough, _ := req.Context().Value(tenantPassThroughContextKey).(bool)
+		if len(rt.header) == 0 || passThrough || len(req.Header.Values(rt.header)) == 0 {
+			return rt.next.RoundTrip(req)
+		}
+
+		req = req.Clone(req.Context())
+		req.Header.Del(rt.header)
+		return rt.next.RoundTrip(req)
+	}
+
+	if len(header.value) == 0 {
+		return nil, errors.Errorf("no tenant to set in %s", header.name)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(header.name, header.value)
+
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,191 @@
+//go:build test
+
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tenantResolver(t *testing.T) {
+	namespaceSet := data.NewSet("ns-a", "ns-b", "ns-c", "ns-unknown")
+
+	testCases := []struct {
+		cfg    *tenantConfig
+		expect []string
+	}{
+		{
+			cfg:    &tenantConfig{header: "X-Scope-OrgID", mapping: tenantMappingProject},
+			expect: []string{"p-ab", "p-c"},
+		},
+		{
+			cfg:    &tenantConfig{header: "X-Scope-OrgID", mapping: tenantMappingNamespace},
+			expect: []string{"ns-a", "ns-b", "ns-c", "ns-unknown"},
+		},
+		{
+			cfg:    &tenantConfig{header: "X-Scope-OrgID", mapping: tenantMappingTemplate, template: `{{ if .ProjectID }}c-1-{{ .ProjectID }}{{ end }}`},
+			expect: []string{"c-1-p-ab", "c-1-p-c"},
+		},
+	}
+
+	for _, tc := range testCases {
+		resolver, err := newTenantResolver(tc.cfg, mockOwnedNamespaces())
+		require.NoError(t, err, tc.cfg.mapping)
+
+		tenants, err := resolver.resolve(namespaceSet)
+		require.NoError(t, err, tc.cfg.mapping)
+		require.Equal(t, tc.expect, tenants, tc.cfg.mapping)
+	}
+
+	resolver, err := newTenantResolver(&tenantConfig{}, mockOwnedNamespaces())
+	require.NoError(t, err)
+	require.Nil(t, resolver)
+
+	_, err = newTenantResolver(&tenantConfig{header: "X-Scope-OrgID", mapping: "cluster"}, mockOwnedNamespaces())
+	require.Error(t, err)
+}
+
+func Test_tenantRoundTripper(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Values("X-Scope-OrgID")
+	}))
+	defer server.Close()
+
+	rt := &tenantRoundTripper{header: "X-Scope-OrgID", next: http.DefaultTransport}
+
+	testCases := []struct {
+		name        string
+		header      *tenantHeader
+		passThrough bool
+		expect      []string
+	}{
+		{
+			name: "not resolved",
+		},
+		{
+			name:        "bypassed",
+			passThrough: true,
+			expect:      []string{"caller"},
+		},
+		{
+			name:   "override",
+			header: newTenantHeader("X-Scope-OrgID", []string{"p-c", "p-ab"}),
+			expect: []string{"p-ab|p-c"},
+		},
+	}
+
+	for _, tc := range testCases {
+		ctx := context.Background()
+		if tc.header != nil {
+			ctx = context.WithValue(ctx, tenantHeaderContextKey, tc.header)
+		}
+		if tc.passThrough {
+			ctx = context.WithValue(ctx, tenantPassThroughContextKey, true)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Scope-OrgID", "caller")
+
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err, tc.name)
+		resp.Body.Close()
+
+		require.Equal(t, tc.expect, received, tc.name)
+	}
+
+	// the request never reaches the upstream without a tenant
+	received = nil
+	req, err := http.NewRequestWithContext(context.WithValue(context.Background(), tenantHeaderContextKey, newTenantHeader("X-Scope-OrgID", nil)), http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Scope-OrgID", "caller")
+	_, err = rt.RoundTrip(req)
+	require.Error(t, err)
+	require.Nil(t, received)
+}
+
+func Test_accessControlTenants(t *testing.T) {
+	agt := mockAgent(t)
+	agt.cfg.tenant = &tenantConfig{header: "X-Scope-OrgID", mapping: tenantMappingProject, rewriteMatchers: true}
+	tenants, err := newTenantResolver(agt.cfg.tenant, agt.namespaces)
+	require.NoError(t, err)
+	agt.tenants = tenants
+
+	var received *tenantHeader
+	handler := accessControl(agt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = r.Context().Value(tenantHeaderContextKey).(*tenantHeader)
+	}))
+
+	testCases := []struct {
+		token  string
+		code   int
+		expect *tenantHeader
+	}{
+		{
+			token:  "someNamespacesToken",
+			code:   http.StatusOK,
+			expect: &tenantHeader{name: "X-Scope-OrgID", value: "p-ab"},
+		},
+		{
+			// the upstream must not fall back to its default tenant
+			token: "noneNamespacesToken",
+			code:  http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		received = nil
+		req := httptest.NewRequest(http.MethodGet, "/federate?match[]=up", nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		res := httptest.NewRecorder()
+
+		handler.ServeHTTP(res, req)
+
+		require.Equal(t, tc.code, res.Code, tc.token)
+		require.Equal(t, tc.expect, received, tc.token)
+	}
+}
+
+func Test_tenantWhitelistedPaths(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Values("X-Scope-OrgID")
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	agt := mockAgent(t)
+	agt.cfg.proxyURL = serverURL
+	agt.cfg.tenant = &tenantConfig{header: "X-Scope-OrgID", mapping: tenantMappingProject, rewriteMatchers: true}
+	agt.tenants, err = newTenantResolver(agt.cfg.tenant, agt.namespaces)
+	require.NoError(t, err)
+	agt.upstream, err = newUpstream([]*url.URL{serverURL}, &upstreamConfig{tenantHeader: "X-Scope-OrgID"})
+	require.NoError(t, err)
+	handler := agt.httpBackend()
+
+	// a forged tenant never reaches the upstream
+	received = nil
+	req := httptest.NewRequest(http.MethodGet, "/rules", nil)
+	req.Header.Set("X-Scope-OrgID", "p-c")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Nil(t, received)
+
+	// the bypassed callers pick the tenants by themselves
+	received = nil
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/status/buildinfo", nil)
+	req.Header.Set(authorizationHeaderKey, "Bearer myToken")
+	req.Header.Set("X-Scope-OrgID", "p-c")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, []string{"p-c"}, received)
+}
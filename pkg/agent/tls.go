@@ -0,0 +1,277 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cmux"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	authentication "k8s.io/api/authentication/v1"
+)
+
+const (
+	tlsStateContextKey = "_tlsState_"
+)
+
+type tlsConfig struct {
+	certFile          string
+	keyFile           string
+	clientCAFile      string
+	requireClientCert bool
+	reloadInterval    time.Duration
+}
+
+func (c *tlsConfig) enabled() bool {
+	return c != nil && len(c.certFile) != 0 && len(c.keyFile) != 0
+}
+
+// certificateReloader keeps the serving certificate and the client CA bundle
+// in sync with the files on disk, so that rotated certificates are picked up
+// without restarting the agent.
+type certificateReloader struct {
+	cfg *tlsConfig
+
+	sync.RWMutex
+	certificate   *tls.Certificate
+	clientCAs     *x509.CertPool
+	certModTime   time.Time
+	keyModTime    time.Time
+	clientModTime time.Time
+}
+
+func newCertificateReloader(cfg *tlsConfig) (*certificateReloader, error) {
+	r := &certificateReloader{
+		cfg: cfg,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certificateReloader) reload() error {
+	certModTime, err := modTime(r.cfg.certFile)
+	if err != nil {
+		return errors.Annotatef(err, "unable to stat TLS certificate %s", r.cfg.certFile)
+	}
+	keyModTime, err := modTime(r.cfg.keyFile)
+	if err != nil {
+		return errors.Annotatef(err, "unable to stat TLS key %s", r.cfg.keyFile)
+	}
+
+	r.RLock()
+	certChanged := r.certificate == nil || !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime)
+	r.RUnlock()
+
+	if certChanged {
+		certificate, err := tls.LoadX509KeyPair(r.cfg.certFile, r.cfg.keyFile)
+		if err != nil {
+			return errors.Annotatef(err, "unable to load TLS key pair %s, %s", r.cfg.certFile, r.cfg.keyFile)
+		}
+
+		r.Lock()
+		r.certificate = &certificate
+		r.certModTime = certModTime
+		r.keyModTime = keyModTime
+		r.Unlock()
+
+		log.Infof("Loaded TLS certificate from %s", r.cfg.certFile)
+	}
+
+	if len(r.cfg.clientCAFile) == 0 {
+		return nil
+	}
+
+	clientModTime, err := modTime(r.cfg.clientCAFile)
+	if err != nil {
+		return errors.Annotatef(err, "unable to stat TLS client CA %s", r.cfg.clientCAFile)
+	}
+
+	r.RLock()
+	clientChanged := r.clientCAs == nil || !clientModTime.Equal(r.clientModTime)
+	r.RUnlock()
+
+	if clientChanged {
+		clientCAs, err := loadCertPool(r.cfg.clientCAFile)
+		if err != nil {
+			return err
+		}
+
+		r.Lock()
+		r.clientCAs = clientCAs
+		r.clientModTime = clientModTime
+		r.Unlock()
+
+		log.Infof("Loaded TLS client CA from %s", r.cfg.clientCAFile)
+	}
+
+	return nil
+}
+
+func (r *certificateReloader) run(ctx context.Context) {
+	interval := r.cfg.reloadInterval
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				log.WithError(err).Warn("Failed to reload TLS certificates, keep serving the previous ones")
+			}
+		}
+	}
+}
+
+func (r *certificateReloader) tlsConfig() *tls.Config {
+	r.RLock()
+	defer r.RUnlock()
+
+	ret := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{*r.certificate},
+	}
+
+	if r.clientCAs != nil {
+		ret.ClientCAs = r.clientCAs
+		ret.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.cfg.requireClientCert {
+			ret.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return ret
+}
+
+func (r *certificateReloader) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	return r.tlsConfig(), nil
+}
+
+func createTLSListener(ctx context.Context, listener net.Listener, cfg *tlsConfig) (net.Listener, error) {
+	reloader, err := newCertificateReloader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.run(ctx)
+
+	serverTLSConfig := reloader.tlsConfig()
+	serverTLSConfig.GetConfigForClient = reloader.getConfigForClient
+
+	return tls.NewListener(listener, serverTLSConfig), nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read CA bundle %s", caFile)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, errors.Errorf("no valid certificate found in CA bundle %s", caFile)
+	}
+
+	return pool, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
+
+// tlsStateConn exposes the TLS state of a multiplexed connection,
+// so that the HTTP/2 server can populate http.Request.TLS.
+type tlsStateConn struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c *tlsStateConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func connectionState(c net.Conn) *tls.ConnectionState {
+	for {
+		switch conn := c.(type) {
+		case *tls.Conn:
+			state := conn.ConnectionState()
+			return &state
+		case *tlsStateConn:
+			return &conn.state
+		case *cmux.MuxConn:
+			c = conn.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+func withConnectionState(ctx context.Context, c net.Conn) context.Context {
+	state := connectionState(c)
+	if state == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, tlsStateContextKey, state)
+}
+
+func requestConnectionState(r *http.Request) *tls.ConnectionState {
+	if r.TLS != nil {
+		return r.TLS
+	}
+
+	state, _ := r.Context().Value(tlsStateContextKey).(*tls.ConnectionState)
+	return state
+}
+
+// userInfoFromConnectionState maps a verified client certificate to a user identity,
+// the common name (or the first SAN) becomes the username and the organizations become the groups.
+func userInfoFromConnectionState(state *tls.ConnectionState) (authentication.UserInfo, bool) {
+	var userInfo authentication.UserInfo
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return userInfo, false
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	username := cert.Subject.CommonName
+	if len(username) == 0 {
+		switch {
+		case len(cert.URIs) != 0:
+			username = cert.URIs[0].String()
+		case len(cert.DNSNames) != 0:
+			username = cert.DNSNames[0]
+		case len(cert.EmailAddresses) != 0:
+			username = cert.EmailAddresses[0]
+		}
+	}
+	if len(username) == 0 {
+		return userInfo, false
+	}
+
+	userInfo.Username = username
+	userInfo.Groups = append(userInfo.Groups, cert.Subject.Organization...)
+
+	return userInfo, true
+}
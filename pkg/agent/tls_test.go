@@ -0,0 +1,175 @@
+//go:build test
+
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func generateCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	return cert, key, certPEM, keyPEM
+}
+
+func newCertificateTemplate(serial int64, commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+func Test_certificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-auth-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caTemplate := newCertificateTemplate(1, "test-ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, caKey, caPEM, _ := generateCertificate(t, caTemplate, nil, nil)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	_, _, certPEM, keyPEM := generateCertificate(t, newCertificateTemplate(2, "serving-1"), ca, caKey)
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	reloader, err := newCertificateReloader(&tlsConfig{
+		certFile:          certFile,
+		keyFile:           keyFile,
+		clientCAFile:      caFile,
+		requireClientCert: true,
+	})
+	require.NoError(t, err)
+
+	cfg, err := reloader.getConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	require.Equal(t, []string{"h2", "http/1.1"}, cfg.NextProtos)
+	leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "serving-1", leaf.Subject.CommonName)
+
+	// rotate
+	_, _, certPEM, keyPEM = generateCertificate(t, newCertificateTemplate(3, "serving-2"), ca, caKey)
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	require.NoError(t, reloader.reload())
+
+	cfg, err = reloader.getConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	leaf, err = x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "serving-2", leaf.Subject.CommonName)
+
+	// broken files keep the previous certificate
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("broken"), 0600))
+	later := future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.Error(t, reloader.reload())
+
+	cfg, err = reloader.getConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	leaf, err = x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "serving-2", leaf.Subject.CommonName)
+}
+
+func Test_userInfoFromConnectionState(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://cluster.local/ns/ns-a/sa/grafana")
+	require.NoError(t, err)
+
+	withCN := newCertificateTemplate(1, "alice")
+	withCN.Subject.Organization = []string{"sre", "dev"}
+	withURI := newCertificateTemplate(2, "")
+	withURI.URIs = []*url.URL{spiffeID}
+	withNothing := newCertificateTemplate(3, "")
+
+	testCases := []struct {
+		name   string
+		state  *tls.ConnectionState
+		expect string
+		groups []string
+		ok     bool
+	}{
+		{
+			name: "no TLS",
+		},
+		{
+			name:  "not verified",
+			state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{withCN}},
+		},
+		{
+			name:   "common name",
+			state:  &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{withCN}}},
+			expect: "alice",
+			groups: []string{"sre", "dev"},
+			ok:     true,
+		},
+		{
+			name:   "URI SAN",
+			state:  &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{withURI}}},
+			expect: "spiffe://cluster.local/ns/ns-a/sa/grafana",
+			ok:     true,
+		},
+		{
+			name:  "no identity",
+			state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{withNothing}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		userInfo, ok := userInfoFromConnectionState(tc.state)
+		if ok != tc.ok {
+			t.Errorf("%s: got %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if userInfo.Username != tc.expect {
+			t.Errorf("%s: got username %q, want %q", tc.name, userInfo.Username, tc.expect)
+		}
+		if len(tc.groups) != 0 {
+			require.Equal(t, tc.groups, userInfo.Groups, tc.name)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+type upstreamConfig struct {
+	caFile                string
+	certFile              string
+	keyFile               string
+	serverName            string
+	insecureSkipVerify    bool
+	bearerTokenFile       string
+	basicAuthUsername     string
+	basicAuthPasswordFile string
+	routing               string
+	healthCheckInterval   time.Duration
+	tenantHeader          string
+}
+
+func (c *upstreamConfig) String() string {
+	sb := &strings.Builder{}
+
+	if len(c.caFile) != 0 {
+		sb.WriteString(fmt.Sprintf(" trusting CA %s", c.caFile))
+	}
+	if len(c.certFile) != 0 {
+		sb.WriteString(fmt.Sprintf(" presenting client certificate %s", c.certFile))
+	}
+	if len(c.routing) != 0 {
+		sb.WriteString(fmt.Sprintf(" routing %s", c.routing))
+	}
+	if c.insecureSkipVerify {
+		sb.WriteString(" skipping TLS verification")
+	}
+	if len(c.bearerTokenFile) != 0 {
+		sb.WriteString(fmt.Sprintf(" authenticating with bearer token %s", c.bearerTokenFile))
+	} else if len(c.basicAuthUsername) != 0 {
+		sb.WriteString(fmt.Sprintf(" authenticating with basic auth user %s", c.basicAuthUsername))
+	}
+
+	return sb.String()
+}
+
+// upstream holds the transport settings shared by the reverse proxy, the Prometheus API client and the gRPC backend.
+type upstream struct {
+	tlsConfig           *tls.Config
+	credentials         *upstreamCredentials
+	replicas            *replicaPool
+	transport           http.RoundTripper
+	baseTransport       http.RoundTripper
+	healthCheckInterval time.Duration
+}
+
+func newUpstream(proxyURLs []*url.URL, cfg *upstreamConfig) (*upstream, error) {
+	ret := &upstream{
+		healthCheckInterval: cfg.healthCheckInterval,
+	}
+
+	httpsScheme := false
+	for _, proxyURL := range proxyURLs {
+		httpsScheme = httpsScheme || proxyURL.Scheme == "https"
+	}
+
+	if httpsScheme || len(cfg.caFile) != 0 || len(cfg.certFile) != 0 || len(cfg.serverName) != 0 || cfg.insecureSkipVerify {
+		tlsConfig, err := createUpstreamTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ret.tlsConfig = tlsConfig
+	}
+
+	if len(cfg.bearerTokenFile) != 0 && len(cfg.basicAuthUsername) != 0 {
+		return nil, errors.New("bearer token and basic auth are mutually exclusive for upstream")
+	}
+	if len(cfg.bearerTokenFile) != 0 {
+		ret.credentials = &upstreamCredentials{
+			secret: &secretFile{path: cfg.bearerTokenFile},
+		}
+	} else if len(cfg.basicAuthUsername) != 0 {
+		ret.credentials = &upstreamCredentials{
+			username: cfg.basicAuthUsername,
+			secret:   &secretFile{path: cfg.basicAuthPasswordFile},
+		}
+	}
+	if ret.credentials != nil {
+		if _, err := ret.credentials.authorization(); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = ret.tlsConfig
+	var roundTripper http.RoundTripper = transport
+	if ret.credentials != nil {
+		roundTripper = &authRoundTripper{
+			credentials: ret.credentials,
+			next:        transport,
+		}
+	}
+	roundTripper = &tenantRoundTripper{header: cfg.tenantHeader, next: roundTripper}
+
+	replicas, err := newReplicaPool(proxyURLs, cfg.routing, roundTripper)
+	if err != nil {
+		return nil, err
+	}
+	ret.replicas = replicas
+	ret.transport = replicas
+	ret.baseTransport = roundTripper
+
+	return ret, nil
+}
+
+func (u *upstream) run(ctx context.Context) {
+	u.replicas.run(ctx, u.healthCheckInterval)
+}
+
+func createUpstreamTLSConfig(cfg *upstreamConfig) (*tls.Config, error) {
+	ret := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.serverName,
+		InsecureSkipVerify: cfg.insecureSkipVerify,
+	}
+
+	if len(cfg.caFile) != 0 {
+		rootCAs, err := loadCertPool(cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.RootCAs = rootCAs
+	}
+
+	if (len(cfg.certFile) == 0) != (len(cfg.keyFile) == 0) {
+		return nil, errors.New("upstream client certificate and key must be set together")
+	}
+	if len(cfg.certFile) != 0 {
+		// reload the client certificate on every handshake, so that rotated certificates are picked up
+		certFile, keyFile := cfg.certFile, cfg.keyFile
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, errors.Annotatef(err, "unable to load upstream client key pair %s, %s", certFile, keyFile)
+		}
+		ret.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, errors.Annotatef(err, "unable to load upstream client key pair %s, %s", certFile, keyFile)
+			}
+			return &certificate, nil
+		}
+	}
+
+	return ret, nil
+}
+
+func (u *upstream) roundTripper() http.RoundTripper {
+	if u == nil {
+		return http.DefaultTransport
+	}
+
+	return u.transport
+}
+
+// shardRoundTripper carries the upstream TLS and auth settings without routing among the replicas.
+func (u *upstream) shardRoundTripper() http.RoundTripper {
+	if u == nil {
+		return http.DefaultTransport
+	}
+
+	return u.baseTransport
+}
+
+func (u *upstream) grpcDialOptions() []grpc.DialOption {
+	if u == nil {
+		return []grpc.DialOption{grpc.WithInsecure()}
+	}
+
+	ret := make([]grpc.DialOption, 0, 2)
+	if u.tlsConfig != nil {
+		ret = append(ret, grpc.WithTransportCredentials(credentials.NewTLS(u.tlsConfig.Clone())))
+	} else {
+		ret = append(ret, grpc.WithInsecure())
+	}
+	if u.credentials != nil {
+		ret = append(ret, grpc.WithPerRPCCredentials(u.credentials))
+	}
+
+	return ret
+}
+
+// upstreamCredentials injects either a bearer token or basic auth into the upstream requests.
+type upstreamCredentials struct {
+	username string
+	secret   *secretFile
+}
+
+func (c *upstreamCredentials) authorization() (string, error) {
+	secret, err := c.secret.get()
+	if err != nil {
+		return "", err
+	}
+
+	if len(c.username) != 0 {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+secret)), nil
+	}
+
+	return "Bearer " + secret, nil
+}
+
+func (c *upstreamCredentials) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	authorization, err := c.authorization()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"authorization": authorization}, nil
+}
+
+func (c *upstreamCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+type authRoundTripper struct {
+	credentials *upstreamCredentials
+	next        http.RoundTripper
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	authorization, err := rt.credentials.authorization()
+	if err != nil {
+		return nil, err
+	}
+
+	// the caller's token must not leak to the upstream
+	req = req.Clone(req.Context())
+	req.Header.Set(authorizationHeaderKey, authorization)
+
+	return rt.next.RoundTrip(req)
+}
+
+// secretFile reads a secret from a file and re-reads it once the file changes.
+type secretFile struct {
+	path string
+
+	sync.Mutex
+	modTime time.Time
+	value   string
+}
+
+func (f *secretFile) get() (string, error) {
+	mt, err := modTime(f.path)
+	if err != nil {
+		return "", errors.Annotatef(err, "unable to stat secret file %s", f.path)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.value) != 0 && mt.Equal(f.modTime) {
+		return f.value, nil
+	}
+
+	valueBytes, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", errors.Annotatef(err, "unable to read secret file %s", f.path)
+	}
+	value := strings.TrimSpace(string(valueBytes))
+	if len(value) == 0 {
+		return "", errors.Errorf("read empty secret from file %s", f.path)
+	}
+
+	f.value = value
+	f.modTime = mt
+
+	return value, nil
+}
@@ -0,0 +1,92 @@
+//go:build test
+
+package agent
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_upstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-auth-upstream")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var receivedAuthorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedAuthorization = r.Header.Get(authorizationHeaderKey)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("upstream-token\n"), 0600))
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(passwordFile, []byte("secret"), 0600))
+
+	testCases := []struct {
+		name   string
+		cfg    *upstreamConfig
+		expect string
+		failed bool
+	}{
+		{
+			name:   "unknown CA",
+			cfg:    &upstreamConfig{},
+			failed: true,
+		},
+		{
+			name:   "insecure",
+			cfg:    &upstreamConfig{insecureSkipVerify: true},
+			expect: "Bearer caller-token",
+		},
+		{
+			name:   "bearer token",
+			cfg:    &upstreamConfig{caFile: caFile, bearerTokenFile: tokenFile},
+			expect: "Bearer upstream-token",
+		},
+		{
+			name:   "basic auth",
+			cfg:    &upstreamConfig{caFile: caFile, basicAuthUsername: "prometheus", basicAuthPasswordFile: passwordFile},
+			expect: "Basic cHJvbWV0aGV1czpzZWNyZXQ=",
+		},
+	}
+
+	for _, tc := range testCases {
+		receivedAuthorization = ""
+
+		u, err := newUpstream([]*url.URL{serverURL}, tc.cfg)
+		require.NoError(t, err, tc.name)
+
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err, tc.name)
+		req.Header.Set(authorizationHeaderKey, "Bearer caller-token")
+
+		resp, err := u.roundTripper().RoundTrip(req)
+		if tc.failed {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		resp.Body.Close()
+
+		require.Equal(t, tc.expect, receivedAuthorization, tc.name)
+		require.Equal(t, "Bearer caller-token", req.Header.Get(authorizationHeaderKey), tc.name)
+	}
+
+	_, err = newUpstream([]*url.URL{serverURL}, &upstreamConfig{bearerTokenFile: tokenFile, basicAuthUsername: "prometheus"})
+	require.Error(t, err)
+}
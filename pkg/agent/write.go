@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/golang/snappy"
+	"github.com/juju/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the whole write request is refused
+	writeModeReject = "reject"
+	// the unauthorized series are dropped, the others are written
+	writeModeDrop = "drop"
+	// the unauthorized series are moved into the only namespace of the caller
+	writeModeRelabel = "relabel"
+
+	exportedNamespaceLabelName = "exported_namespace"
+)
+
+func validateWriteMode(mode string) error {
+	switch mode {
+	case writeModeReject, writeModeDrop, writeModeRelabel:
+		return nil
+	}
+
+	return errors.Errorf("unknown write mode %q, expected one of %s, %s or %s", mode, writeModeReject, writeModeDrop, writeModeRelabel)
+}
+
+func hijackWrite(apiCtx *apiContext) error {
+	req := apiCtx.request
+
+	// pre check
+	wreq, err := remote.DecodeWriteRequest(req.Body)
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+
+	var startMs, endMs int64 = math.MaxInt64, math.MinInt64
+	for _, ts := range wreq.Timeseries {
+		for _, sample := range ts.Samples {
+			if sample.Timestamp < startMs {
+				startMs = sample.Timestamp
+			}
+			if sample.Timestamp > endMs {
+				endMs = sample.Timestamp
+			}
+		}
+	}
+	if startMs <= endMs {
+		// the samples are only written into the namespaces belonging to the caller at their timestamps
+		apiCtx.restrictPeriod(timestamp.Time(startMs), timestamp.Time(endMs))
+	}
+
+	// hijack
+	series := wreq.Timeseries[:0]
+	dropped := 0
+	for _, ts := range wreq.Timeseries {
+		pbLabels, err := apiCtx.enforceWriteNamespace(ts.Labels)
+		if err != nil {
+			if apiCtx.writeMode != writeModeDrop {
+				return errors.Wrap(err, badRequestErr)
+			}
+			dropped++
+			continue
+		}
+		ts.Labels = pbLabels
+		series = append(series, ts)
+	}
+	if dropped != 0 {
+		log.Warnf("write[%s] dropped %d series outside of namespaces [%s]", apiCtx.tag, dropped, apiCtx.namespaceSet)
+	}
+
+	// quick response
+	if len(series) == 0 {
+		apiCtx.Do(func() {
+			apiCtx.response.WriteHeader(http.StatusNoContent)
+		})
+		return nil
+	}
+	wreq.Timeseries = series
+
+	// inject
+	marshaledData, err := wreq.Marshal()
+	if err != nil {
+		return errors.Wrap(err, badRequestErr)
+	}
+	compressedData := snappy.Encode(nil, marshaledData)
+
+	// proxy
+	newReq, err := http.NewRequest(http.MethodPost, req.URL.String(), bytes.NewBuffer(compressedData))
+	if err != nil {
+		return errors.Wrap(err, internalErr)
+	}
+	newReq.Header = req.Header.Clone()
+	newReq.Header.Del("Content-Length")
+
+	return apiCtx.proxyWith(newReq)
+}
+
+// enforceWriteNamespace returns the labels of a series written into the namespaces of the caller,
+// the namespace is injected if missing and unambiguous.
+func (c *apiContext) enforceWriteNamespace(pbLabels []prompb.Label) ([]prompb.Label, error) {
+	onlyNamespace := ""
+	if len(c.namespaceSet) == 1 {
+		onlyNamespace = c.namespaceSet.Values()[0]
+	}
+
+	namespace := prompbLabelValue(pbLabels, namespaceLabelName)
+	if _, exist := c.namespaceSet[namespace]; exist && len(namespace) != 0 {
+		return pbLabels, nil
+	}
+
+	if len(namespace) == 0 {
+		if len(onlyNamespace) == 0 {
+			return nil, errors.Errorf("series %s has no namespace, which is ambiguous for %d namespaces", prompbLabelsKey(pbLabels), len(c.namespaceSet))
+		}
+		// an explicit empty namespace is replaced, a duplicated label is rejected by the upstream
+		ret := make([]prompb.Label, 0, len(pbLabels)+1)
+		for _, l := range pbLabels {
+			if l.Name != namespaceLabelName {
+				ret = append(ret, l)
+			}
+		}
+		return sortPBLabels(append(ret, prompb.Label{Name: namespaceLabelName, Value: onlyNamespace})), nil
+	}
+
+	if c.writeMode != writeModeRelabel || len(onlyNamespace) == 0 {
+		return nil, errors.Errorf("series %s is outside of the authorized namespaces", prompbLabelsKey(pbLabels))
+	}
+
+	ret := make([]prompb.Label, 0, len(pbLabels)+1)
+	for _, l := range pbLabels {
+		switch l.Name {
+		case exportedNamespaceLabelName:
+			continue
+		case namespaceLabelName:
+			ret = append(ret,
+				prompb.Label{Name: namespaceLabelName, Value: onlyNamespace},
+				prompb.Label{Name: exportedNamespaceLabelName, Value: namespace},
+			)
+		default:
+			ret = append(ret, l)
+		}
+	}
+
+	return sortPBLabels(ret), nil
+}
+
+// sortPBLabels sorts the labels by name, as the upstream expects.
+func sortPBLabels(pbLabels []prompb.Label) []prompb.Label {
+	sort.Slice(pbLabels, func(i, j int) bool {
+		return pbLabels[i].Name < pbLabels[j].Name
+	})
+
+	return pbLabels
+}
@@ -0,0 +1,111 @@
+//go:build test
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_hijackWrite(t *testing.T) {
+	var written *prompb.WriteRequest
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		written, err = remote.DecodeWriteRequest(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	newSeries := func(pairs ...string) prompb.TimeSeries {
+		ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}}
+		for i := 0; i < len(pairs); i += 2 {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: pairs[i], Value: pairs[i+1]})
+		}
+		return ts
+	}
+
+	serve := func(mode string, namespaceSet data.Set, series ...prompb.TimeSeries) *httptest.ResponseRecorder {
+		written = nil
+		reqBuf, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, reqBuf)))
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		res := httptest.NewRecorder()
+		apiCtx := &apiContext{
+			response:     res,
+			request:      req,
+			proxyHandler: upstream,
+			namespaceSet: namespaceSet,
+			writeMode:    mode,
+		}
+		apiContextHandler(hijackWrite).ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiContextKey, apiCtx)))
+		return res
+	}
+
+	// the only namespace is injected
+	res := serve(writeModeReject, data.NewSet("ns-a"),
+		newSeries("__name__", "job_duration_seconds", "job", "backup"),
+		newSeries("__name__", "job_duration_seconds", "namespace", "ns-a"),
+	)
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Len(t, written.Timeseries, 2)
+	require.Equal(t, []prompb.Label{{Name: "__name__", Value: "job_duration_seconds"}, {Name: "job", Value: "backup"}, {Name: "namespace", Value: "ns-a"}}, written.Timeseries[0].Labels)
+
+	// an explicit empty namespace is replaced rather than duplicated
+	res = serve(writeModeReject, data.NewSet("ns-a"), newSeries("__name__", "job_duration_seconds", "namespace", "", "job", "backup"))
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Equal(t, []prompb.Label{{Name: "__name__", Value: "job_duration_seconds"}, {Name: "job", Value: "backup"}, {Name: "namespace", Value: "ns-a"}}, written.Timeseries[0].Labels)
+
+	// the whole request is refused
+	res = serve(writeModeReject, data.NewSet("ns-a"),
+		newSeries("__name__", "job_duration_seconds", "namespace", "ns-a"),
+		newSeries("__name__", "job_duration_seconds", "namespace", "ns-b"),
+	)
+	require.Equal(t, http.StatusBadRequest, res.Code)
+	require.Contains(t, res.Body.String(), "outside of the authorized namespaces")
+	require.Nil(t, written)
+
+	// the missing namespace is ambiguous
+	res = serve(writeModeReject, data.NewSet("ns-a", "ns-b"), newSeries("__name__", "job_duration_seconds"))
+	require.Equal(t, http.StatusBadRequest, res.Code)
+	require.Nil(t, written)
+
+	// the unauthorized series are dropped
+	res = serve(writeModeDrop, data.NewSet("ns-a", "ns-b"),
+		newSeries("__name__", "job_duration_seconds", "namespace", "ns-b"),
+		newSeries("__name__", "job_duration_seconds", "namespace", "ns-c"),
+		newSeries("__name__", "job_duration_seconds"),
+	)
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Len(t, written.Timeseries, 1)
+	require.Equal(t, "ns-b", prompbLabelValue(written.Timeseries[0].Labels, namespaceLabelName))
+
+	// nothing is left to write
+	res = serve(writeModeDrop, data.NewSet(), newSeries("__name__", "job_duration_seconds", "namespace", "ns-a"))
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Nil(t, written)
+
+	// the unauthorized series are moved into the only namespace
+	res = serve(writeModeRelabel, data.NewSet("ns-a"), newSeries("__name__", "job_duration_seconds", "namespace", "ns-x", "exported_namespace", "ns-y"))
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "job_duration_seconds"},
+		{Name: "exported_namespace", Value: "ns-x"},
+		{Name: "namespace", Value: "ns-a"},
+	}, written.Timeseries[0].Labels)
+
+	require.NoError(t, validateWriteMode(writeModeRelabel))
+	require.Error(t, validateWriteMode("ignore"))
+}
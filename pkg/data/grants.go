@@ -0,0 +1,108 @@
+package data
+
+import (
+	"time"
+)
+
+// Period is a time range of [Since, Until), the zero Since is unbounded in the past
+// and the zero Until is unbounded in the future.
+type Period struct {
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+}
+
+// Covers returns true if the whole range of [start, end] is within the period.
+func (p Period) Covers(start, end time.Time) bool {
+	if !p.Since.IsZero() && start.Before(p.Since) {
+		return false
+	}
+	if !p.Until.IsZero() && !end.Before(p.Until) {
+		return false
+	}
+
+	return true
+}
+
+// Overlaps returns true if any part of the range of [start, end] is within the period.
+func (p Period) Overlaps(start, end time.Time) bool {
+	if !p.Since.IsZero() && end.Before(p.Since) {
+		return false
+	}
+	if !p.Until.IsZero() && !start.Before(p.Until) {
+		return false
+	}
+
+	return true
+}
+
+// Grants are the periods which each namespace is granted for.
+type Grants map[string][]Period
+
+// Namespaces returns the namespaces granted for any period.
+func (g Grants) Namespaces() Set {
+	ret := make(Set, len(g))
+	for namespace := range g {
+		ret[namespace] = struct{}{}
+	}
+
+	return ret
+}
+
+// Restrict returns the namespaces of the set granted for the whole range of [start, end],
+// the namespaces partially granted are left out as their data outside of the grant can't be told apart.
+func (g Grants) Restrict(namespaceSet Set, start, end time.Time) Set {
+	ret := make(Set, len(namespaceSet))
+	for namespace := range namespaceSet {
+		for _, period := range g[namespace] {
+			if period.Covers(start, end) {
+				ret[namespace] = struct{}{}
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+// Overlap returns the namespaces of the set granted for any part of the range of [start, end], and the grants of
+// the ones granted only for a part of it with the periods overlapping the range, their data has to be limited to these.
+func (g Grants) Overlap(namespaceSet Set, start, end time.Time) (Set, Grants) {
+	ret, partial := make(Set, len(namespaceSet)), Grants{}
+	for namespace := range namespaceSet {
+		var periods []Period
+		for _, period := range g[namespace] {
+			if period.Covers(start, end) {
+				periods = nil
+				ret[namespace] = struct{}{}
+				break
+			}
+			if period.Overlaps(start, end) {
+				periods = append(periods, period)
+			}
+		}
+		if len(periods) != 0 {
+			ret[namespace] = struct{}{}
+			partial[namespace] = periods
+		}
+	}
+
+	return ret, partial
+}
+
+// Since returns the earliest time which the namespaces of the set are granted since,
+// the zero time is returned if any of them is granted since ever.
+func (g Grants) Since(namespaceSet Set) time.Time {
+	var ret time.Time
+	for namespace := range namespaceSet {
+		for _, period := range g[namespace] {
+			if period.Since.IsZero() {
+				return time.Time{}
+			}
+			if ret.IsZero() || period.Since.Before(ret) {
+				ret = period.Since
+			}
+		}
+	}
+
+	return ret
+}
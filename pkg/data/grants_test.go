@@ -0,0 +1,77 @@
+//go:build test
+
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGrants(t *testing.T) {
+	moved := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	deleted := moved.Add(24 * time.Hour)
+
+	g := Grants{
+		// always in the project
+		"ns-a": {{}},
+		// moved into the project
+		"ns-b": {{Since: moved}},
+		// deleted after moving in, then recreated
+		"ns-c": {{Since: moved, Until: deleted}, {Since: deleted.Add(time.Hour)}},
+	}
+
+	testCases := []struct {
+		name       string
+		start, end time.Time
+		expect     Set
+	}{
+		{"before moving", moved.Add(-time.Hour), moved.Add(-time.Minute), NewSet("ns-a")},
+		{"across moving", moved.Add(-time.Hour), moved.Add(time.Hour), NewSet("ns-a")},
+		{"after moving", moved, moved.Add(time.Hour), NewSet("ns-a", "ns-b", "ns-c")},
+		{"at deleting", deleted, deleted, NewSet("ns-a", "ns-b")},
+		{"after recreating", deleted.Add(2 * time.Hour), deleted.Add(3 * time.Hour), NewSet("ns-a", "ns-b", "ns-c")},
+		{"across recreating", moved, deleted.Add(2 * time.Hour), NewSet("ns-a", "ns-b")},
+	}
+
+	for _, tc := range testCases {
+		if got := g.Restrict(NewSet("ns-a", "ns-b", "ns-c", "ns-x"), tc.start, tc.end); !reflect.DeepEqual(tc.expect, got) {
+			t.Errorf("%s: expect %v, but get %v", tc.name, tc.expect, got)
+		}
+	}
+
+	overlapCases := []struct {
+		name       string
+		start, end time.Time
+		expect     Set
+		partial    Grants
+	}{
+		{"before moving", moved.Add(-time.Hour), moved.Add(-time.Minute), NewSet("ns-a"), Grants{}},
+		{"across moving", moved.Add(-time.Hour), moved.Add(time.Hour), NewSet("ns-a", "ns-b", "ns-c"), Grants{
+			"ns-b": {{Since: moved}},
+			"ns-c": {{Since: moved, Until: deleted}},
+		}},
+		{"across recreating", moved, deleted.Add(2 * time.Hour), NewSet("ns-a", "ns-b", "ns-c"), Grants{
+			"ns-c": {{Since: moved, Until: deleted}, {Since: deleted.Add(time.Hour)}},
+		}},
+		{"while deleted", deleted, deleted.Add(time.Minute), NewSet("ns-a", "ns-b"), Grants{}},
+	}
+
+	for _, tc := range overlapCases {
+		got, partial := g.Overlap(NewSet("ns-a", "ns-b", "ns-c", "ns-x"), tc.start, tc.end)
+		if !reflect.DeepEqual(tc.expect, got) || !reflect.DeepEqual(tc.partial, partial) {
+			t.Errorf("%s: expect %v partially %v, but get %v partially %v", tc.name, tc.expect, tc.partial, got, partial)
+		}
+	}
+
+	if got := g.Since(NewSet("ns-b", "ns-c")); !got.Equal(moved) {
+		t.Errorf("expect the earliest grant since %v, but get %v", moved, got)
+	}
+	if got := g.Since(NewSet("ns-a", "ns-b")); !got.IsZero() {
+		t.Errorf("expect the grant since ever, but get %v", got)
+	}
+
+	if got := g.Namespaces(); !reflect.DeepEqual(NewSet("ns-a", "ns-b", "ns-c"), got) {
+		t.Errorf("expect the namespaces of all the grants, but get %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package kube
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	authentication "k8s.io/api/authentication/v1"
+	authorization "k8s.io/api/authorization/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+	clientAuthorization "k8s.io/client-go/kubernetes/typed/authorization/v1"
+)
+
+type AccessReviews interface {
+	Allowed(userInfo authentication.UserInfo, attributes authorization.ResourceAttributes) (bool, error)
+}
+
+type accessReviews struct {
+	subjectAccessReviewsClient clientAuthorization.SubjectAccessReviewInterface
+	reviewResultTTLCache       *cache.LRUExpireCache
+}
+
+func (a *accessReviews) Allowed(userInfo authentication.UserInfo, attributes authorization.ResourceAttributes) (bool, error) {
+	key := accessReviewKey(userInfo, attributes)
+	if allowed, exist := a.reviewResultTTLCache.Get(key); exist {
+		return allowed.(bool), nil
+	}
+
+	extra := make(map[string]authorization.ExtraValue, len(userInfo.Extra))
+	for k, v := range userInfo.Extra {
+		extra[k] = authorization.ExtraValue(v)
+	}
+
+	sar := &authorization.SubjectAccessReview{
+		Spec: authorization.SubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+			User:               userInfo.Username,
+			Groups:             userInfo.Groups,
+			UID:                userInfo.UID,
+			Extra:              extra,
+		},
+	}
+	reviewResult, err := a.subjectAccessReviewsClient.Create(context.TODO(), sar, meta.CreateOptions{})
+	if err != nil {
+		return false, errors.Annotatef(err, "failed to review access of %s", userInfo.Username)
+	}
+
+	allowed := reviewResult.Status.Allowed && !reviewResult.Status.Denied
+	a.reviewResultTTLCache.Add(key, allowed, time.Minute)
+
+	return allowed, nil
+}
+
+func accessReviewKey(userInfo authentication.UserInfo, attributes authorization.ResourceAttributes) string {
+	return strings.Join([]string{
+		identityKey(userInfo),
+		attributes.Namespace,
+		attributes.Verb,
+		attributes.Group,
+		attributes.Resource,
+		attributes.Name,
+	}, "/")
+}
+
+// identityKey identifies the subject of the reviews regardless of the order of the groups.
+func identityKey(userInfo authentication.UserInfo) string {
+	groups := append([]string(nil), userInfo.Groups...)
+	sort.Strings(groups)
+
+	return strings.Join([]string{
+		userInfo.Username,
+		userInfo.UID,
+		strings.Join(groups, ","),
+	}, "/")
+}
+
+func NewAccessReviews(_ context.Context, k8sClient kubernetes.Interface) AccessReviews {
+	return &accessReviews{
+		subjectAccessReviewsClient: k8sClient.AuthorizationV1().SubjectAccessReviews(),
+		reviewResultTTLCache:       cache.NewLRUExpireCache(1024),
+	}
+}
@@ -0,0 +1,199 @@
+package kube
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	log "github.com/sirupsen/logrus"
+	core "k8s.io/api/core/v1"
+	clientCache "k8s.io/client-go/tools/cache"
+)
+
+// membership is a period which a namespace belongs to a project.
+type membership struct {
+	ProjectID string `json:"projectId"`
+	data.Period
+}
+
+// NamespaceHistory records the project memberships of the namespaces over time, so that the data of a deleted
+// or moved namespace stays visible to its project only for the period it belonged. The namespaces seen for the
+// first time are members since their creation, the moved ones since the move is seen, the history is persisted
+// into the file, if any, to survive restarts.
+type NamespaceHistory struct {
+	sync.RWMutex
+	file        string
+	memberships map[string][]membership
+	now         func() time.Time
+}
+
+func NewNamespaceHistory(file string) (*NamespaceHistory, error) {
+	h := &NamespaceHistory{
+		file:        file,
+		memberships: map[string][]membership{},
+		now:         time.Now,
+	}
+	if len(file) == 0 {
+		return h, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return nil, errors.Annotatef(err, "unable to read namespace history %s", file)
+	}
+	if err := json.Unmarshal(content, &h.memberships); err != nil {
+		return nil, errors.Annotatef(err, "unable to parse namespace history %s", file)
+	}
+
+	return h, nil
+}
+
+// observe records the current project of the namespace created at the time, the empty project closes the current membership.
+func (h *NamespaceHistory) observe(namespace, projectID string, created time.Time) {
+	if len(namespace) == 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.record(namespace, projectID, created) {
+		h.save()
+	}
+}
+
+// reconcile records the namespaces of the initial sync and closes the memberships of the namespaces
+// which were deleted while nobody was watching.
+func (h *NamespaceHistory) reconcile(namespaces []*core.Namespace) {
+	h.Lock()
+	defer h.Unlock()
+
+	changed := false
+	namespaceSet := data.Set{}
+	for _, ns := range namespaces {
+		projectID, _ := getProjectID(ns)
+		changed = h.record(ns.Name, projectID, ns.CreationTimestamp.Time) || changed
+		namespaceSet[ns.Name] = struct{}{}
+	}
+	for namespace := range h.memberships {
+		if _, exist := namespaceSet[namespace]; !exist {
+			changed = h.record(namespace, "", time.Time{}) || changed
+		}
+	}
+
+	if changed {
+		h.save()
+	}
+}
+
+// record opens the membership of the namespace in the project since the namespace was created, capped by the time
+// it is seen: a namespace newer than its current membership is a reused name, its former namespace left at its
+// creation, otherwise the namespace is moved now.
+func (h *NamespaceHistory) record(namespace, projectID string, created time.Time) bool {
+	memberships := h.memberships[namespace]
+	now := h.now()
+
+	since := now
+	if !created.IsZero() && created.Before(now) {
+		since = created
+	}
+
+	if size := len(memberships); size != 0 {
+		last := &memberships[size-1]
+		seen := last.Since
+		if !last.Until.IsZero() {
+			seen = last.Until
+		}
+		if !since.After(seen) {
+			since = now
+		}
+		if last.Until.IsZero() {
+			if last.ProjectID == projectID {
+				return false
+			}
+			last.Until = since
+		} else if last.ProjectID == projectID && len(projectID) != 0 {
+			// a namespace recreated in the same project keeps its membership
+			last.Until = time.Time{}
+			return true
+		}
+	}
+	if len(projectID) == 0 {
+		return len(memberships) != 0
+	}
+
+	h.memberships[namespace] = append(memberships, membership{
+		ProjectID: projectID,
+		Period:    data.Period{Since: since},
+	})
+
+	return true
+}
+
+func (h *NamespaceHistory) save() {
+	if len(h.file) == 0 {
+		return
+	}
+
+	content, err := json.Marshal(h.memberships)
+	if err != nil {
+		log.WithError(err).Warn("Failed to encode namespace history")
+		return
+	}
+
+	tmpFile := filepath.Join(filepath.Dir(h.file), "."+filepath.Base(h.file)+".tmp")
+	if err := ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+		log.WithError(err).Warnf("Failed to write namespace history %s", h.file)
+		return
+	}
+	if err := os.Rename(tmpFile, h.file); err != nil {
+		log.WithError(err).Warnf("Failed to write namespace history %s", h.file)
+	}
+}
+
+// grants returns the periods which the namespaces belonged to the projects.
+func (h *NamespaceHistory) grants(projectIDs data.Set) data.Grants {
+	h.RLock()
+	defer h.RUnlock()
+
+	ret := data.Grants{}
+	for namespace, memberships := range h.memberships {
+		for _, m := range memberships {
+			if _, exist := projectIDs[m.ProjectID]; exist {
+				ret[namespace] = append(ret[namespace], m.Period)
+			}
+		}
+	}
+
+	return ret
+}
+
+// eventHandler feeds the history from the namespace informer.
+func (h *NamespaceHistory) eventHandler() clientCache.ResourceEventHandler {
+	observe := func(obj interface{}) {
+		ns := toNamespace(obj)
+		projectID, _ := getProjectID(ns)
+		h.observe(ns.Name, projectID, ns.CreationTimestamp.Time)
+	}
+
+	return clientCache.ResourceEventHandlerFuncs{
+		AddFunc: observe,
+		UpdateFunc: func(_, newObj interface{}) {
+			observe(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(clientCache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			h.observe(toNamespace(obj).Name, "", time.Time{})
+		},
+	}
+}
@@ -0,0 +1,96 @@
+//go:build test
+
+package kube
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceHistory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "namespaces.json")
+	h, err := NewNamespaceHistory(file)
+	require.NoError(t, err)
+
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+	tick := func() time.Time {
+		now = now.Add(time.Hour)
+		return now
+	}
+
+	// the namespaces seen for the first time are members since their creation
+	created := now.Add(-24 * time.Hour)
+	h.observe("ns-a", "p-ab", created)
+	h.observe("ns-b", "p-ab", created)
+	h.observe("ns-c", "p-c", created)
+	h.observe("ns-a", "p-ab", created)
+
+	// ns-b moves into p-c
+	moved := tick()
+	h.observe("ns-b", "p-c", created)
+
+	// ns-c is deleted, then recreated in p-ab
+	deleted := tick()
+	h.observe("ns-c", "", time.Time{})
+	recreated := tick()
+	h.observe("ns-c", "p-ab", recreated.Add(-time.Minute))
+
+	// ns-a is deleted, then recreated in the same project
+	tick()
+	h.observe("ns-a", "", time.Time{})
+	h.observe("ns-a", "p-ab", tick())
+
+	require.Equal(t, data.Grants{
+		"ns-a": {{Since: created}},
+		"ns-b": {{Since: created, Until: moved}},
+		"ns-c": {{Since: recreated.Add(-time.Minute)}},
+	}, h.grants(data.NewSet("p-ab")))
+	require.Equal(t, data.Grants{
+		"ns-b": {{Since: moved}},
+		"ns-c": {{Since: created, Until: deleted}},
+	}, h.grants(data.NewSet("p-c")))
+
+	// the history survives restarts, the namespaces deleted, moved or created meanwhile are reconciled
+	restarted, err := NewNamespaceHistory(file)
+	require.NoError(t, err)
+	require.Equal(t, h.grants(data.NewSet("p-ab", "p-c")), restarted.grants(data.NewSet("p-ab", "p-c")))
+
+	downtime := tick()
+	reconciled := tick()
+	restarted.now = func() time.Time { return reconciled }
+	restarted.reconcile([]*core.Namespace{
+		createdNamespace("ns-a", "p-c", created),
+		createdNamespace("ns-c", "p-c", downtime),
+		createdNamespace("ns-d", "p-c", downtime),
+	})
+	require.Equal(t, data.Grants{
+		"ns-a": {{Since: created, Until: reconciled}},
+		"ns-b": {{Since: created, Until: moved}},
+		"ns-c": {{Since: recreated.Add(-time.Minute), Until: downtime}},
+	}, restarted.grants(data.NewSet("p-ab")))
+	require.Equal(t, data.Grants{
+		"ns-a": {{Since: reconciled}},
+		"ns-b": {{Since: moved, Until: reconciled}},
+		"ns-c": {{Since: created, Until: deleted}, {Since: downtime}},
+		"ns-d": {{Since: downtime}},
+	}, restarted.grants(data.NewSet("p-c")))
+
+	// the namespaces without a creation timestamp are members since they are seen
+	seen := tick()
+	restarted.now = func() time.Time { return seen }
+	restarted.observe("ns-e", "p-c", time.Time{})
+	require.Equal(t, []data.Period{{Since: seen}}, restarted.grants(data.NewSet("p-c"))["ns-e"])
+}
+
+func createdNamespace(name, projectID string, created time.Time) *core.Namespace {
+	ns := projectNamespace(name, projectID)
+	ns.CreationTimestamp = meta.NewTime(created)
+	return ns
+}
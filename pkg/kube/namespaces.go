@@ -8,6 +8,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/rancher/prometheus-auth/pkg/data"
 	log "github.com/sirupsen/logrus"
+	authentication "k8s.io/api/authentication/v1"
 	authorization "k8s.io/api/authorization/v1"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -22,49 +23,172 @@ import (
 const (
 	byTokenIndex     = "byToken"
 	byProjectIDIndex = "byProjectID"
+
+	// the allowed projects are resolved once per identity within the TTL
+	projectReviewCacheSize = 4096
+	projectReviewTTL       = time.Minute
 )
 
 type Namespaces interface {
-	Query(token string) data.Set
+	Query(token string, userInfo authentication.UserInfo) data.Set
+	ProjectID(namespace string) (string, bool)
+	ProjectNamespaces(projectID string) data.Set
+	Grants(token string, userInfo authentication.UserInfo) data.Grants
 }
 
 type namespaces struct {
 	subjectAccessReviewsClient clientAuthorization.SubjectAccessReviewInterface
 	reviewResultTTLCache       *cache.LRUExpireCache
+	projectReviewTTLCache      *cache.LRUExpireCache
+	accessReviews              AccessReviews
 	secretIndexer              clientCache.Indexer
 	namespaceIndexer           clientCache.Indexer
+	history                    *NamespaceHistory
 }
 
-func (n *namespaces) Query(token string) data.Set {
-	ret, err := n.query(token)
-	if err != nil {
+// Query returns the union of the namespaces of the token's project
+// and of every project which the identity is authorized for.
+func (n *namespaces) Query(token string, userInfo authentication.UserInfo) data.Set {
+	ret, err := data.Set{}, error(nil)
+	if len(token) != 0 {
+		ret, err = n.query(token)
+	}
+
+	for namespace := range n.queryProjects(userInfo) {
+		ret[namespace] = struct{}{}
+	}
+
+	// the token of a user is not a project monitoring token, it's only worth warning if nothing is found
+	if err != nil && len(ret) == 0 {
 		log.Warnln("failed to query Namespaces", errors.ErrorStack(err))
 	}
 
 	return ret
 }
 
-func (n *namespaces) query(token string) (data.Set, error) {
+func (n *namespaces) ProjectID(namespace string) (string, bool) {
+	nsObj, exist, _ := n.namespaceIndexer.GetByKey(namespace)
+	if !exist {
+		return "", false
+	}
+
+	return getProjectID(toNamespace(nsObj))
+}
+
+func (n *namespaces) ProjectNamespaces(projectID string) data.Set {
 	ret := data.Set{}
 
-	tokenNamespace, err := n.validate(token)
+	nsList, err := n.namespaceIndexer.ByIndex(byProjectIDIndex, projectID)
 	if err != nil {
-		return ret, err
+		log.Warnln("failed to query Namespaces of project", errors.ErrorStack(err))
+		return ret
 	}
 
-	nsObj, exist, _ := n.namespaceIndexer.GetByKey(tokenNamespace)
-	if !exist {
-		return ret, errors.New("unknown namespace of token")
+	for _, nsObj := range nsList {
+		ns := toNamespace(nsObj)
+		if ns.DeletionTimestamp == nil {
+			ret[ns.Name] = struct{}{}
+		}
 	}
 
-	ns := toNamespace(nsObj)
-	if ns.DeletionTimestamp != nil {
-		return ret, errors.New("deleting namespace of token")
+	return ret
+}
+
+// Grants returns the periods which the namespaces belonged to the projects of Query, the namespaces deleted or
+// moved out are granted for the periods they belonged. Without history, the current namespaces are granted for all time.
+func (n *namespaces) Grants(token string, userInfo authentication.UserInfo) data.Grants {
+	projectIDs := n.reviewProjects(userInfo)
+	if len(token) != 0 {
+		if projectID, err := n.tokenProjectID(token); err == nil {
+			projectIDs[projectID] = struct{}{}
+		} else if len(projectIDs) == 0 {
+			log.Warnln("failed to query Namespaces", errors.ErrorStack(err))
+		}
 	}
 
-	projectID, exist := getProjectID(ns)
+	if n.history == nil {
+		ret := data.Grants{}
+		for projectID := range projectIDs {
+			for namespace := range n.ProjectNamespaces(projectID) {
+				ret[namespace] = []data.Period{{}}
+			}
+		}
+		return ret
+	}
+
+	return n.history.grants(projectIDs)
+}
+
+// queryProjects returns the namespaces of the projects which the identity is authorized for.
+func (n *namespaces) queryProjects(userInfo authentication.UserInfo) data.Set {
+	ret := data.Set{}
+	for projectID := range n.reviewProjects(userInfo) {
+		for namespace := range n.ProjectNamespaces(projectID) {
+			ret[namespace] = struct{}{}
+		}
+	}
+
+	return ret
+}
+
+// reviewProjects returns the projects which the identity is authorized for, they are cached per identity,
+// the returned set is a copy which the caller can modify.
+func (n *namespaces) reviewProjects(userInfo authentication.UserInfo) data.Set {
+	ret := data.Set{}
+	if len(userInfo.Username) == 0 || n.accessReviews == nil {
+		return ret
+	}
+
+	key := identityKey(userInfo)
+	projectIDs, exist := n.projectReviewTTLCache.Get(key)
 	if !exist {
-		return ret, errors.New("unknown project of token")
+		var err error
+		projectIDs, err = n.reviewAllProjects(userInfo)
+		if err == nil {
+			// the failed reviews are retried by the next request
+			n.projectReviewTTLCache.Add(key, projectIDs, projectReviewTTL)
+		}
+	}
+
+	for projectID := range projectIDs.(data.Set) {
+		ret[projectID] = struct{}{}
+	}
+
+	return ret
+}
+
+// reviewAllProjects reviews the identity per project, the roles of a project are bound in all of its namespaces,
+// so it's enough to review in one of them.
+func (n *namespaces) reviewAllProjects(userInfo authentication.UserInfo) (data.Set, error) {
+	ret := data.Set{}
+	var lastErr error
+
+	for _, projectID := range n.namespaceIndexer.ListIndexFuncValues(byProjectIDIndex) {
+		projectNamespaces := n.ProjectNamespaces(projectID)
+		if len(projectNamespaces) == 0 {
+			continue
+		}
+
+		allowed, err := n.accessReviews.Allowed(userInfo, projectMonitoringAttributes(projectNamespaces.Values()[0]))
+		if err != nil {
+			log.WithError(err).Warnf("Failed to review project %s of %s", projectID, userInfo.Username)
+			lastErr = err
+			continue
+		}
+		if allowed {
+			ret[projectID] = struct{}{}
+		}
+	}
+
+	return ret, lastErr
+}
+
+func (n *namespaces) query(token string) (data.Set, error) {
+	ret := data.Set{}
+
+	projectID, err := n.tokenProjectID(token)
+	if err != nil {
+		return ret, err
 	}
 
 	nsList, err := n.namespaceIndexer.ByIndex(byProjectIDIndex, projectID)
@@ -79,6 +203,31 @@ func (n *namespaces) query(token string) (data.Set, error) {
 	return ret, nil
 }
 
+// tokenProjectID returns the project of the namespace which the project monitoring token belongs to.
+func (n *namespaces) tokenProjectID(token string) (string, error) {
+	tokenNamespace, err := n.validate(token)
+	if err != nil {
+		return "", err
+	}
+
+	nsObj, exist, _ := n.namespaceIndexer.GetByKey(tokenNamespace)
+	if !exist {
+		return "", errors.New("unknown namespace of token")
+	}
+
+	ns := toNamespace(nsObj)
+	if ns.DeletionTimestamp != nil {
+		return "", errors.New("deleting namespace of token")
+	}
+
+	projectID, exist := getProjectID(ns)
+	if !exist {
+		return "", errors.New("unknown project of token")
+	}
+
+	return projectID, nil
+}
+
 func (n *namespaces) validate(token string) (string, error) {
 	secList, err := n.secretIndexer.ByIndex(byTokenIndex, token)
 	if err != nil || len(secList) != 1 {
@@ -97,15 +246,11 @@ func (n *namespaces) validate(token string) (string, error) {
 
 	projectMonitoringServiceAccountName := "project-monitoring"
 	sarUser := fmt.Sprintf("system:serviceaccount:%s:%s", sec.Namespace, projectMonitoringServiceAccountName)
+	attributes := projectMonitoringAttributes(sec.Namespace)
 	sar := &authorization.SubjectAccessReview{
 		Spec: authorization.SubjectAccessReviewSpec{
-			ResourceAttributes: &authorization.ResourceAttributes{
-				Namespace: sec.Namespace,
-				Verb:      "view",
-				Group:     "monitoring.cattle.io",
-				Resource:  "prometheus",
-			},
-			User: sarUser,
+			ResourceAttributes: &attributes,
+			User:               sarUser,
 		},
 	}
 	reviewResult, err := n.subjectAccessReviewsClient.Create(context.TODO(), sar, meta.CreateOptions{})
@@ -122,7 +267,8 @@ func (n *namespaces) validate(token string) (string, error) {
 	return sec.Namespace, nil
 }
 
-func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface) Namespaces {
+// NewNamespaces watches the namespaces and the tokens, the history is optional.
+func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface, accessReviews AccessReviews, history *NamespaceHistory) Namespaces {
 	// secrets
 	sec := k8sClient.CoreV1().Secrets(meta.NamespaceAll)
 	secListWatch := &clientCache.ListWatch{
@@ -147,6 +293,20 @@ func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface) Namespac
 	}
 	nsInformer := clientCache.NewSharedIndexInformer(nsListWatch, &core.Namespace{}, 10*time.Minute, clientCache.Indexers{byProjectIDIndex: namespaceByProjectID})
 
+	if history != nil {
+		nsInformer.AddEventHandler(history.eventHandler())
+		go func() {
+			if clientCache.WaitForCacheSync(ctx.Done(), nsInformer.HasSynced) {
+				nsList := nsInformer.GetIndexer().List()
+				namespaces := make([]*core.Namespace, 0, len(nsList))
+				for _, nsObj := range nsList {
+					namespaces = append(namespaces, toNamespace(nsObj))
+				}
+				history.reconcile(namespaces)
+			}
+		}()
+	}
+
 	// run
 	go secInformer.Run(ctx.Done())
 	go nsInformer.Run(ctx.Done())
@@ -154,8 +314,21 @@ func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface) Namespac
 	return &namespaces{
 		subjectAccessReviewsClient: k8sClient.AuthorizationV1().SubjectAccessReviews(),
 		reviewResultTTLCache:       cache.NewLRUExpireCache(1024),
+		projectReviewTTLCache:      cache.NewLRUExpireCache(projectReviewCacheSize),
+		accessReviews:              accessReviews,
 		secretIndexer:              secInformer.GetIndexer(),
 		namespaceIndexer:           nsInformer.GetIndexer(),
+		history:                    history,
+	}
+}
+
+// projectMonitoringAttributes is the permission of viewing the project monitoring in the namespace.
+func projectMonitoringAttributes(namespace string) authorization.ResourceAttributes {
+	return authorization.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "view",
+		Group:     "monitoring.cattle.io",
+		Resource:  "prometheus",
 	}
 }
 
@@ -0,0 +1,126 @@
+//go:build test
+
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rancher/prometheus-auth/pkg/data"
+	"github.com/stretchr/testify/require"
+	authentication "k8s.io/api/authentication/v1"
+	authorization "k8s.io/api/authorization/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func projectNamespace(name, projectID string) *core.Namespace {
+	return &core.Namespace{
+		ObjectMeta: meta.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"field.cattle.io/projectId": projectID},
+		},
+	}
+}
+
+func Test_namespaces_Query(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	k8sClient := fake.NewSimpleClientset(
+		projectNamespace("ns-a", "p-ab"),
+		projectNamespace("ns-b", "p-ab"),
+		projectNamespace("ns-c", "p-c"),
+		projectNamespace("ns-d", "p-d"),
+		&core.Secret{
+			ObjectMeta: meta.ObjectMeta{Name: "project-monitoring-token", Namespace: "ns-d"},
+			Type:       core.SecretTypeServiceAccountToken,
+			Data:       map[string][]byte{core.ServiceAccountTokenKey: []byte("projectMonitoringToken")},
+		},
+	)
+
+	// alice is a member of p-ab and p-c, the project monitoring service account of p-d views its own project
+	reviews := 0
+	k8sClient.PrependReactor("create", "subjectaccessreviews", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		sar := action.(k8sTesting.CreateAction).GetObject().(*authorization.SubjectAccessReview)
+		attributes := sar.Spec.ResourceAttributes
+
+		allowed := false
+		switch sar.Spec.User {
+		case "alice":
+			allowed = attributes.Namespace == "ns-a" || attributes.Namespace == "ns-c"
+		case "system:serviceaccount:ns-d:project-monitoring":
+			allowed = attributes.Namespace == "ns-d"
+		}
+		sar.Status.Allowed = allowed
+
+		return true, sar, nil
+	})
+
+	n := NewNamespaces(ctx, k8sClient, NewAccessReviews(ctx, k8sClient), nil)
+	require.Eventually(t, func() bool {
+		return len(n.ProjectNamespaces("p-d")) == 1 && len(n.Query("projectMonitoringToken", authentication.UserInfo{})) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	alice := authentication.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}}
+	require.Equal(t, data.NewSet("ns-a", "ns-b", "ns-c"), n.Query("", alice))
+
+	// the reviews are cached per project
+	before := reviews
+	require.Equal(t, data.NewSet("ns-a", "ns-b", "ns-c", "ns-d"), n.Query("projectMonitoringToken", alice))
+	require.Equal(t, before, reviews)
+
+	require.Empty(t, n.Query("unknownToken", authentication.UserInfo{Username: "bob"}))
+}
+
+type countingAccessReviews struct {
+	reviews int
+	err     error
+}
+
+func (c *countingAccessReviews) Allowed(userInfo authentication.UserInfo, attributes authorization.ResourceAttributes) (bool, error) {
+	c.reviews++
+	return attributes.Namespace == "ns-a", c.err
+}
+
+func Test_namespaces_reviewProjects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	k8sClient := fake.NewSimpleClientset(
+		projectNamespace("ns-a", "p-a"),
+		projectNamespace("ns-b", "p-b"),
+		projectNamespace("ns-c", "p-c"),
+	)
+
+	accessReviews := &countingAccessReviews{}
+	n := NewNamespaces(ctx, k8sClient, accessReviews, nil).(*namespaces)
+	require.Eventually(t, func() bool {
+		return len(n.namespaceIndexer.ListKeys()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the projects are reviewed once per identity
+	alice := authentication.UserInfo{Username: "alice", Groups: []string{"devs", "ops"}}
+	projectIDs := n.reviewProjects(alice)
+	require.Equal(t, data.NewSet("p-a"), projectIDs)
+	require.Equal(t, 3, accessReviews.reviews)
+
+	projectIDs["p-c"] = struct{}{}
+	require.Equal(t, data.NewSet("p-a"), n.reviewProjects(authentication.UserInfo{Username: "alice", Groups: []string{"ops", "devs"}}))
+	require.Equal(t, 3, accessReviews.reviews)
+
+	require.Equal(t, data.NewSet("p-a"), n.reviewProjects(authentication.UserInfo{Username: "alice", Groups: []string{"devs"}}))
+	require.Equal(t, 6, accessReviews.reviews)
+
+	// the failed reviews are not cached
+	accessReviews.err = errors.New("unavailable")
+	require.Empty(t, n.reviewProjects(authentication.UserInfo{Username: "bob"}))
+	require.Empty(t, n.reviewProjects(authentication.UserInfo{Username: "bob"}))
+	require.Equal(t, 12, accessReviews.reviews)
+}
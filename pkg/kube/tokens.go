@@ -3,6 +3,7 @@ package kube
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	authentication "k8s.io/api/authentication/v1"
@@ -57,6 +58,33 @@ func NewTokens(_ context.Context, k8sClient kubernetes.Interface) Tokens {
 	}
 }
 
+type chainedTokens []Tokens
+
+// Authenticate tries each authenticator in order, the first one recognizing the token wins.
+func (c chainedTokens) Authenticate(token string) (authentication.UserInfo, error) {
+	var userInfo authentication.UserInfo
+
+	errs := make([]string, 0, len(c))
+	for _, tokens := range c {
+		ret, err := tokens.Authenticate(token)
+		if err == nil {
+			return ret, nil
+		}
+		errs = append(errs, err.Error())
+	}
+
+	return userInfo, fmt.Errorf("user is not authenticated: %s", strings.Join(errs, "; "))
+}
+
+// NewChainedTokens chains the authenticators, e.g. a JWT authenticator before the TokenReview.
+func NewChainedTokens(tokens ...Tokens) Tokens {
+	if len(tokens) == 1 {
+		return tokens[0]
+	}
+
+	return chainedTokens(tokens)
+}
+
 func MatchingUsers(userInfoA, userInfoB authentication.UserInfo) bool {
 	if userInfoA.Username != userInfoB.Username {
 		return false
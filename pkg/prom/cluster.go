@@ -0,0 +1,133 @@
+package prom
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+// ClusterSelectors select the series without namespace, e.g. the node metrics,
+// which the tenants can read without the namespace matcher.
+type ClusterSelectors [][]*promlb.Matcher
+
+func ParseClusterSelectors(values []string) (ClusterSelectors, error) {
+	ret := make(ClusterSelectors, 0, len(values))
+	for _, value := range values {
+		matchers, err := parser.ParseMetricSelector(value)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid cluster selector %q", value)
+		}
+		for _, m := range matchers {
+			if m.Name == namespaceMatchName {
+				return nil, errors.Errorf("cluster selector %q must not match %s", value, namespaceMatchName)
+			}
+		}
+		ret = append(ret, matchers)
+	}
+
+	return ret, nil
+}
+
+// Covers returns true if the series selected by the matchers are selected by one of the cluster selectors,
+// that is the matchers pin every label of the cluster selector with an equality matcher.
+func (s ClusterSelectors) Covers(srcMatchers []*promlb.Matcher) bool {
+	if len(s) == 0 {
+		return false
+	}
+
+	equals := make(map[string]string, len(srcMatchers))
+	for _, m := range srcMatchers {
+		if m.Name == namespaceMatchName {
+			return false
+		}
+		if m.Type == promlb.MatchEqual {
+			equals[m.Name] = m.Value
+		}
+	}
+
+	for _, selector := range s {
+		if coveredBy(equals, selector) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func coveredBy(equals map[string]string, selector []*promlb.Matcher) bool {
+	for _, m := range selector {
+		value, exist := equals[m.Name]
+		if !exist || !m.Matches(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Selects returns true if the series is selected by one of the cluster selectors.
+func (s ClusterSelectors) Selects(lbs promlb.Labels) bool {
+	for _, selector := range s {
+		selected := true
+		for _, m := range selector {
+			if !m.Matches(lbs.Get(m.Name)) {
+				selected = false
+				break
+			}
+		}
+		if selected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterMatchers restricts the covered matchers to the series without namespace,
+// the others are restricted to the namespaces as usual.
+func (s ClusterSelectors) FilterMatchers(namespaceSet data.Set, srcMatchers []*promlb.Matcher) []*promlb.Matcher {
+	if !s.Covers(srcMatchers) {
+		return FilterMatchers(namespaceSet, srcMatchers)
+	}
+
+	return append(srcMatchers, promlb.MustNewMatcher(promlb.MatchEqual, namespaceMatchName, ""))
+}
+
+func (s ClusterSelectors) FilterLabelMatchers(namespaceSet data.Set, srcMatchers []*prompb.LabelMatcher) []*prompb.LabelMatcher {
+	matchers, err := FromLabelMatchers(srcMatchers)
+	if err != nil || !s.Covers(matchers) {
+		return FilterLabelMatchers(namespaceSet, srcMatchers)
+	}
+
+	return append(srcMatchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: namespaceMatchName})
+}
+
+// NewExprForCountAllLabels counts the metric names of the namespaces and of the cluster selectors.
+func (s ClusterSelectors) NewExprForCountAllLabels(namespaces []string) string {
+	if len(s) == 0 {
+		return NewExprForCountAllLabels(namespaces)
+	}
+
+	return fmt.Sprintf(`count (%s) by (__name__)`, strings.Join(s.NewInstantVectorSelectors(namespaces), " or "))
+}
+
+// NewInstantVectorSelectors returns the selectors of the namespaces and of the cluster selectors.
+func (s ClusterSelectors) NewInstantVectorSelectors(namespaces []string) []string {
+	instantVectorSelectors := make([]string, 0, len(s)+1)
+	instantVectorSelectors = append(instantVectorSelectors, NewInstantVectorSelectorsForNamespaces(namespaces))
+	for _, selector := range s {
+		matchers := make([]string, 0, len(selector)+1)
+		for _, m := range selector {
+			matchers = append(matchers, m.String())
+		}
+		matchers = append(matchers, fmt.Sprintf(`%s=""`, namespaceMatchName))
+		instantVectorSelectors = append(instantVectorSelectors, fmt.Sprintf(`{%s}`, strings.Join(matchers, ",")))
+	}
+
+	return instantVectorSelectors
+}
@@ -0,0 +1,68 @@
+//go:build test
+
+package prom
+
+import (
+	"testing"
+
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+func TestClusterSelectors(t *testing.T) {
+	selectors, err := ParseClusterSelectors([]string{`{__name__=~"node_.*"}`, `up{job="apiserver"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		input  string
+		expect string
+	}{
+		{`node_cpu_seconds_total`, `node_cpu_seconds_total{namespace=""}`},
+		{`node_memory_MemFree_bytes{instance="n1"}`, `node_memory_MemFree_bytes{instance="n1",namespace=""}`},
+		{`up{job="apiserver"}`, `up{job="apiserver",namespace=""}`},
+		// not pinned by equality matchers
+		{`up`, `up{namespace="ns-a"}`},
+		{`up{job=~"api.*"}`, `up{job=~"api.*",namespace="ns-a"}`},
+		{`{__name__=~"node_.*"}`, `{__name__=~"node_.*",namespace="ns-a"}`},
+		// the namespace matcher is always restricted
+		{`node_load1{namespace="ns-b"}`, `node_load1{namespace="______"}`},
+		{`rate(node_cpu_seconds_total[5m]) / on() group_left kube_pod_info`, `rate(node_cpu_seconds_total{namespace=""}[5m]) / on() group_left() kube_pod_info{namespace="ns-a"}`},
+	}
+
+	for _, tc := range testCases {
+		expr, err := parser.ParseExpr(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			if n, ok := node.(*parser.VectorSelector); ok {
+				n.LabelMatchers = selectors.FilterMatchers(data.NewSet("ns-a"), n.LabelMatchers)
+			}
+			return nil
+		})
+
+		if got := expr.String(); got != tc.expect {
+			t.Errorf("%s: got %s, want %s", tc.input, got, tc.expect)
+		}
+	}
+
+	if _, err := ParseClusterSelectors([]string{`up{namespace="kube-system"}`}); err == nil {
+		t.Error("expected the namespace matcher to be refused")
+	}
+
+	expect := `count ({namespace="ns-a"} or {__name__=~"node_.*",namespace=""} or {job="apiserver",__name__="up",namespace=""}) by (__name__)`
+	if got := selectors.NewExprForCountAllLabels([]string{"ns-a"}); got != expect {
+		t.Errorf("got %s, want %s", got, expect)
+	}
+
+	if !selectors.Selects(promlb.FromStrings("__name__", "node_load1", "instance", "n1")) {
+		t.Error("expected node_load1 to be selected")
+	}
+	if selectors.Selects(promlb.FromStrings("__name__", "up", "job", "node")) {
+		t.Error("expected up of the node job not to be selected")
+	}
+}
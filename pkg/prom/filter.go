@@ -10,34 +10,68 @@ const (
 	namespaceMatchName = "namespace"
 )
 
+// FilterMatchers restricts the matchers to the namespaces, all the matchers on the namespace label
+// are reduced to a single one in place of the first of them.
 func FilterMatchers(namespaceSet data.Set, srcMatchers []*promlb.Matcher) []*promlb.Matcher {
-	for _, m := range srcMatchers {
-		name := m.Name
-
-		if name == namespaceMatchName {
-			translateMatcher(namespaceSet, m)
-			return srcMatchers
+	var namespaceMatchers []*promlb.Matcher
+	first := -1
+	for i, m := range srcMatchers {
+		if m.Name == namespaceMatchName {
+			namespaceMatchers = append(namespaceMatchers, m)
+			if first < 0 {
+				first = i
+			}
 		}
 	}
 
-	// append namespace match
-	srcMatchers = append(srcMatchers, createMatcher(namespaceMatchName, namespaceSet.Values()))
+	if first < 0 {
+		// append namespace match
+		return append(srcMatchers, createMatcher(namespaceMatchName, namespaceSet.Values()))
+	}
+	if namespaceSet == nil {
+		return srcMatchers
+	}
+
+	ret := make([]*promlb.Matcher, 0, len(srcMatchers)-len(namespaceMatchers)+1)
+	for i, m := range srcMatchers {
+		if i == first {
+			ret = append(ret, translateMatchers(namespaceSet, namespaceMatchers))
+		} else if m.Name != namespaceMatchName {
+			ret = append(ret, m)
+		}
+	}
 
-	return srcMatchers
+	return ret
 }
 
 func FilterLabelMatchers(namespaceSet data.Set, srcMatchers []*prompb.LabelMatcher) []*prompb.LabelMatcher {
-	for _, m := range srcMatchers {
-		name := m.Name
-
-		if name == namespaceMatchName {
-			translateLabelMatcher(namespaceSet, m)
-			return srcMatchers
+	var namespaceMatchers []*prompb.LabelMatcher
+	first := -1
+	for i, m := range srcMatchers {
+		if m.Name == namespaceMatchName {
+			namespaceMatchers = append(namespaceMatchers, m)
+			if first < 0 {
+				first = i
+			}
 		}
 	}
 
-	// append namespace match
-	srcMatchers = append(srcMatchers, createLabelMatcher(namespaceMatchName, namespaceSet.Values()))
+	if first < 0 {
+		// append namespace match
+		return append(srcMatchers, createLabelMatcher(namespaceMatchName, namespaceSet.Values()))
+	}
+	if namespaceSet == nil {
+		return srcMatchers
+	}
+
+	ret := make([]*prompb.LabelMatcher, 0, len(srcMatchers)-len(namespaceMatchers)+1)
+	for i, m := range srcMatchers {
+		if i == first {
+			ret = append(ret, translateLabelMatchers(namespaceSet, namespaceMatchers))
+		} else if m.Name != namespaceMatchName {
+			ret = append(ret, m)
+		}
+	}
 
-	return srcMatchers
+	return ret
 }
@@ -107,6 +107,21 @@ var metrics = []struct {
 		`a{namespace!~""}`,
 		`a{namespace=~"ns-a|ns-b|rx-c"}`,
 	},
+	{
+		"multiple matchers",
+		`a{namespace=~"ns-.*",namespace!="ns-b"}`,
+		`a{namespace="ns-a"}`,
+	},
+	{
+		"multiple matchers with other labels",
+		`a{job="x",namespace!="",value="value",namespace!~"rx-.*"}`,
+		`a{job="x",namespace=~"ns-a|ns-b",value="value"}`,
+	},
+	{
+		"multiple matchers without value hitting",
+		`a{namespace="ns-a",namespace="ns-b"}`,
+		`a{namespace="______"}`,
+	},
 }
 
 func fakeNamespaceSet() data.Set {
@@ -146,7 +161,7 @@ func TestFilterLabelMatchers(t *testing.T) {
 				return nil, err
 			}
 
-			return fromLabelMatchers(FilterLabelMatchers(nsSet, lm))
+			return FromLabelMatchers(FilterLabelMatchers(nsSet, lm))
 		})
 		if err != nil {
 			errs = append(errs, err)
@@ -13,61 +13,44 @@ const (
 )
 
 func createMatcher(matcherName string, namespaces []string) *promlb.Matcher {
-	ret := &promlb.Matcher{
-		Name: matcherName,
+	matchType, value := promlb.MatchEqual, canonicalValue(namespaces)
+	if len(namespaces) > 1 {
+		matchType = promlb.MatchRegexp
 	}
 
-	return modifyMatcher(ret, namespaces)
-}
-
-func createLabelMatcher(matcherName string, namespaces []string) *prompb.LabelMatcher {
-	ret := &prompb.LabelMatcher{
-		Name: matcherName,
+	ret, err := promlb.NewMatcher(matchType, matcherName, value)
+	if err != nil {
+		log.Errorf("unable to create matcher %s%s%q, select none of the namespaces instead: %v", matcherName, matchType, value, err)
+		return promlb.MustNewMatcher(promlb.MatchEqual, matcherName, noneNamespace)
 	}
 
-	modifyLabelMatcher(ret, namespaces)
-
 	return ret
 }
 
-func modifyMatcher(srcMatcher *promlb.Matcher, namespaces []string) *promlb.Matcher {
-	size := len(namespaces)
-
-	if size == 0 {
-		srcMatcher.Type = promlb.MatchEqual
-		srcMatcher.Value = noneNamespace
-	} else if size == 1 {
-		srcMatcher.Type = promlb.MatchEqual
-		srcMatcher.Value = namespaces[0]
-	} else {
-		srcMatcher.Type = promlb.MatchRegexp
-		srcMatcher.Value = join(namespaces)
+func createLabelMatcher(matcherName string, namespaces []string) *prompb.LabelMatcher {
+	matchType := prompb.LabelMatcher_EQ
+	if len(namespaces) > 1 {
+		matchType = prompb.LabelMatcher_RE
 	}
 
-	matcher, err := promlb.NewMatcher(srcMatcher.Type, srcMatcher.Name, srcMatcher.Value)
-	if err != nil {
-		log.Errorf("unable to modify matcher from %s%s%s to %s%s%s",
-			srcMatcher.Name, srcMatcher.Type, srcMatcher.Value,
-			matcher.Name, matcher.Type, matcher.Value,
-		)
+	return &prompb.LabelMatcher{
+		Type:  matchType,
+		Name:  matcherName,
+		Value: canonicalValue(namespaces),
 	}
-
-	return matcher
 }
 
-func modifyLabelMatcher(srcMatcher *prompb.LabelMatcher, namespaces []string) {
-	size := len(namespaces)
-
-	if size == 0 {
-		srcMatcher.Type = prompb.LabelMatcher_EQ
-		srcMatcher.Value = noneNamespace
-	} else if size == 1 {
-		srcMatcher.Type = prompb.LabelMatcher_EQ
-		srcMatcher.Value = namespaces[0]
-	} else {
-		srcMatcher.Type = prompb.LabelMatcher_RE
-		srcMatcher.Value = join(namespaces)
+// canonicalValue returns the value of the single matcher selecting exactly the namespaces,
+// it's an alternation if there is more than one namespace.
+func canonicalValue(namespaces []string) string {
+	switch len(namespaces) {
+	case 0:
+		return noneNamespace
+	case 1:
+		return namespaces[0]
 	}
+
+	return join(namespaces)
 }
 
 func toLabelMatchers(matchers []*promlb.Matcher) ([]*prompb.LabelMatcher, error) {
@@ -95,7 +78,8 @@ func toLabelMatchers(matchers []*promlb.Matcher) ([]*prompb.LabelMatcher, error)
 	return pbMatchers, nil
 }
 
-func fromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*promlb.Matcher, error) {
+// FromLabelMatchers converts the remote read matchers into the PromQL matchers.
+func FromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*promlb.Matcher, error) {
 	result := make([]*promlb.Matcher, 0, len(matchers))
 	for _, matcher := range matchers {
 		var mtype promlb.MatchType
@@ -0,0 +1,97 @@
+package prom
+
+import (
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	metricNameMatchName = "__name__"
+)
+
+// MetricNameFilter restricts the metric names by regular expressions, a blank expression doesn't restrict.
+type MetricNameFilter struct {
+	Allow string
+	Deny  string
+}
+
+func (f *MetricNameFilter) enabled() bool {
+	return f != nil && (len(f.Allow) != 0 || len(f.Deny) != 0)
+}
+
+func (f *MetricNameFilter) matchers() []*promlb.Matcher {
+	ret := make([]*promlb.Matcher, 0, 2)
+	if len(f.Allow) != 0 {
+		ret = append(ret, promlb.MustNewMatcher(promlb.MatchRegexp, metricNameMatchName, f.Allow))
+	}
+	if len(f.Deny) != 0 {
+		ret = append(ret, promlb.MustNewMatcher(promlb.MatchNotRegexp, metricNameMatchName, f.Deny))
+	}
+
+	return ret
+}
+
+// Allowed returns true if the metric name passes the filter.
+func (f *MetricNameFilter) Allowed(name string) bool {
+	if !f.enabled() {
+		return true
+	}
+
+	for _, m := range f.matchers() {
+		if !m.Matches(name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FilterMatchers appends the metric name matchers, which are not appended yet.
+func (f *MetricNameFilter) FilterMatchers(srcMatchers []*promlb.Matcher) []*promlb.Matcher {
+	if !f.enabled() {
+		return srcMatchers
+	}
+
+	for _, m := range f.matchers() {
+		if !hasMatcher(srcMatchers, m) {
+			srcMatchers = append(srcMatchers, m)
+		}
+	}
+
+	return srcMatchers
+}
+
+func (f *MetricNameFilter) FilterLabelMatchers(srcMatchers []*prompb.LabelMatcher) []*prompb.LabelMatcher {
+	if !f.enabled() {
+		return srcMatchers
+	}
+
+	pbMatchers, _ := toLabelMatchers(f.matchers())
+	for _, m := range pbMatchers {
+		if !hasLabelMatcher(srcMatchers, m) {
+			srcMatchers = append(srcMatchers, m)
+		}
+	}
+
+	return srcMatchers
+}
+
+func hasMatcher(matchers []*promlb.Matcher, m *promlb.Matcher) bool {
+	for _, src := range matchers {
+		if src.Type == m.Type && src.Name == m.Name && src.Value == m.Value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasLabelMatcher(matchers []*prompb.LabelMatcher, m *prompb.LabelMatcher) bool {
+	for _, src := range matchers {
+		if src.Type == m.Type && src.Name == m.Name && src.Value == m.Value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,381 @@
+package prom
+
+import (
+	"time"
+
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+// SelectedPeriod returns the period which the expression evaluated from start to end reads the samples of,
+// the ranges, the offsets and the @ modifiers of the selectors and of the subqueries are taken into account like
+// the Prometheus engine does. The start and the end are returned as is if the expression has no selector.
+func SelectedPeriod(expr parser.Expr, start, end time.Time, lookbackDelta time.Duration) (time.Time, time.Time) {
+	var minTime, maxTime time.Time
+	var evalRange time.Duration
+
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			selectorStart, selectorEnd := selectorPeriod(n, path, start, end, evalRange, lookbackDelta)
+			if minTime.IsZero() || selectorStart.Before(minTime) {
+				minTime = selectorStart
+			}
+			if maxTime.IsZero() || selectorEnd.After(maxTime) {
+				maxTime = selectorEnd
+			}
+			evalRange = 0
+		case *parser.MatrixSelector:
+			evalRange = n.Range
+		}
+		return nil
+	})
+
+	if minTime.IsZero() {
+		return start, end
+	}
+
+	return minTime, maxTime
+}
+
+func selectorPeriod(n *parser.VectorSelector, path []parser.Node, start, end time.Time, evalRange, lookbackDelta time.Duration) (time.Time, time.Time) {
+	var subqueryOffset, subqueryRange time.Duration
+	for _, node := range path {
+		subquery, ok := node.(*parser.SubqueryExpr)
+		if !ok {
+			continue
+		}
+
+		subqueryOffset += subquery.OriginalOffset
+		subqueryRange += subquery.Range
+		if at, ok := atTime(subquery.Timestamp, subquery.StartOrEnd, start, end); ok {
+			// the @ modifier resets the offsets and the ranges of the outer subqueries
+			subqueryOffset, subqueryRange = subquery.OriginalOffset, subquery.Range
+			start, end = at, at
+		}
+	}
+
+	if at, ok := atTime(n.Timestamp, n.StartOrEnd, start, end); ok {
+		start, end = at, at
+	} else {
+		start = start.Add(-subqueryOffset - subqueryRange)
+		end = end.Add(-subqueryOffset)
+	}
+
+	if evalRange == 0 {
+		start = start.Add(-lookbackDelta)
+	} else {
+		start = start.Add(-evalRange)
+	}
+
+	return start.Add(-n.OriginalOffset), end.Add(-n.OriginalOffset)
+}
+
+func atTime(ts *int64, startOrEnd parser.ItemType, start, end time.Time) (time.Time, bool) {
+	switch {
+	case ts != nil:
+		return timestamp.Time(*ts), true
+	case startOrEnd == parser.START:
+		return start, true
+	case startOrEnd == parser.END:
+		return end, true
+	}
+
+	return time.Time{}, false
+}
+
+// LimitPeriods rewrites the filtered selectors of the expression evaluated from start to end, so that the namespaces
+// granted for a part of the period are only read within the periods of their grants. The selector or the range
+// function reading them is split by the periods, each part is kept at the evaluation times reading within its periods,
+// e.g. `rate(up{namespace=~"ns-a|ns-b"}[5m])` becomes
+// `(rate(up{namespace="ns-a"}[5m]) or (rate(up{namespace="ns-b"}[5m]) and on() (vector(time()) >= 1.7903e+09)))`.
+// The namespaces can't be limited in a single evaluation, under the @ modifier, in the absent functions or in a range
+// vector result, they are left out there unless they are granted for the whole period read.
+func LimitPeriods(expr parser.Expr, namespaceSet data.Set, grants data.Grants, start, end time.Time, lookbackDelta time.Duration) parser.Expr {
+	l := &periodLimiter{
+		namespaceSet:  namespaceSet,
+		grants:        grants,
+		start:         start,
+		end:           end,
+		lookbackDelta: lookbackDelta,
+	}
+
+	return l.limit(expr, nil)
+}
+
+type periodLimiter struct {
+	namespaceSet  data.Set
+	grants        data.Grants
+	start, end    time.Time
+	lookbackDelta time.Duration
+}
+
+// periodGroup is the namespaces granted for the same periods.
+type periodGroup struct {
+	namespaces []string
+	periods    []data.Period
+}
+
+func (l *periodLimiter) limit(expr parser.Expr, path []parser.Node) parser.Expr {
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		e.Expr = l.limit(e.Expr, append(path, e))
+		if e.Param != nil {
+			e.Param = l.limit(e.Param, append(path, e))
+		}
+	case *parser.BinaryExpr:
+		e.LHS = l.limit(e.LHS, append(path, e))
+		e.RHS = l.limit(e.RHS, append(path, e))
+	case *parser.Call:
+		return l.limitCall(e, path)
+	case *parser.ParenExpr:
+		e.Expr = l.limit(e.Expr, append(path, e))
+	case *parser.UnaryExpr:
+		e.Expr = l.limit(e.Expr, append(path, e))
+	case *parser.StepInvariantExpr:
+		e.Expr = l.limit(e.Expr, append(path, e))
+	case *parser.SubqueryExpr:
+		e.Expr = l.limit(e.Expr, append(path, e))
+	case *parser.MatrixSelector:
+		// the range vector result isn't evaluated over time
+		l.restrict(e.VectorSelector.(*parser.VectorSelector), path, e.Range)
+	case *parser.VectorSelector:
+		return l.limitSelector(e, path, 0, e, func(limited *parser.VectorSelector) parser.Expr {
+			return limited
+		})
+	}
+
+	return expr
+}
+
+func (l *periodLimiter) limitCall(call *parser.Call, path []parser.Node) parser.Expr {
+	path = append(path, call)
+
+	matrixIdx := -1
+	for i, arg := range call.Args {
+		switch a := arg.(type) {
+		case *parser.MatrixSelector:
+			matrixIdx = i
+		case *parser.VectorSelector:
+			if call.Func.Name == "absent" {
+				// the absence isn't told apart by namespace
+				l.restrict(a, path, 0)
+				continue
+			}
+			call.Args[i] = l.limit(arg, path)
+		default:
+			call.Args[i] = l.limit(arg, path)
+		}
+	}
+	if matrixIdx < 0 {
+		return call
+	}
+
+	matrix := call.Args[matrixIdx].(*parser.MatrixSelector)
+	vs := matrix.VectorSelector.(*parser.VectorSelector)
+	if call.Func.Name == "absent_over_time" {
+		l.restrict(vs, path, matrix.Range)
+		return call
+	}
+
+	// the range functions are evaluated per series, the results of the parts are disjoint
+	return l.limitSelector(vs, path, matrix.Range, call, func(limited *parser.VectorSelector) parser.Expr {
+		args := make(parser.Expressions, len(call.Args))
+		copy(args, call.Args)
+		args[matrixIdx] = &parser.MatrixSelector{VectorSelector: limited, Range: matrix.Range, EndPos: matrix.EndPos}
+		return &parser.Call{Func: call.Func, Args: args, PosRange: call.PosRange}
+	})
+}
+
+// limitSelector returns the expression wrapping the selector split by the periods of the namespaces it reads,
+// the original expression is returned if the selector reads all of them for the whole period.
+func (l *periodLimiter) limitSelector(vs *parser.VectorSelector, path []parser.Node, evalRange time.Duration, original parser.Expr, wrap func(*parser.VectorSelector) parser.Expr) parser.Expr {
+	whole, groups, changed := l.split(vs, path, evalRange, true)
+	if !changed {
+		return original
+	}
+
+	var ret parser.Expr
+	if len(whole) != 0 || len(groups) == 0 {
+		ret = wrap(withNamespaces(vs, whole))
+	}
+	readRange := evalRange
+	if readRange == 0 {
+		readRange = l.lookbackDelta
+	}
+	for _, group := range groups {
+		part := &parser.ParenExpr{Expr: &parser.BinaryExpr{
+			Op:             parser.LAND,
+			LHS:            wrap(withNamespaces(vs, group.namespaces)),
+			RHS:            &parser.ParenExpr{Expr: periodCondition(group.periods, vs.OriginalOffset, readRange)},
+			VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany, On: true},
+		}}
+		if ret == nil {
+			ret = part
+			continue
+		}
+		ret = &parser.BinaryExpr{
+			Op:             parser.LOR,
+			LHS:            ret,
+			RHS:            part,
+			VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany},
+		}
+	}
+	if _, ok := ret.(*parser.BinaryExpr); ok {
+		ret = &parser.ParenExpr{Expr: ret}
+	}
+
+	return ret
+}
+
+// restrict leaves the namespaces which the selector doesn't read for the whole period out of it.
+func (l *periodLimiter) restrict(vs *parser.VectorSelector, path []parser.Node, evalRange time.Duration) {
+	if whole, _, changed := l.split(vs, path, evalRange, false); changed {
+		vs.LabelMatchers = withNamespaces(vs, whole).LabelMatchers
+	}
+}
+
+// split returns the namespaces which the selector reads within their grants for the whole period, and the groups of
+// the ones it reads within their grants for a part of the period only if it's evaluated over time, the others are
+// left out. It returns false if the selector reads all of its namespaces for the whole period.
+func (l *periodLimiter) split(vs *parser.VectorSelector, path []parser.Node, evalRange time.Duration, overTime bool) ([]string, []*periodGroup, bool) {
+	var namespaceMatchers []*promlb.Matcher
+	for _, m := range vs.LabelMatchers {
+		if m.Name == namespaceMatchName {
+			namespaceMatchers = append(namespaceMatchers, m)
+		}
+	}
+	if len(namespaceMatchers) == 0 {
+		return nil, nil, false
+	}
+
+	start, end := selectorPeriod(vs, path, l.start, l.end, evalRange, l.lookbackDelta)
+	if vs.Timestamp != nil || vs.StartOrEnd != 0 || (l.start.Equal(l.end) && !inSubquery(path)) {
+		// the selector reads a single period
+		overTime = false
+	}
+
+	var whole []string
+	var groups []*periodGroup
+	changed := false
+	for _, namespace := range matchedNamespaces(l.namespaceSet, namespaceMatchers...) {
+		periods, partial := l.grants[namespace]
+		if !partial {
+			whole = append(whole, namespace)
+			continue
+		}
+
+		var overlapping []data.Period
+		covered := false
+		for _, period := range periods {
+			if period.Covers(start, end) {
+				covered = true
+				break
+			}
+			if period.Overlaps(start, end) {
+				overlapping = append(overlapping, period)
+			}
+		}
+		if covered {
+			whole = append(whole, namespace)
+			continue
+		}
+
+		changed = true
+		if !overTime || len(overlapping) == 0 {
+			continue
+		}
+		groups = appendPeriodGroup(groups, namespace, overlapping)
+	}
+
+	return whole, groups, changed
+}
+
+func appendPeriodGroup(groups []*periodGroup, namespace string, periods []data.Period) []*periodGroup {
+	for _, group := range groups {
+		if samePeriods(group.periods, periods) {
+			group.namespaces = append(group.namespaces, namespace)
+			return groups
+		}
+	}
+
+	return append(groups, &periodGroup{namespaces: []string{namespace}, periods: periods})
+}
+
+func samePeriods(a, b []data.Period) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Since.Equal(b[i].Since) || !a[i].Until.Equal(b[i].Until) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func inSubquery(path []parser.Node) bool {
+	for _, node := range path {
+		if _, ok := node.(*parser.SubqueryExpr); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withNamespaces returns a copy of the selector which reads the namespaces, the matchers on the namespace label
+// are reduced to a single one in place of the first of them.
+func withNamespaces(vs *parser.VectorSelector, namespaces []string) *parser.VectorSelector {
+	ret := *vs
+	ret.LabelMatchers = make([]*promlb.Matcher, 0, len(vs.LabelMatchers))
+	replaced := false
+	for _, m := range vs.LabelMatchers {
+		if m.Name != namespaceMatchName {
+			ret.LabelMatchers = append(ret.LabelMatchers, m)
+		} else if !replaced {
+			ret.LabelMatchers = append(ret.LabelMatchers, createMatcher(namespaceMatchName, namespaces))
+			replaced = true
+		}
+	}
+
+	return &ret
+}
+
+// periodCondition returns the expression which has a sample at the evaluation times when the selector with the offset
+// reads the range within one of the periods, [time - offset - range, time - offset] has to be in [since, until).
+func periodCondition(periods []data.Period, offset, readRange time.Duration) parser.Expr {
+	var ret parser.Expr
+	for _, period := range periods {
+		var cond parser.Expr = &parser.Call{
+			Func: parser.Functions["vector"],
+			Args: parser.Expressions{&parser.Call{Func: parser.Functions["time"], Args: parser.Expressions{}}},
+		}
+		if !period.Since.IsZero() {
+			cond = &parser.BinaryExpr{Op: parser.GTE, LHS: cond, RHS: timeLiteral(period.Since.Add(offset + readRange))}
+		}
+		if !period.Until.IsZero() {
+			cond = &parser.BinaryExpr{Op: parser.LSS, LHS: cond, RHS: timeLiteral(period.Until.Add(offset))}
+		}
+
+		if ret == nil {
+			ret = cond
+			continue
+		}
+		ret = &parser.BinaryExpr{
+			Op:             parser.LOR,
+			LHS:            ret,
+			RHS:            cond,
+			VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany},
+		}
+	}
+
+	return ret
+}
+
+func timeLiteral(t time.Time) *parser.NumberLiteral {
+	return &parser.NumberLiteral{Val: float64(timestamp.FromTime(t)) / 1000}
+}
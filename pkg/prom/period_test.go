@@ -0,0 +1,104 @@
+//go:build test
+
+package prom
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+func TestSelectedPeriod(t *testing.T) {
+	end := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	start := end.Add(-time.Hour)
+	lookbackDelta := 5 * time.Minute
+
+	testCases := []struct {
+		input       string
+		expectStart time.Time
+		expectEnd   time.Time
+	}{
+		{`1`, start, end},
+		{`up`, start.Add(-lookbackDelta), end},
+		{`rate(up[10m])`, start.Add(-10 * time.Minute), end},
+		{`up offset 1h`, start.Add(-time.Hour - lookbackDelta), end.Add(-time.Hour)},
+		{`up or rate(up[30m] offset 1d)`, start.Add(-24*time.Hour - 30*time.Minute), end},
+		{`max_over_time(rate(up[5m])[1h:1m] offset 1h)`, start.Add(-2*time.Hour - 5*time.Minute), end.Add(-time.Hour)},
+		{`up @ 1790000000`, time.Unix(1790000000, 0).Add(-lookbackDelta), time.Unix(1790000000, 0)},
+		{`up @ start()`, start.Add(-lookbackDelta), start},
+		{`up @ end() offset -1h`, end.Add(-lookbackDelta + time.Hour), end.Add(time.Hour)},
+	}
+
+	for _, tc := range testCases {
+		expr, err := parser.ParseExpr(tc.input)
+		if err != nil {
+			t.Fatalf("cannot parse %s: %v", tc.input, err)
+		}
+
+		gotStart, gotEnd := SelectedPeriod(expr, start, end, lookbackDelta)
+		if !gotStart.Equal(tc.expectStart) || !gotEnd.Equal(tc.expectEnd) {
+			t.Errorf("%s => [%s, %s], but get [%s, %s]", tc.input, tc.expectStart, tc.expectEnd, gotStart, gotEnd)
+		}
+	}
+}
+
+func TestLimitPeriods(t *testing.T) {
+	end := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	start := end.Add(-time.Hour)
+	moved := start.Add(30 * time.Minute)
+	lookbackDelta := 5 * time.Minute
+
+	// ns-a is granted for the whole period, ns-b is moved in and ns-c is moved out in the middle of it
+	namespaceSet := data.NewSet("ns-a", "ns-b", "ns-c")
+	grants := data.Grants{
+		"ns-b": {{Since: moved}},
+		"ns-c": {{Until: moved}},
+	}
+	at := func(t time.Time) string {
+		return fmt.Sprint(float64(t.Unix()))
+	}
+
+	testCases := []struct {
+		input      string
+		start, end time.Time
+		expect     string
+	}{
+		{`up{namespace="ns-a"}`, start, end, `up{namespace="ns-a"}`},
+		{`node_cpu_seconds_total{namespace=""}`, start, end, `node_cpu_seconds_total{namespace=""}`},
+		{`up{namespace=~"ns-a|ns-b"}`, start, end,
+			fmt.Sprintf(`(up{namespace="ns-a"} or (up{namespace="ns-b"} and on() (vector(time()) >= %s)))`, at(moved.Add(lookbackDelta)))},
+		{`rate(up{namespace=~"ns-b|ns-c"}[10m])`, start, end,
+			fmt.Sprintf(`((rate(up{namespace="ns-b"}[10m]) and on() (vector(time()) >= %s)) or (rate(up{namespace="ns-c"}[10m]) and on() (vector(time()) < %s)))`, at(moved.Add(10*time.Minute)), at(moved))},
+		{`quantile_over_time(0.9, up{namespace="ns-b"}[10m])`, start, end,
+			fmt.Sprintf(`(quantile_over_time(0.9, up{namespace="ns-b"}[10m]) and on() (vector(time()) >= %s))`, at(moved.Add(10*time.Minute)))},
+		{`sum(up{namespace="ns-b"} offset 10m)`, start, end,
+			fmt.Sprintf(`sum((up{namespace="ns-b"} offset 10m and on() (vector(time()) >= %s)))`, at(moved.Add(15*time.Minute)))},
+		// the namespaces are read within their grants for the whole period or left out
+		{`up{namespace="ns-b"} @ end()`, start, end, `up{namespace="ns-b"} @ end()`},
+		{`up{namespace="ns-c"} @ end()`, start, end, `up{namespace="______"} @ end()`},
+		{`absent_over_time(up{namespace="ns-b"}[10m])`, start, end, `absent_over_time(up{namespace="______"}[10m])`},
+		{`up{namespace=~"ns-a|ns-b"}[10m]`, end, end, `up{namespace=~"ns-a|ns-b"}[10m]`},
+		{`rate(up{namespace=~"ns-a|ns-b"}[10m])`, moved, moved, `rate(up{namespace="ns-a"}[10m])`},
+		// the subquery is evaluated over time
+		{`max_over_time(up{namespace="ns-b"}[1h:1m])`, end, end,
+			fmt.Sprintf(`max_over_time((up{namespace="ns-b"} and on() (vector(time()) >= %s))[1h:1m])`, at(moved.Add(lookbackDelta)))},
+	}
+
+	for _, tc := range testCases {
+		expr, err := parser.ParseExpr(tc.input)
+		if err != nil {
+			t.Fatalf("cannot parse %s: %v", tc.input, err)
+		}
+
+		got := LimitPeriods(expr, namespaceSet, grants, tc.start, tc.end, lookbackDelta).String()
+		if got != tc.expect {
+			t.Errorf("%s => %s, but get %s", tc.input, tc.expect, got)
+		}
+		if _, err := parser.ParseExpr(got); err != nil {
+			t.Errorf("cannot parse the limited %s: %v", got, err)
+		}
+	}
+}
@@ -15,3 +15,7 @@ func NewInstantVectorSelectorsForNamespaces(namespaces []string) string {
 
 	return fmt.Sprintf(`{%s}`, ret.String())
 }
+
+func NewExprForCountAllNames() string {
+	return `count ({__name__=~".+"}) by (__name__)`
+}
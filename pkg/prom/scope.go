@@ -0,0 +1,143 @@
+package prom
+
+import (
+	"regexp/syntax"
+	"sort"
+
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+// OutOfScopeNamespaces returns the namespaces named by the matchers outside of the namespaces,
+// e.g. `absent(up{namespace="ns-x"})` of a tenant not owning ns-x, which would be rewritten to select nothing.
+func OutOfScopeNamespaces(namespaceSet data.Set, srcMatchers []*promlb.Matcher) []string {
+	var ret []string
+	for _, m := range srcMatchers {
+		if m.Name != namespaceMatchName {
+			continue
+		}
+		for _, namespace := range namedNamespaces(m) {
+			if _, exist := namespaceSet[namespace]; !exist {
+				ret = append(ret, namespace)
+			}
+		}
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+// NarrowedNamespaces returns the namespaces which a pattern matcher on the namespace label is narrowed to,
+// false is returned for the matchers naming the namespaces, which are narrowed as OutOfScopeNamespaces.
+func NarrowedNamespaces(namespaceSet data.Set, m *promlb.Matcher) ([]string, bool) {
+	if m.Name != namespaceMatchName || m.Type == promlb.MatchEqual {
+		return nil, false
+	}
+	if m.Type == promlb.MatchRegexp {
+		if _, pattern := regexNamespaces(m.Value); !pattern {
+			return nil, false
+		}
+	}
+
+	return matchedNamespaces(namespaceSet, m), true
+}
+
+// namedNamespaces returns the namespaces named by an equality matcher,
+// or by the literal alternatives of a regex matcher, e.g. `ns-a|(ns-b|team-.*)` names ns-a and ns-b.
+func namedNamespaces(m *promlb.Matcher) []string {
+	switch m.Type {
+	case promlb.MatchEqual:
+		if len(m.Value) != 0 {
+			return []string{m.Value}
+		}
+	case promlb.MatchRegexp:
+		names, _ := regexNamespaces(m.Value)
+		return names
+	}
+
+	return nil
+}
+
+// maxRegexNamespaces bounds the expansion of the literal alternatives, e.g. `ns-[a-z][a-z]` is regarded as a pattern.
+const maxRegexNamespaces = 256
+
+// regexNamespaces expands the literal alternatives of a regex after simplifying it, pattern is true if the regex
+// can match anything else, e.g. `(ns-a|ns-b)` names ns-a and ns-b, while `ns-a|team-.*` names ns-a and is a pattern.
+func regexNamespaces(value string) (names []string, pattern bool) {
+	re, err := syntax.Parse(value, syntax.Perl)
+	if err != nil {
+		return nil, true
+	}
+
+	literals, pattern := expandLiterals(re.Simplify())
+	for _, literal := range literals {
+		if len(literal) == 0 {
+			// the series without namespace
+			pattern = true
+			continue
+		}
+		names = append(names, literal)
+	}
+
+	return names, pattern
+}
+
+// expandLiterals returns the strings which the regex matches as a whole, others is true if it matches any other string.
+func expandLiterals(re *syntax.Regexp) (literals []string, others bool) {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return nil, false
+	case syntax.OpEmptyMatch, syntax.OpBeginText, syntax.OpEndText:
+		return []string{""}, false
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, true
+		}
+		return []string{string(re.Rune)}, false
+	case syntax.OpCharClass:
+		for idx := 0; idx+1 < len(re.Rune); idx += 2 {
+			for r := re.Rune[idx]; r <= re.Rune[idx+1]; r++ {
+				if len(literals) == maxRegexNamespaces {
+					return nil, true
+				}
+				literals = append(literals, string(r))
+			}
+		}
+		return literals, false
+	case syntax.OpCapture:
+		return expandLiterals(re.Sub[0])
+	case syntax.OpQuest:
+		literals, others = expandLiterals(re.Sub[0])
+		return append(literals, ""), others
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			subLiterals, subOthers := expandLiterals(sub)
+			if len(literals)+len(subLiterals) > maxRegexNamespaces {
+				return nil, true
+			}
+			literals = append(literals, subLiterals...)
+			others = others || subOthers
+		}
+		return literals, others
+	case syntax.OpConcat:
+		literals = []string{""}
+		for _, sub := range re.Sub {
+			subLiterals, subOthers := expandLiterals(sub)
+			if len(literals)*len(subLiterals) > maxRegexNamespaces {
+				return nil, true
+			}
+			product := make([]string, 0, len(literals)*len(subLiterals))
+			for _, prefix := range literals {
+				for _, suffix := range subLiterals {
+					product = append(product, prefix+suffix)
+				}
+			}
+			literals = product
+			others = others || subOthers
+		}
+		return literals, others
+	}
+
+	// the repetitions and the wildcards
+	return nil, true
+}
@@ -0,0 +1,78 @@
+//go:build test
+
+package prom
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+func TestOutOfScopeNamespaces(t *testing.T) {
+	testCases := []struct {
+		input  string
+		expect []string
+	}{
+		{`up{namespace="ns-a"}`, nil},
+		{`up{namespace="ns-x"}`, []string{"ns-x"}},
+		{`up{namespace=""}`, nil},
+		{`up{namespace=~"ns-y|ns-a|ns-x"}`, []string{"ns-x", "ns-y"}},
+		{`up{namespace=~"ns-x|team-.*"}`, []string{"ns-x"}},
+		{`up{namespace=~"ns-.*"}`, nil},
+		{`up{namespace=~"(ns-x|ns-y)"}`, []string{"ns-x", "ns-y"}},
+		{`up{namespace=~"ns-(x|y)|team-.*"}`, []string{"ns-x", "ns-y"}},
+		{`up{namespace=~"ns-a|ns-x.+"}`, nil},
+		{`up{namespace=~"ns\\.x|ns-y"}`, []string{"ns-y", "ns.x"}},
+		{`up{namespace=~"(?i)ns-x"}`, nil},
+		{`up{namespace!="ns-x"}`, nil},
+		{`up{job="ns-x"}`, nil},
+	}
+
+	for _, tc := range testCases {
+		matchers, err := parser.ParseMetricSelector(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := OutOfScopeNamespaces(data.NewSet("ns-a"), matchers); !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("%s: got %v, want %v", tc.input, got, tc.expect)
+		}
+	}
+}
+
+func TestNarrowedNamespaces(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expect   []string
+		narrowed bool
+	}{
+		{`up{namespace="ns-x"}`, nil, false},
+		{`up{namespace=~"ns-a|ns-x"}`, nil, false},
+		{`up{namespace=~"(ns-a|ns-x)"}`, nil, false},
+		{`up{namespace=~"ns-a|"}`, []string{"ns-a"}, true},
+		{`up{namespace=~"ns-.*"}`, []string{"ns-a", "ns-b"}, true},
+		{`up{namespace!="ns-a"}`, []string{"ns-b", "team-c"}, true},
+		{`up{namespace!~"ns-.*"}`, []string{"team-c"}, true},
+		{`up{job=~".*"}`, nil, false},
+	}
+
+	for _, tc := range testCases {
+		matchers, err := parser.ParseMetricSelector(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		var narrowed bool
+		for _, m := range matchers {
+			if namespaces, ok := NarrowedNamespaces(data.NewSet("ns-a", "ns-b", "team-c"), m); ok {
+				got, narrowed = namespaces, ok
+			}
+		}
+		if narrowed != tc.narrowed || !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("%s: got %v %v, want %v %v", tc.input, got, narrowed, tc.expect, tc.narrowed)
+		}
+	}
+}
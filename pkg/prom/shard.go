@@ -0,0 +1,47 @@
+package prom
+
+import (
+	"github.com/juju/errors"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// crossSeriesFunctions produce results depending on more than one input series,
+// hence they cannot be evaluated shard by shard.
+var crossSeriesFunctions = map[string]struct{}{
+	"absent":             {},
+	"absent_over_time":   {},
+	"histogram_quantile": {},
+	"scalar":             {},
+	"sort":               {},
+	"sort_desc":          {},
+	"vector":             {},
+}
+
+// ValidateFanOut checks whether the expression can be evaluated on every shard and merged afterwards,
+// it only accepts selectors and the functions working on each series independently.
+func ValidateFanOut(expr parser.Expr) error {
+	var ret error
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if ret != nil {
+			return ret
+		}
+
+		switch n := node.(type) {
+		case *parser.AggregateExpr:
+			ret = errors.Errorf("aggregation %q is not supported across shards, query the raw series instead", n.Op)
+		case *parser.BinaryExpr:
+			if n.LHS.Type() == parser.ValueTypeVector && n.RHS.Type() == parser.ValueTypeVector {
+				ret = errors.Errorf("vector matching %q is not supported across shards", n.Op)
+			}
+		case *parser.Call:
+			if _, exist := crossSeriesFunctions[n.Func.Name]; exist {
+				ret = errors.Errorf("function %q is not supported across shards", n.Func.Name)
+			}
+		}
+
+		return ret
+	})
+
+	return ret
+}
@@ -0,0 +1,40 @@
+//go:build test
+
+package prom
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestValidateFanOut(t *testing.T) {
+	testCases := []struct {
+		input   string
+		allowed bool
+	}{
+		{`a`, true},
+		{`a{namespace="ns-a"}[5m]`, true},
+		{`rate(a[5m])`, true},
+		{`a * 2`, true},
+		{`(a)`, true},
+		{`sum(a)`, false},
+		{`count by (namespace) (a)`, false},
+		{`rate(a[5m]) / on(pod) b`, false},
+		{`absent(a)`, false},
+		{`histogram_quantile(0.9, rate(a_bucket[5m]))`, false},
+		{`max_over_time(sum(a)[5m:])`, false},
+	}
+
+	for _, tc := range testCases {
+		expr, err := parser.ParseExpr(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ValidateFanOut(expr)
+		if got := err == nil; got != tc.allowed {
+			t.Errorf("%s: got allowed %v, want %v, error: %v", tc.input, got, tc.allowed, err)
+		}
+	}
+}
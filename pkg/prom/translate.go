@@ -1,82 +1,48 @@
 package prom
 
 import (
-	"fmt"
-	"regexp"
+	"sort"
 
 	promlb "github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/rancher/prometheus-auth/pkg/data"
 )
 
-func translateMatcher(namespaceSet data.Set, srcMatcher *promlb.Matcher) {
-	if namespaceSet == nil || srcMatcher == nil {
-		return
-	}
-
-	value := srcMatcher.Value
-	switch srcMatcher.Type {
-	case promlb.MatchEqual: // =
-		if _, exist := namespaceSet[value]; !exist {
-			srcMatcher.Value = noneNamespace
-		}
-	case promlb.MatchNotEqual: // !=
-		namespaces := namespaceSet.Values()
-		if _, exist := namespaceSet[value]; exist {
-			namespaces = stringSliceIgnore(namespaces, &value)
-		}
-
-		srcMatcher = modifyMatcher(srcMatcher, namespaces)
-	case promlb.MatchRegexp: // =~
-		namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
-			return srcMatcher.Matches(*ns)
-		})
-
-		srcMatcher = modifyMatcher(srcMatcher, namespaces)
-	case promlb.MatchNotRegexp: // !~
-		namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
-			return srcMatcher.Matches(*ns)
-		})
-
-		srcMatcher = modifyMatcher(srcMatcher, namespaces)
-	}
+// translateMatchers returns the canonical matcher selecting the namespaces matched by all the matchers on the namespace label.
+func translateMatchers(namespaceSet data.Set, srcMatchers []*promlb.Matcher) *promlb.Matcher {
+	return createMatcher(namespaceMatchName, matchedNamespaces(namespaceSet, srcMatchers...))
 }
 
-func translateLabelMatcher(namespaceSet data.Set, srcMatcher *prompb.LabelMatcher) {
-	if namespaceSet == nil || srcMatcher == nil {
-		return
+// translateLabelMatchers is translateMatchers of the remote read, an invalid matcher selects none of the namespaces.
+func translateLabelMatchers(namespaceSet data.Set, srcMatchers []*prompb.LabelMatcher) *prompb.LabelMatcher {
+	matchers, err := FromLabelMatchers(srcMatchers)
+	if err != nil {
+		return createLabelMatcher(namespaceMatchName, nil)
 	}
 
-	value := srcMatcher.Value
-	switch srcMatcher.Type {
-	case prompb.LabelMatcher_EQ: // =
-		if _, exist := namespaceSet[value]; !exist {
-			srcMatcher.Value = noneNamespace
-		}
-	case prompb.LabelMatcher_NEQ: // !=
-		namespaces := namespaceSet.Values()
-		if _, exist := namespaceSet[value]; exist {
-			namespaces = stringSliceIgnore(namespaces, &value)
-		}
-
-		modifyLabelMatcher(srcMatcher, namespaces)
-	case prompb.LabelMatcher_RE: // =~
-		valueRegexp, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", value))
-		if err == nil {
-			namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
-				return valueRegexp.MatchString(*ns)
-			})
+	return createLabelMatcher(namespaceMatchName, matchedNamespaces(namespaceSet, matchers...))
+}
 
-			modifyLabelMatcher(srcMatcher, namespaces)
+// matchedNamespaces returns the sorted namespaces matched by all the matchers. Prometheus matches a missing label as
+// the empty value, which is never a namespace, so `namespace=~""` matches none and `namespace!=""` matches all of them.
+func matchedNamespaces(namespaceSet data.Set, matchers ...*promlb.Matcher) []string {
+	ret := make([]string, 0, len(namespaceSet))
+	for namespace := range namespaceSet {
+		if len(namespace) != 0 && matchesAll(matchers, namespace) {
+			ret = append(ret, namespace)
 		}
-	case prompb.LabelMatcher_NRE: // !~
-		valueRegexp, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", value))
-		if err == nil {
-			namespaces := stringSliceFilter(namespaceSet.Values(), func(ns *string) bool {
-				return !valueRegexp.MatchString(*ns)
-			})
+	}
+	sort.Strings(ret)
+
+	return ret
+}
 
-			modifyLabelMatcher(srcMatcher, namespaces)
+func matchesAll(matchers []*promlb.Matcher, value string) bool {
+	for _, m := range matchers {
+		if !m.Matches(value) {
+			return false
 		}
 	}
+
+	return true
 }
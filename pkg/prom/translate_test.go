@@ -0,0 +1,205 @@
+//go:build test
+
+package prom
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	promlb "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rancher/prometheus-auth/pkg/data"
+)
+
+var (
+	// the namespaces of the tenant, and the others of the cluster
+	translateNamespaces = []string{"ns-a", "ns-b", "rx-c", "team-1"}
+	clusterNamespaces   = []string{"ns-a", "ns-b", "rx-c", "team-1", "ns-x", "team-2", "x"}
+
+	regexFragments = []string{"", ".*", ".+", "ns-.*", "n.*", ".*-b", "team-[0-9]", "rx-c|ns-a", "(ns|rx)-[a-c]", "[a-z]+", "x?"}
+)
+
+// generatedMatcher is a random matcher on the namespace label.
+type generatedMatcher struct {
+	Type  promlb.MatchType
+	Value string
+}
+
+func (generatedMatcher) Generate(r *rand.Rand, _ int) reflect.Value {
+	m := generatedMatcher{Type: promlb.MatchType(r.Intn(4))}
+
+	alternatives := make([]string, 1+r.Intn(3))
+	for i := range alternatives {
+		switch r.Intn(3) {
+		case 0:
+			alternatives[i] = clusterNamespaces[r.Intn(len(clusterNamespaces))]
+		case 1:
+			alternatives[i] = regexFragments[r.Intn(len(regexFragments))]
+		default:
+			alternatives[i] = ""
+		}
+	}
+	if m.Type == promlb.MatchEqual || m.Type == promlb.MatchNotEqual {
+		m.Value = alternatives[0]
+		if strings.ContainsAny(m.Value, `.*+?[]()|`) && r.Intn(2) == 0 {
+			m.Value = ""
+		}
+	} else {
+		m.Value = strings.Join(alternatives, "|")
+	}
+
+	return reflect.ValueOf(m)
+}
+
+func (m generatedMatcher) String() string {
+	return fmt.Sprintf("%s%s%q", namespaceMatchName, m.Type, m.Value)
+}
+
+// expectedNamespaces returns the tenant namespaces selected by the matcher, as Prometheus matches a label value.
+func (m generatedMatcher) expectedNamespaces() []string {
+	ret := make([]string, 0, len(translateNamespaces))
+	for _, namespace := range translateNamespaces {
+		var matched bool
+		switch m.Type {
+		case promlb.MatchEqual:
+			matched = namespace == m.Value
+		case promlb.MatchNotEqual:
+			matched = namespace != m.Value
+		case promlb.MatchRegexp:
+			matched = regexp.MustCompile("^(?:" + m.Value + ")$").MatchString(namespace)
+		case promlb.MatchNotRegexp:
+			matched = !regexp.MustCompile("^(?:" + m.Value + ")$").MatchString(namespace)
+		}
+		if matched {
+			ret = append(ret, namespace)
+		}
+	}
+
+	return ret
+}
+
+// selectedNamespaces returns the cluster namespaces selected by a translated matcher.
+func selectedNamespaces(m *promlb.Matcher) []string {
+	ret := make([]string, 0, len(clusterNamespaces))
+	for _, namespace := range translateNamespaces {
+		if m.Matches(namespace) {
+			ret = append(ret, namespace)
+		}
+	}
+	for _, namespace := range clusterNamespaces[len(translateNamespaces):] {
+		if m.Matches(namespace) {
+			// a namespace outside of the tenant is never selected
+			return append(ret, namespace)
+		}
+	}
+
+	return ret
+}
+
+// checkTranslation checks the PromQL and the remote read translations of the matchers select the expected namespaces.
+func checkTranslation(t *testing.T, nsSet data.Set, gms ...generatedMatcher) bool {
+	expect := gms[0].expectedNamespaces()
+	matchers := make([]*promlb.Matcher, 0, len(gms))
+	for _, gm := range gms {
+		expect = intersectNamespaces(expect, gm.expectedNamespaces())
+		matchers = append(matchers, promlb.MustNewMatcher(gm.Type, namespaceMatchName, gm.Value))
+	}
+
+	translated := translateMatchers(nsSet, matchers)
+	if got := selectedNamespaces(translated); !reflect.DeepEqual(expect, got) {
+		t.Logf("%v => %s selects %v, but expect %v", gms, translated, got, expect)
+		return false
+	}
+
+	// translating the canonical matcher again changes nothing
+	if again := translateMatchers(nsSet, []*promlb.Matcher{translated}); again.String() != translated.String() {
+		t.Logf("%v => %s, but translated again to %s", gms, translated, again)
+		return false
+	}
+
+	pbMatchers, err := toLabelMatchers(matchers)
+	if err != nil {
+		t.Logf("%v cannot convert to the remote read matchers: %v", gms, err)
+		return false
+	}
+	pbTranslated, err := FromLabelMatchers([]*prompb.LabelMatcher{translateLabelMatchers(nsSet, pbMatchers)})
+	if err != nil {
+		t.Logf("%v cannot convert from the remote read matcher: %v", gms, err)
+		return false
+	}
+	if pbTranslated[0].String() != translated.String() {
+		t.Logf("%v => %s in remote read, but %s in PromQL", gms, pbTranslated[0], translated)
+		return false
+	}
+
+	return true
+}
+
+func intersectNamespaces(namespaces, others []string) []string {
+	ret := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		for _, other := range others {
+			if namespace == other {
+				ret = append(ret, namespace)
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+func TestTranslateMatcherProperties(t *testing.T) {
+	nsSet := data.NewSet(translateNamespaces...)
+	config := &quick.Config{MaxCount: 2000, Rand: rand.New(rand.NewSource(1))}
+
+	single := func(gm generatedMatcher) bool {
+		return checkTranslation(t, nsSet, gm)
+	}
+	if err := quick.Check(single, config); err != nil {
+		t.Error(err)
+	}
+
+	multiple := func(gm, other, another generatedMatcher) bool {
+		return checkTranslation(t, nsSet, gm, other) && checkTranslation(t, nsSet, gm, other, another)
+	}
+	if err := quick.Check(multiple, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTranslateEmptyMatchers(t *testing.T) {
+	nsSet := data.NewSet(translateNamespaces...)
+
+	testCases := []struct {
+		matchType promlb.MatchType
+		value     string
+		expect    string
+	}{
+		{promlb.MatchEqual, "", `namespace="______"`},
+		{promlb.MatchNotEqual, "", `namespace=~"ns-a|ns-b|rx-c|team-1"`},
+		{promlb.MatchRegexp, "", `namespace="______"`},
+		{promlb.MatchNotRegexp, "", `namespace=~"ns-a|ns-b|rx-c|team-1"`},
+		{promlb.MatchRegexp, "|ns-a", `namespace="ns-a"`},
+		{promlb.MatchNotRegexp, "|ns-a", `namespace=~"ns-b|rx-c|team-1"`},
+		{promlb.MatchRegexp, ".*", `namespace=~"ns-a|ns-b|rx-c|team-1"`},
+		{promlb.MatchNotRegexp, ".+", `namespace="______"`},
+	}
+
+	for _, tc := range testCases {
+		m := promlb.MustNewMatcher(tc.matchType, namespaceMatchName, tc.value)
+		if got := translateMatchers(nsSet, []*promlb.Matcher{m}).String(); got != tc.expect {
+			t.Errorf("%s => %s, but get %s", m, tc.expect, got)
+		}
+	}
+
+	invalid := &prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: namespaceMatchName, Value: "ns-("}
+	if got := translateLabelMatchers(nsSet, []*prompb.LabelMatcher{invalid}); got.Type != prompb.LabelMatcher_EQ || got.Value != noneNamespace {
+		t.Errorf("invalid %s => %s, but get %s", invalid, noneNamespace, got)
+	}
+}